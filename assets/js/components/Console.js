@@ -18,6 +18,9 @@
 import React from 'react';
 import keydown, { ALL_KEYS } from 'react-keydown';
 import Websocket from 'react-websocket';
+import {
+  FrameWriter, MOD_ALT, MOD_CTRL, MOD_META, MOD_SHIFT, RightModifiers, SUBPROTOCOL,
+} from '../protocol';
 
 class Console extends React.Component {
   prohibitedKeys = [
@@ -28,29 +31,115 @@ class Console extends React.Component {
     'Redo',
   ];
 
+  controlKeys = [
+    'WakeUp',
+    'Standby',
+    'AudioVolumeUp',
+    'AudioVolumeDown',
+    'AudioVolumeMute',
+    'MediaPlayPause',
+    'MediaStop',
+    'MediaTrackNext',
+    'MediaTrackPrevious',
+  ];
+
   constructor(props) {
     super(props);
 
     this.state = {
       connected: false,
       ws: false,
+      leds: {},
+      lock: {},
+      redacting: false,
     };
+    this.rightModifiers = new RightModifiers();
     this.handleOpen = this.handleOpen.bind(this);
     this.handleClose = this.handleClose.bind(this);
+    this.handleKeyUp = this.handleKeyUp.bind(this);
+    this.handleMessage = this.handleMessage.bind(this);
+    this.handleMouse = this.handleMouse.bind(this);
+    this.handleWheel = this.handleWheel.bind(this);
+    this.handleControl = this.handleControl.bind(this);
+    this.handleRedact = this.handleRedact.bind(this);
+  }
+
+  componentDidMount() {
+    window.addEventListener('keyup', this.handleKeyUp);
+  }
+
+  componentWillUnmount() {
+    window.removeEventListener('keyup', this.handleKeyUp);
   }
 
   handleOpen() {
+    // Fall back to JSON messages if the server does not support the binary
+    // framing.
+    const ws = this.refWebSocket.state.ws;
+    ws.binaryType = 'arraybuffer';
+    if (ws.protocol === SUBPROTOCOL) {
+      this.frames = new FrameWriter(data => ws.send(data));
+      this.pingInterval = setInterval(() => this.frames.ping(), 5000);
+    }
+
     this.setState({
       ws: true,
     });
   }
 
   handleClose() {
+    clearInterval(this.pingInterval);
+    this.frames = null;
+
     this.setState({
       ws: false,
     });
   }
 
+  handleMessage(data) {
+    if (data instanceof ArrayBuffer) {
+      if (this.frames) {
+        this.frames.receive(data);
+      }
+      return;
+    }
+
+    const event = JSON.parse(data);
+
+    if (event.type === 'leds') {
+      this.setState({
+        leds: event.leds,
+      });
+    }
+
+    if (event.type === 'lock') {
+      this.setState({
+        lock: event,
+      });
+    }
+
+    if (event.type === 'controlRequested' && confirm(event.by + ' has requested control. Hand over control?')) {
+      this.refWebSocket.sendMessage(JSON.stringify({
+        type: 'grantControl',
+      }));
+    }
+  }
+
+  handleRedact() {
+    this.refWebSocket.sendMessage(JSON.stringify({
+      type: this.state.redacting ? 'redactEnd' : 'redactStart',
+    }));
+    this.setState({
+      redacting: !this.state.redacting,
+    });
+  }
+
+  handleControl() {
+    this.refWebSocket.sendMessage(JSON.stringify({
+      type: this.state.lock.controlling ? 'releaseControl' : 'requestControl',
+    }));
+  }
+
   @keydown(ALL_KEYS)
   handleKeys(e) {
     if (this.prohibitedKeys.includes(e.key)) {
@@ -63,12 +152,91 @@ class Console extends React.Component {
       return;
     }
 
+    if (this.controlKeys.includes(e.key)) {
+      this.refWebSocket.sendMessage(JSON.stringify({
+        type: 'control',
+        key: e.key,
+      }));
+      return;
+    }
+
+    this.sendKey('keydown', e);
+  }
+
+  handleKeyUp(e) {
+    if (this.prohibitedKeys.includes(e.key) || this.controlKeys.includes(e.key) || !this.state.ws) {
+      return;
+    }
+
+    this.sendKey('keyup', e);
+  }
+
+  sendKey(type, e) {
+    const right = this.rightModifiers.update(type, e);
+    if (this.frames) {
+      this.frames.key(type, e, right);
+      return;
+    }
+
     const message = {
+      type: type,
       key: e.key,
+      code: e.code,
+      location: e.location,
       shift: e.shiftKey,
       ctrl: e.ctrlKey,
       alt: e.altKey,
       meta: e.metaKey,
+      altGraph: e.getModifierState('AltGraph'),
+      ctrlRight: (right & MOD_CTRL) !== 0,
+      shiftRight: (right & MOD_SHIFT) !== 0,
+      altRight: (right & MOD_ALT) !== 0,
+      metaRight: (right & MOD_META) !== 0,
+    };
+    this.refWebSocket.sendMessage(JSON.stringify(message));
+  }
+
+  handleMouse(e) {
+    this.sendMouse(e, 0);
+  }
+
+  handleWheel(e) {
+    e.preventDefault();
+    this.sendMouse(e, -Math.sign(e.deltaY));
+  }
+
+  sendMouse(e, wheel) {
+    if (!this.state.ws) {
+      return;
+    }
+
+    // Map the pointer onto the area of the element actually covered by the
+    // video, as the video is letterboxed to preserve its aspect ratio.
+    const video = e.currentTarget;
+    const rect = video.getBoundingClientRect();
+    let width = rect.width;
+    let height = rect.height;
+    if (video.videoWidth && video.videoHeight) {
+      const scale = Math.min(rect.width / video.videoWidth, rect.height / video.videoHeight);
+      width = video.videoWidth * scale;
+      height = video.videoHeight * scale;
+    }
+    const left = rect.left + (rect.width - width) / 2;
+    const top = rect.top + (rect.height - height) / 2;
+    const x = Math.min(Math.max((e.clientX - left) / width, 0), 1);
+    const y = Math.min(Math.max((e.clientY - top) / height, 0), 1);
+
+    if (this.frames) {
+      this.frames.mouse(x, y, e.buttons, wheel);
+      return;
+    }
+
+    const message = {
+      type: 'mouse',
+      x: x,
+      y: y,
+      buttons: e.buttons,
+      wheel: wheel,
     };
     this.refWebSocket.sendMessage(JSON.stringify(message));
   }
@@ -78,7 +246,7 @@ class Console extends React.Component {
 
     return (
       <div>
-        <Websocket url={ url } onMessage={ (m) => {} }
+        <Websocket url={ url } protocol={ SUBPROTOCOL } onMessage={ this.handleMessage }
                    onOpen={ this.handleOpen } onClose={ this.handleClose }
                    reconnect={ true } debug={ false }
                    ref={ Websocket => {
@@ -87,8 +255,26 @@ class Console extends React.Component {
         <p className="my-4 text-gray-700">
           <strong className="text-primary-800">Status:</strong> Connecting...
         </p>
+        <p className="my-4 text-gray-700">
+          <strong className="text-primary-800">Num Lock:</strong> { this.state.leds.numLock ? 'On' : 'Off' }
+          <strong className="ml-4 text-primary-800">Caps Lock:</strong> { this.state.leds.capsLock ? 'On' : 'Off' }
+          <strong className="ml-4 text-primary-800">Scroll Lock:</strong> { this.state.leds.scrollLock ? 'On' : 'Off' }
+        </p>
+        <p className="my-4 text-gray-700">
+          <strong className="text-primary-800">Control:</strong> { this.state.lock.controlling ? 'You'
+            : this.state.lock.locked ? this.state.lock.controller : 'Available' }
+          <button className="ml-4 text-primary-800 underline" onClick={ this.handleControl }>
+            { this.state.lock.controlling ? 'Release control' : 'Request control' }
+          </button>
+          <button className="ml-4 text-primary-800 underline" onClick={ this.handleRedact }>
+            { this.state.redacting ? 'Resume recording keystrokes' : 'Hide keystrokes from recording' }
+          </button>
+        </p>
         <div className="console__container">
-          <video className="console"/>
+          <video className="console"
+                 onMouseMove={ this.handleMouse } onMouseDown={ this.handleMouse }
+                 onMouseUp={ this.handleMouse } onWheel={ this.handleWheel }
+                 onContextMenu={ e => e.preventDefault() }/>
           { this.state.connected ? '' : <div className="console__overlay">
             <h1 className="font-bold mt-8 mb-4 text-2xl">Connecting to Remote Machine</h1>
             <h2 className="console__loading_container">
@@ -15,20 +15,137 @@
  * this program.  If not, see <https://www.gnu.org/licenses/>.
  */
 
-import React, { useState } from 'react';
+import React, { useEffect, useState } from 'react';
 import { withRouter } from 'react-router-dom';
 import { useDropzone } from 'react-dropzone';
 
 import { FontAwesomeIcon } from '@fortawesome/react-fontawesome';
 import { faSpinner, faExclamationTriangle, faCheck } from '@fortawesome/free-solid-svg-icons';
 
+import { uploadImage } from '../upload';
+
 function Images() {
   const [ errors, setErrors ] = useState([]);
-  const [ images, setImages ] = useState([
-    { name: 'test.iso', file: '123456.iso' },
-  ]);
+  const [ images, setImages ] = useState([]);
   const [ selectedImage, selectImage ] = useState('');
   const [ files, setFiles ] = useState({});
+  const [ fetchUrl, setFetchUrl ] = useState('');
+  const [ checksum, setChecksum ] = useState('');
+  const [ fetches, setFetches ] = useState([]);
+  const [ dropFiles, setDropFiles ] = useState([]);
+  const [ dropLabel, setDropLabel ] = useState('');
+  const [ seedKind, setSeedKind ] = useState('userData');
+  const [ seedConfig, setSeedConfig ] = useState('');
+  const [ seedMetaData, setSeedMetaData ] = useState('');
+  const [ seedNetwork, setSeedNetwork ] = useState('');
+  const [ seedFormat, setSeedFormat ] = useState('iso');
+  const [ media, setMedia ] = useState([]);
+  const [ lun, setLun ] = useState(0);
+  const [ writable, setWritable ] = useState(false);
+  const [ ejectAction, setEjectAction ] = useState('discard');
+
+  const loadMedia = () => {
+    fetch('/api/media', {
+      credentials: 'same-origin',
+    })
+      .then(res => res.json())
+      .then(res => {
+        if (res.code === 200) {
+          setMedia(res.media);
+        }
+      });
+  };
+
+  useEffect(loadMedia, []);
+
+  const loadImages = () => {
+    fetch('/api/images', {
+      credentials: 'same-origin',
+    })
+      .then(res => res.json())
+      .then(res => {
+        if (res.code === 200) {
+          setImages(res.images);
+        }
+      });
+  };
+
+  useEffect(loadImages, []);
+
+  const loadFetches = () => {
+    fetch('/api/images/fetch', {
+      credentials: 'same-origin',
+    })
+      .then(res => res.json())
+      .then(res => {
+        if (res.code !== 200) {
+          return;
+        }
+
+        if (res.fetches.some((entry, i) => entry.state === 'complete'
+          && (fetches[i] || {}).state !== 'complete')) {
+          loadImages();
+        }
+        setFetches(res.fetches);
+      });
+  };
+
+  useEffect(loadFetches, []);
+
+  useEffect(() => {
+    const active = fetches.some(entry => entry.state === 'downloading' || entry.state === 'verifying');
+    if (!active) {
+      return;
+    }
+
+    const timer = setTimeout(loadFetches, 1000);
+    return () => clearTimeout(timer);
+  }, [ fetches ]);
+
+  const startFetch = e => {
+    e.preventDefault();
+
+    let body = { url: fetchUrl };
+    if (/^https?:\/\//.test(checksum)) {
+      body.checksumUrl = checksum;
+    } else if (checksum.length === 128) {
+      body.sha512 = checksum;
+    } else if (checksum !== '') {
+      body.sha256 = checksum;
+    }
+
+    fetch('/api/images/fetch', {
+      method: 'POST',
+      headers: {
+        'Content-Type': 'application/json',
+      },
+      credentials: 'same-origin',
+      body: JSON.stringify(body),
+    })
+      .then(res => res.json())
+      .then(res => {
+        if (res.code !== 202) {
+          setErrors([ res.message ]);
+          return;
+        }
+
+        setFetchUrl('');
+        setChecksum('');
+        loadFetches();
+      });
+  };
+
+  const cancelFetch = id => {
+    fetch('/api/images/fetch', {
+      method: 'DELETE',
+      headers: {
+        'Content-Type': 'application/json',
+      },
+      credentials: 'same-origin',
+      body: JSON.stringify({ id }),
+    })
+      .then(loadFetches);
+  };
 
   const statusIcon = status => {
     switch (status) {
@@ -72,36 +189,23 @@ function Images() {
       };
       setFiles(clone);
 
-      let data = new FormData();
-      data.append('file', file);
-
-      let request = new XMLHttpRequest();
-      request.onreadystatechange = () => {
-        if (request.readyState === 4) {
-          let response = request.response;
-
-          let clone = Object.assign({}, files);
-          if (response.code === 200) {
-            clone[file.name].status = 10;
-          } else {
-            clone[file.name].status = 5;
-
-            let oldErrors = errors.slice(0);
-            oldErrors.push(response.error);
-            setErrors(oldErrors);
-          }
-          setFiles(clone);
-        }
-      };
-      request.onprogress = e => {
-        let clone = Object.assign({}, files);
-        clone[file.name].progress = e.loaded / e.total;
-        setFiles(clone);
-      };
-
-      request.open('POST', '/api/images');
-      request.responseType = 'json';
-      request.send(data);
+      uploadImage(file, progress => {
+        setFiles(files => Object.assign({}, files, {
+          [file.name]: Object.assign({}, files[file.name], { progress: progress * 100 }),
+        }));
+      })
+        .then(image => {
+          setFiles(files => Object.assign({}, files, {
+            [file.name]: Object.assign({}, files[file.name], { status: 10, uploadedFile: image }),
+          }));
+          loadImages();
+        })
+        .catch(e => {
+          setFiles(files => Object.assign({}, files, {
+            [file.name]: Object.assign({}, files[file.name], { status: 5 }),
+          }));
+          setErrors(errors => errors.concat([ e.message ]));
+        });
     });
   };
 
@@ -139,19 +243,136 @@ function Images() {
   };
 
   const loadImage = () => {
-    const pattern = /^[0-9A-F]{64}.iso$/;
-    if (!pattern.test(selectedImage)) {
-      alert('Invalid image file name supplied.');
+    if (selectedImage === '') {
+      alert('No image selected.');
       return;
     }
 
-    fetch('/api/images/' + selectedImage + '/load', {
-      method: 'PATCH',
+    fetch('/api/media', {
+      method: 'POST',
       headers: {
         'Content-Type': 'application/json',
       },
       credentials: 'same-origin',
-    });
+      body: JSON.stringify({ lun, image: selectedImage, readOnly: !writable }),
+    })
+      .then(res => res.json())
+      .then(res => {
+        if (res.code !== 200) {
+          setErrors([ res.message ]);
+          return;
+        }
+
+        setMedia(res.media);
+      });
+  };
+
+  const ejectImage = () => {
+    fetch('/api/media', {
+      method: 'DELETE',
+      headers: {
+        'Content-Type': 'application/json',
+      },
+      credentials: 'same-origin',
+      body: JSON.stringify({ lun, action: ejectAction }),
+    })
+      .then(res => res.json())
+      .then(res => {
+        if (res.code !== 200) {
+          setErrors([ res.message ]);
+          return;
+        }
+
+        setMedia(res.media);
+        if (res.image.name !== '') {
+          loadImages();
+        }
+      });
+  };
+
+  const buildSeed = e => {
+    e.preventDefault();
+
+    const seed = { [seedKind]: seedConfig, format: seedFormat, lun };
+    if (seedKind !== 'kickstart') {
+      seed.metaData = seedMetaData;
+      seed.networkConfig = seedNetwork;
+    }
+
+    fetch('/api/images/seed', {
+      method: 'POST',
+      headers: {
+        'Content-Type': 'application/json',
+      },
+      credentials: 'same-origin',
+      body: JSON.stringify(seed),
+    })
+      .then(res => res.json())
+      .then(res => {
+        if (res.code !== 200) {
+          setErrors([ res.message ]);
+        }
+
+        loadImages();
+        loadMedia();
+      });
+  };
+
+  const buildDrive = e => {
+    e.preventDefault();
+
+    let data = new FormData();
+    if (dropLabel !== '') {
+      data.append('label', dropLabel);
+    }
+    data.append('lun', String(lun));
+    Array.from(dropFiles).forEach(file => data.append('files', file));
+
+    fetch('/api/images/drop', {
+      method: 'POST',
+      credentials: 'same-origin',
+      body: data,
+    })
+      .then(res => res.json())
+      .then(res => {
+        if (res.code !== 200) {
+          setErrors([ res.message ]);
+        }
+
+        setDropFiles([]);
+        setDropLabel('');
+        loadImages();
+        loadMedia();
+      });
+  };
+
+  const downloadFiles = () => {
+    window.location = '/api/images/files?name=' + encodeURIComponent(selectedImage);
+  };
+
+  const deleteImage = () => {
+    if (!confirm('Delete the selected image from the library?')) {
+      return;
+    }
+
+    fetch('/api/images', {
+      method: 'DELETE',
+      headers: {
+        'Content-Type': 'application/json',
+      },
+      credentials: 'same-origin',
+      body: JSON.stringify({ name: selectedImage }),
+    })
+      .then(res => res.json())
+      .then(res => {
+        if (res.code !== 200) {
+          setErrors([ res.message ]);
+          return;
+        }
+
+        selectImage('');
+        loadImages();
+      });
   };
 
   const {
@@ -161,7 +382,7 @@ function Images() {
   } = useDropzone({
     onDropAccepted: uploadFiles,
     multiple: false,
-    accept: '.iso',
+    accept: [ '.iso', '.img', '.raw', '.gz', '.xz', '.zst' ],
   });
 
   return (
@@ -170,14 +391,37 @@ function Images() {
         <strong>Uploaded Images</strong>
         <div>
           { images.map(image =>
-            <div className="mt-3 p-2 images__item" data-selected={ image.file === selectedImage
-              ? '1' : '0' } data-value={ image.file } onClick={ () =>
-              selectImage(image.file) }>
-              { image.name }
+            <div className="mt-3 p-2 images__item" key={ image.name } data-selected={ image.name === selectedImage
+              ? '1' : '0' } data-value={ image.name } title={ image.sha256 } onClick={ () =>
+              selectImage(image.name) }>
+              { image.label } ({ image.type }, { Math.ceil(image.size / 1048576) } MB)
+              { image.volume ? <small className="block">
+                { image.volume.label }{ image.volume.publisher !== '' ? ` by ${ image.volume.publisher }` : '' }
+                { image.volume.bios ? ' · BIOS' : '' }{ image.volume.uefi ? ' · UEFI' : '' }
+                { !image.volume.bios && !image.volume.uefi ? ' · not bootable' : '' }
+              </small> : '' }
             </div>,
           ) }
         </div>
-        <button className="btn btn-primary mt-2">Load</button>
+        <select className="form-control mt-2" value={ lun } onChange={ e => setLun(parseInt(e.target.value, 10)) }>
+          { media.map(medium => <option key={ medium.lun } value={ medium.lun }>
+            LUN { medium.lun }: { medium.file === '' ? 'empty' : (medium.image || medium.file) }
+            { medium.file !== '' ? (medium.cdrom ? ' (CD-ROM)' : ' (disk)') : '' }
+          </option>) }
+        </select>
+        <label className="mt-2 block">
+          <input type="checkbox" checked={ writable } onChange={ e => setWritable(e.target.checked) }/> Writable
+        </label>
+        { (media.find(medium => medium.lun === lun) || {}).overlay ? <select className="form-control mt-2"
+          value={ ejectAction } onChange={ e => setEjectAction(e.target.value) }>
+          <option value="discard">Discard changes on eject</option>
+          <option value="keep">Keep changes as a new image on eject</option>
+          <option value="merge">Merge changes into the image on eject</option>
+        </select> : '' }
+        <button className="btn btn-primary mt-2" onClick={ loadImage }>Load</button>
+        <button className="btn btn-secondary mt-2 ml-2" onClick={ ejectImage }>Eject</button>
+        <button className="btn btn-secondary mt-2 ml-2" onClick={ downloadFiles }>Download Files</button>
+        <button className="btn btn-danger mt-2 ml-2" onClick={ deleteImage }>Delete</button>
       </div> : '' }
       <div className="relative images__drop_container">
         { errors.length !== 0 ? <div className="alert alert-danger">
@@ -194,6 +438,50 @@ function Images() {
           </div>
         </div>
         <button className="btn btn-primary" onClick={ commitFiles }>Upload</button>
+        <form className="mt-4" onSubmit={ startFetch }>
+          <p><strong>Fetch from URL</strong></p>
+          <input className="form-control mb-2" type="url" placeholder="https://mirror.example/image.iso"
+            value={ fetchUrl } onChange={ e => setFetchUrl(e.target.value) } required/>
+          <input className="form-control mb-2" type="text" placeholder="SHA-256, SHA-512 or checksum file URL"
+            value={ checksum } onChange={ e => setChecksum(e.target.value) }/>
+          <button className="btn btn-primary" type="submit">Fetch</button>
+        </form>
+        <form className="mt-4" onSubmit={ buildDrive }>
+          <p><strong>USB Drive from Files</strong></p>
+          <input className="form-control mb-2" type="text" placeholder="drivers.img"
+            value={ dropLabel } onChange={ e => setDropLabel(e.target.value) }/>
+          <input className="mb-2" type="file" multiple onChange={ e => setDropFiles(e.target.files) } required/>
+          <button className="btn btn-primary" type="submit">Build and Mount</button>
+        </form>
+        <form className="mt-4" onSubmit={ buildSeed }>
+          <p><strong>Installation Seed</strong></p>
+          <select className="form-control mb-2" value={ seedKind } onChange={ e => setSeedKind(e.target.value) }>
+            <option value="userData">cloud-init user-data</option>
+            <option value="autoinstall">Ubuntu autoinstall</option>
+            <option value="kickstart">Kickstart</option>
+          </select>
+          <textarea className="form-control mb-2" rows="8" value={ seedConfig }
+            onChange={ e => setSeedConfig(e.target.value) } required/>
+          { seedKind !== 'kickstart' ? <React.Fragment>
+            <textarea className="form-control mb-2" rows="3" placeholder="meta-data (optional)"
+              value={ seedMetaData } onChange={ e => setSeedMetaData(e.target.value) }/>
+            <textarea className="form-control mb-2" rows="3" placeholder="network-config (optional)"
+              value={ seedNetwork } onChange={ e => setSeedNetwork(e.target.value) }/>
+          </React.Fragment> : '' }
+          <select className="form-control mb-2" value={ seedFormat } onChange={ e => setSeedFormat(e.target.value) }>
+            <option value="iso">ISO image</option>
+            <option value="fat">FAT disk image</option>
+          </select>
+          <button className="btn btn-primary" type="submit">Build and Mount</button>
+        </form>
+        { fetches.map(entry => <div className="flex mt-2 w-full" key={ entry.id }>
+          <span className="w-1/4" title={ entry.error || entry.url }>{ entry.label }</span>
+          <progress className="mr-4 w-1/2" max={ entry.length > 0 ? entry.length : null } value={ entry.received }/>
+          <span className="mr-2">{ entry.state }</span>
+          <button className="btn btn-secondary btn-sm" onClick={ () => cancelFetch(entry.id) }>
+            { entry.state === 'downloading' || entry.state === 'verifying' ? 'Cancel' : 'Dismiss' }
+          </button>
+        </div>) }
       </div>
     </div>
   );
@@ -0,0 +1,174 @@
+/*
+ * Adsisto
+ * Copyright (c) 2019 Andrew Ying
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of version 3 of the GNU General Public License as published by the
+ * Free Software Foundation. In addition, this program is also subject to certain
+ * additional terms available at <SUPPLEMENT.md>.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+ * A PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Binary framing of the input events, see pkg/hid/protocol.go.
+export const SUBPROTOCOL = 'adsisto.v1';
+
+export const FRAME_KEY_DOWN = 0x01;
+export const FRAME_KEY_UP = 0x02;
+export const FRAME_MOUSE = 0x03;
+export const FRAME_CONTROL = 0x04;
+export const FRAME_PING = 0x10;
+export const FRAME_PONG = 0x11;
+export const FRAME_ACK = 0x20;
+
+// Bits of the modifiers bytes in key frames.
+export const MOD_CTRL = 0x01;
+export const MOD_SHIFT = 0x02;
+export const MOD_ALT = 0x04;
+export const MOD_META = 0x08;
+export const MOD_ALT_GRAPH = 0x10;
+
+const HEADER_LENGTH = 6;
+const MAX_COORDINATE = 32767;
+
+const RIGHT_MODIFIERS = {
+  ControlRight: MOD_CTRL,
+  ShiftRight: MOD_SHIFT,
+  AltRight: MOD_ALT,
+  MetaRight: MOD_META,
+};
+
+const encoder = new TextEncoder();
+
+export function modifiers(e) {
+  return (e.ctrlKey ? MOD_CTRL : 0) | (e.shiftKey ? MOD_SHIFT : 0) | (e.altKey ? MOD_ALT : 0) |
+    (e.metaKey ? MOD_META : 0) | (e.getModifierState('AltGraph') ? MOD_ALT_GRAPH : 0);
+}
+
+// RightModifiers tracks the modifiers held down on the right-hand side of the
+// keyboard, as keyboard events only report whether a modifier is held down.
+export class RightModifiers {
+  constructor() {
+    this.held = 0;
+  }
+
+  update(type, e) {
+    const bit = RIGHT_MODIFIERS[e.code] || 0;
+    if (type === 'keydown') {
+      this.held |= bit;
+    } else {
+      this.held &= ~bit;
+    }
+
+    // Keys released while the page did not have the focus are forgotten.
+    this.held &= modifiers(e);
+    return this.held;
+  }
+}
+
+export class FrameWriter {
+  constructor(send) {
+    this.send = send;
+    this.seq = 0;
+    this.acked = 0;
+    this.queue = [];
+    this.latency = null;
+  }
+
+  key(type, e, right) {
+    const code = encoder.encode(e.code);
+    const payload = new Uint8Array(3 + code.length);
+    payload[0] = modifiers(e);
+    payload[1] = right;
+    payload[2] = e.location;
+    payload.set(code, 3);
+
+    this.push(type === 'keydown' ? FRAME_KEY_DOWN : FRAME_KEY_UP, payload);
+    this.flush();
+  }
+
+  mouse(x, y, buttons, wheel) {
+    const payload = new Uint8Array(6);
+    const view = new DataView(payload.buffer);
+    view.setUint16(0, Math.round(x * MAX_COORDINATE));
+    view.setUint16(2, Math.round(y * MAX_COORDINATE));
+    view.setUint8(4, buttons);
+    view.setInt8(5, wheel);
+
+    // Pointer moves are batched until the next frame is painted.
+    this.push(FRAME_MOUSE, payload);
+    if (!this.scheduled) {
+      this.scheduled = true;
+      window.requestAnimationFrame(() => this.flush());
+    }
+  }
+
+  ping() {
+    const payload = new Uint8Array(8);
+    new DataView(payload.buffer).setFloat64(0, performance.now());
+    this.queue.push(this.frame(FRAME_PING, 0, payload));
+    this.flush();
+  }
+
+  push(type, payload) {
+    this.seq++;
+    this.queue.push(this.frame(type, this.seq, payload));
+  }
+
+  frame(type, seq, payload) {
+    const frame = new Uint8Array(HEADER_LENGTH + payload.length);
+    const view = new DataView(frame.buffer);
+    view.setUint8(0, type);
+    view.setUint32(1, seq);
+    view.setUint8(5, payload.length);
+    frame.set(payload, HEADER_LENGTH);
+
+    return frame;
+  }
+
+  flush() {
+    this.scheduled = false;
+    if (this.queue.length === 0) {
+      return;
+    }
+
+    const length = this.queue.reduce((total, frame) => total + frame.length, 0);
+    const batch = new Uint8Array(length);
+    let offset = 0;
+    this.queue.forEach(frame => {
+      batch.set(frame, offset);
+      offset += frame.length;
+    });
+    this.queue = [];
+
+    this.send(batch.buffer);
+  }
+
+  receive(buffer) {
+    const view = new DataView(buffer);
+    let offset = 0;
+
+    while (offset + HEADER_LENGTH <= view.byteLength) {
+      const type = view.getUint8(offset);
+      const seq = view.getUint32(offset + 1);
+      const length = view.getUint8(offset + 5);
+
+      if (type === FRAME_ACK) {
+        this.acked = seq;
+      } else if (type === FRAME_PONG && length === 8) {
+        this.latency = performance.now() - view.getFloat64(offset + HEADER_LENGTH);
+      }
+
+      offset += HEADER_LENGTH + length;
+    }
+  }
+
+  pending() {
+    return this.seq - this.acked;
+  }
+}
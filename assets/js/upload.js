@@ -0,0 +1,111 @@
+/*
+ * Adsisto
+ * Copyright (c) 2019 Andrew Ying
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of version 3 of the GNU General Public License as published by the
+ * Free Software Foundation. In addition, this program is also subject to certain
+ * additional terms available at <SUPPLEMENT.md>.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+ * A PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Resumable uploads of images, see pkg/images/upload.go.
+const TUS_VERSION = '1.0.0';
+const CHUNK_SIZE = 8 * 1024 * 1024;
+const RETRY_DELAY = 3000;
+const MAX_RETRIES = 5;
+
+const headers = extra => Object.assign({ 'Tus-Resumable': TUS_VERSION }, extra);
+
+const utf8ToBase64 = value => btoa(unescape(encodeURIComponent(value)));
+
+const wait = delay => new Promise(resolve => setTimeout(resolve, delay));
+
+const create = file => fetch('/api/uploads', {
+  method: 'POST',
+  headers: headers({
+    'Upload-Length': String(file.size),
+    'Upload-Metadata': 'filename ' + utf8ToBase64(file.name),
+  }),
+  credentials: 'same-origin',
+})
+  .then(res => res.json())
+  .then(res => {
+    if (res.code !== 201) {
+      throw new Error(res.message);
+    }
+
+    return res.upload;
+  });
+
+const offset = id => fetch('/api/uploads?id=' + id, {
+  method: 'HEAD',
+  headers: headers({}),
+  credentials: 'same-origin',
+})
+  .then(res => {
+    if (!res.ok) {
+      throw new Error('Upload could not be resumed');
+    }
+
+    return parseInt(res.headers.get('Upload-Offset'), 10);
+  });
+
+const patch = (id, file, start) => fetch('/api/uploads?id=' + id, {
+  method: 'PATCH',
+  headers: headers({
+    'Content-Type': 'application/offset+octet-stream',
+    'Upload-Offset': String(start),
+  }),
+  credentials: 'same-origin',
+  body: file.slice(start, start + CHUNK_SIZE),
+})
+  .then(res => {
+    if (res.status === 204) {
+      return parseInt(res.headers.get('Upload-Offset'), 10);
+    }
+
+    return res.json().then(body => {
+      const error = new Error(body.message);
+      error.fatal = res.status < 500 && res.status !== 409;
+      throw error;
+    });
+  });
+
+const details = id => fetch('/api/uploads?id=' + id, {
+  credentials: 'same-origin',
+})
+  .then(res => res.json())
+  .then(res => res.upload);
+
+// Uploads the file in chunks, resuming from the last byte received by the
+// server when a chunk fails. Resolves with the name of the image created.
+export const uploadImage = async (file, progress) => {
+  const upload = await create(file);
+  let sent = upload.offset;
+  let retries = 0;
+
+  while (sent < file.size) {
+    try {
+      sent = await patch(upload.id, file, sent);
+      retries = 0;
+      progress(sent / file.size);
+    } catch (e) {
+      if (e.fatal || retries >= MAX_RETRIES) {
+        throw e;
+      }
+
+      retries++;
+      await wait(RETRY_DELAY);
+      sent = await offset(upload.id);
+    }
+  }
+
+  return (await details(upload.id)).image;
+};
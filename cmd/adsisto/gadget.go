@@ -0,0 +1,119 @@
+/*
+ * Adsisto
+ * Copyright (c) 2019 Andrew Ying
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of version 3 of the GNU General Public License as published by the
+ * Free Software Foundation. In addition, this program is also subject to certain
+ * additional terms available at <SUPPLEMENT.md>.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+ * A PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/adsisto/adsisto/pkg/gadget"
+	"log"
+	"os"
+)
+
+const gadgetUsage = `Usage: adsisto gadget [-config path] <command> [udc]
+
+Commands:
+  create    create or update the USB gadget from the config
+  remove    unbind and tear down the USB gadget
+  bind      bind the USB gadget to the UDC, or to the first UDC available
+  unbind    unbind the USB gadget from its UDC
+  status    print the state of the USB gadget
+  udcs      list the USB device controllers available
+`
+
+// newGadget returns the USB gadget defined in the config.
+func newGadget() *gadget.Gadget {
+	names := config.GetStringSlice("gadget.functions")
+	functions, err := gadget.Functions(names, config.GetInt("gadget.luns"))
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return &gadget.Gadget{
+		Root:          config.GetString("gadget.configfs_root"),
+		Name:          config.GetString("gadget.name"),
+		VendorID:      uint16(config.GetInt("gadget.vendor_id")),
+		ProductID:     uint16(config.GetInt("gadget.product_id")),
+		DeviceBCD:     uint16(config.GetInt("gadget.device_version")),
+		USBBCD:        0x0200,
+		SerialNumber:  config.GetString("gadget.serial_number"),
+		Manufacturer:  config.GetString("gadget.manufacturer"),
+		Product:       config.GetString("gadget.product"),
+		Configuration: "Adsisto",
+		MaxPower:      250,
+		RemoteWakeup:  gadget.RemoteWakeup(names),
+		Functions:     functions,
+	}
+}
+
+// gadgetCommand runs the gadget subcommand with the arguments following it.
+func gadgetCommand(args []string) {
+	flags := flag.NewFlagSet("gadget", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, gadgetUsage)
+	}
+	configPath := flags.String("config", "", "path to config file")
+	_ = flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	loadConfig(*configPath)
+	g := newGadget()
+
+	var err error
+	switch flags.Arg(0) {
+	case "create":
+		err = g.Create()
+	case "remove":
+		err = g.Remove()
+	case "bind":
+		udc := flags.Arg(1)
+		if udc == "" {
+			udc = config.GetString("gadget.udc")
+		}
+		err = g.Bind(udc)
+	case "unbind":
+		err = g.Unbind()
+	case "status":
+		var status gadget.Status
+		status, err = g.Status()
+		if err == nil {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			err = encoder.Encode(status)
+		}
+	case "udcs":
+		var udcs []string
+		udcs, err = g.UDCs()
+		for _, udc := range udcs {
+			fmt.Println(udc)
+		}
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "adsisto gadget %s: %s\n", flags.Arg(0), err)
+		os.Exit(1)
+	}
+}
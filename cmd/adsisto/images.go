@@ -18,68 +18,286 @@
 package main
 
 import (
-	"crypto/sha256"
+	"encoding/json"
 	"fmt"
+	"github.com/adsisto/adsisto/pkg/images"
+	"github.com/adsisto/adsisto/pkg/media"
 	"github.com/adsisto/adsisto/pkg/response"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
 	"path/filepath"
+	"strconv"
 )
 
 type ImagesUploader struct {
-	UploadDir string
+	Uploads *images.Uploads
+	Media   *media.Manager
 }
 
+type seedRequest struct {
+	images.Seed
+	// Format is the format of the seed image, i.e. iso or fat
+	Format string `json:"format"`
+	Label  string `json:"label"`
+	// LUN is the logical unit the seed image is mounted on, if not nil
+	LUN *int `json:"lun"`
+}
+
+// UploadHandler adds the file uploaded in the file field of the form to the
+// image library. The file is streamed to disk as it is received; large files
+// should be uploaded with the resumable upload API instead.
 func (h *ImagesUploader) UploadHandler(w http.ResponseWriter, r *http.Request) {
-	file, header, err := r.FormFile("file")
+	reader, err := r.MultipartReader()
 	if err != nil {
-		response.JSON(w, http.StatusBadRequest, map[string]string{
-			"error": fmt.Sprintf("Unable to process file: %s", err),
+		response.JSON(w, http.StatusBadRequest, map[string]interface{}{
+			"code":    http.StatusBadRequest,
+			"message": fmt.Sprintf("Unable to process file: %s", err),
 		})
 		return
 	}
 
-	log.Printf("[INFO] Processing uploaded file %s\n", header.Filename)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			response.JSON(w, http.StatusBadRequest, map[string]interface{}{
+				"code":    http.StatusBadRequest,
+				"message": fmt.Sprintf("Unable to process file: %s", err),
+			})
+			return
+		}
+
+		if part.FormName() != "file" {
+			continue
+		}
+
+		log.Printf("[INFO] Processing uploaded file %s\n", part.FileName())
 
-	if filepath.Ext(header.Filename) != "iso" {
-		response.JSON(w, http.StatusNotAcceptable, map[string]string{
-			"error": "File uploaded must be a .iso file",
+		image, err := h.Uploads.Import(part, part.FileName(), images.Uploader(r))
+		if err != nil {
+			images.UploadError(w, err)
+			return
+		}
+
+		response.JSON(w, http.StatusOK, map[string]interface{}{
+			"code":  http.StatusOK,
+			"file":  image.Name,
+			"image": image,
 		})
 		return
 	}
 
-	content, err := ioutil.ReadAll(file)
+	response.JSON(w, http.StatusBadRequest, map[string]interface{}{
+		"code":    http.StatusBadRequest,
+		"message": "No file uploaded",
+	})
+}
+
+// DropHandler builds a FAT disk image holding the files uploaded in the files
+// field of the form, e.g. to get drivers onto a target without network. The
+// form may also set the label of the image, its size in megabytes and the
+// logical unit it is mounted on as a writable removable disk.
+func (h *ImagesUploader) DropHandler(w http.ResponseWriter, r *http.Request) {
+	reader, err := r.MultipartReader()
 	if err != nil {
-		response.JSON(w, http.StatusBadRequest, map[string]string{
-			"error": fmt.Sprintf("Unable to process file: %s", err),
+		response.JSON(w, http.StatusBadRequest, map[string]interface{}{
+			"code":    http.StatusBadRequest,
+			"message": fmt.Sprintf("Unable to process files: %s", err),
 		})
 		return
 	}
 
-	hash := sha256.New()
-	_, err = hash.Write(content)
+	dir, err := h.Uploads.Stage()
 	if err != nil {
-		response.JSON(w, http.StatusInternalServerError, map[string]string{
-			"error": "Unable to save file to server",
-		})
+		images.UploadError(w, err)
 		return
 	}
+	defer os.RemoveAll(dir)
+
+	label := "drop.img"
+	var size int64
+	lun := -1
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			response.JSON(w, http.StatusBadRequest, map[string]interface{}{
+				"code":    http.StatusBadRequest,
+				"message": fmt.Sprintf("Unable to process files: %s", err),
+			})
+			return
+		}
+
+		if part.FormName() == "files" {
+			name := filepath.Base(part.FileName())
+			if name == "." || name == ".." || name == string(filepath.Separator) {
+				continue
+			}
+
+			file, err := os.Create(filepath.Join(dir, name))
+			if err == nil {
+				_, err = io.Copy(file, part)
+				if closeErr := file.Close(); err == nil {
+					err = closeErr
+				}
+			}
+			if err != nil {
+				images.UploadError(w, err)
+				return
+			}
+			continue
+		}
+
+		value, err := ioutil.ReadAll(io.LimitReader(part, 256))
+		if err != nil {
+			images.UploadError(w, err)
+			return
+		}
 
-	err = ioutil.WriteFile(
-		fmt.Sprintf("%s/%s.iso", h.UploadDir, hash.Sum(nil)),
-		content,
-		0644,
-	)
+		switch part.FormName() {
+		case "label":
+			if len(value) != 0 {
+				label = filepath.Base(string(value))
+			}
+		case "size":
+			size, err = strconv.ParseInt(string(value), 10, 64)
+			size <<= 20
+		case "lun":
+			lun, err = strconv.Atoi(string(value))
+		}
+		if err != nil || size < 0 {
+			response.JSON(w, http.StatusBadRequest, map[string]interface{}{
+				"code":    http.StatusBadRequest,
+				"message": "invalid user inputs",
+			})
+			return
+		}
+	}
+
+	image, err := h.Uploads.BuildFAT(dir, label, size, images.Uploader(r))
 	if err != nil {
-		log.Printf("[ERROR] Unable to save uploaded image file: %s\n", err)
-		response.JSON(w, http.StatusInternalServerError, map[string]string{
-			"error": "Unable to save file to server",
+		images.UploadError(w, err)
+		return
+	}
+
+	log.Printf("[INFO] Built FAT image %s\n", image.Name)
+
+	if lun >= 0 {
+		// The host writes to the image directly, so that its files can be
+		// retrieved while it is mounted. The image is renamed after the
+		// digest of its new content once ejected.
+		cdrom := false
+		err = h.Media.Mount(lun, image.Name, media.Options{CDROM: &cdrom, Direct: true})
+		if err != nil {
+			log.Printf("[ERROR] Unable to mount FAT image: %s\n", err)
+			response.JSON(w, http.StatusConflict, map[string]interface{}{
+				"code":    http.StatusConflict,
+				"message": fmt.Sprintf("Image created but not mounted: %s", err),
+				"image":   image,
+			})
+			return
+		}
+	}
+
+	response.JSON(w, http.StatusOK, map[string]interface{}{
+		"code":  http.StatusOK,
+		"file":  image.Name,
+		"image": image,
+	})
+}
+
+// SeedHandler builds a seed image for an unattended installation, i.e. a
+// cloud-init NoCloud seed or a Kickstart file, and adds it to the library. The
+// image is mounted read-only on the logical unit in the request, if any.
+func (h *ImagesUploader) SeedHandler(w http.ResponseWriter, r *http.Request) {
+	request := &seedRequest{}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(request); err != nil || (request.LUN != nil && *request.LUN < 0) {
+		response.JSON(w, http.StatusBadRequest, map[string]interface{}{
+			"code":    http.StatusBadRequest,
+			"message": "invalid user inputs",
 		})
 		return
 	}
 
-	response.JSON(w, http.StatusOK, map[string]string{
-		"file": fmt.Sprintf("%s.iso", hash.Sum(nil)),
+	label := request.Label
+	if label != "" {
+		label = filepath.Base(label)
+	}
+
+	image, err := h.Uploads.BuildSeed(request.Seed, request.Format, label, images.Uploader(r))
+	if err != nil {
+		images.UploadError(w, err)
+		return
+	}
+
+	log.Printf("[INFO] Built seed image %s\n", image.Name)
+
+	if request.LUN != nil {
+		err = h.Media.Mount(*request.LUN, image.Name, media.Options{ReadOnly: true})
+		if err != nil {
+			log.Printf("[ERROR] Unable to mount seed image: %s\n", err)
+			response.JSON(w, http.StatusConflict, map[string]interface{}{
+				"code":    http.StatusConflict,
+				"message": fmt.Sprintf("Image created but not mounted: %s", err),
+				"image":   image,
+			})
+			return
+		}
+	}
+
+	response.JSON(w, http.StatusOK, map[string]interface{}{
+		"code":  http.StatusOK,
+		"image": image,
 	})
 }
+
+// FilesHandler sends the files of the FAT disk image whose name is given in
+// the query string as a ZIP archive, e.g. the files written by the host.
+func (h *ImagesUploader) FilesHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+
+	// The archive is written to a temporary file first, so that errors can
+	// still be reported.
+	dir, err := h.Uploads.Stage()
+	if err != nil {
+		images.UploadError(w, err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	archive, err := os.Create(filepath.Join(dir, "files.zip"))
+	if err != nil {
+		images.UploadError(w, err)
+		return
+	}
+	defer archive.Close()
+
+	if err = h.Uploads.ExtractFAT(name, archive); err != nil {
+		images.UploadError(w, err)
+		return
+	}
+
+	info, err := archive.Stat()
+	if err == nil {
+		_, err = archive.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		images.UploadError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".zip"))
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	w.WriteHeader(http.StatusOK)
+	_, _ = io.Copy(w, archive)
+}
@@ -25,6 +25,8 @@ import (
 	"fmt"
 	"github.com/adsisto/adsisto/pkg/auth"
 	"github.com/adsisto/adsisto/pkg/hid"
+	"github.com/adsisto/adsisto/pkg/images"
+	"github.com/adsisto/adsisto/pkg/media"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
 	"github.com/go-webpack/webpack"
@@ -58,6 +60,11 @@ var (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "gadget" {
+		gadgetCommand(os.Args[2:])
+		return
+	}
+
 	isDev = flag.Bool("dev", false, "development mode")
 	configPath := flag.String("config", "", "path to config file")
 	privateKey := flag.String("key", "", "path to private key")
@@ -90,7 +97,11 @@ func main() {
 	r.Use(middleware.RequestID)
 	r.Use(middleware.RealIP)
 	r.Use(middleware.Recoverer)
-	r.Use(middleware.Timeout(60 * time.Second))
+
+	// Uploads of images, and ejecting media whose changes are added to the
+	// library, may take longer than the timeout, which therefore only applies
+	// to the other routes.
+	timeout := middleware.Timeout(60 * time.Second)
 
 	var server *http.Server
 	if *isDev {
@@ -120,21 +131,114 @@ func main() {
 		log.Println("[INFO] Configured web server for SSL")
 	}
 
-	loadAssets(r, *isDev)
-	authRoutes(r)
+	var authenticator *auth.JWTMiddleware
+	r.Group(func(r chi.Router) {
+		r.Use(timeout)
+		loadAssets(r, *isDev)
+		authenticator = authRoutes(r)
+	})
 
+	adminOnly := authenticator.HasAccessLevel(auth.AdminLevel)
 	r.Group(func(auth chi.Router) {
+		auth.Use(authenticator.Authenticated)
+		auth.Use(timeout)
 		auth.Get("/", HomeRenderer)
 
 		s := &hid.Stream{
-			Device: config.GetString("usb.hid_device"),
+			Device:        config.GetString("usb.hid_device"),
+			MouseDevice:   config.GetString("usb.mouse_device"),
+			ControlDevice: config.GetString("usb.control_device"),
+			TypeDelay:     time.Millisecond * time.Duration(config.GetInt("usb.type_delay")),
+			Layout:        config.GetString("usb.keyboard_layout"),
+			HoldTimeout:   time.Millisecond * time.Duration(config.GetInt("usb.hold_timeout")),
+			IdleTimeout:   time.Second * time.Duration(config.GetInt("usb.idle_timeout")),
+			Macros: &hid.MacroStore{
+				Path: config.GetString("app.data_dir") + "macros.json",
+			},
+			Recordings: &hid.RecordingStore{
+				Dir: config.GetString("app.data_dir") + "recordings",
+			},
+			RecordSessions: config.GetBool("usb.record_sessions"),
 		}
+		go s.ListenLEDs(context.Background())
+		go s.Watchdog(context.Background())
+
 		auth.Get("/api/keystrokes", s.WebsocketHandler)
+		auth.Get("/api/keyboard/leds", s.LEDsHandler)
+		auth.Post("/api/keyboard/control", s.ControlHandler)
+		auth.Get("/api/keyboard/type", s.TypeStatusHandler)
+		auth.Post("/api/keyboard/type", s.TypeHandler)
+		auth.Delete("/api/keyboard/type", s.TypeCancelHandler)
+		auth.Get("/api/macros", s.MacrosIndexHandler)
+		auth.Post("/api/macros", s.MacroInsertHandler)
+		auth.Put("/api/macros", s.MacroUpdateHandler)
+		auth.Delete("/api/macros", s.MacroDeleteHandler)
+		auth.Post("/api/macros/run", s.MacroRunHandler)
+		auth.Get("/api/recordings", s.RecordingsIndexHandler)
+		auth.Post("/api/recordings", s.RecordingImportHandler)
+		auth.Delete("/api/recordings", s.RecordingDeleteHandler)
+		auth.Get("/api/recordings/download", s.RecordingDownloadHandler)
+		auth.Put("/api/recordings/redact", s.RecordingRedactHandler)
+		auth.Post("/api/recordings/replay", s.RecordingReplayHandler)
+
+		g := newGadget()
+		auth.Group(func(admin chi.Router) {
+			admin.Use(adminOnly)
+			admin.Get("/api/gadget", g.StatusHandler)
+			admin.Put("/api/gadget", g.ApplyHandler)
+			admin.Post("/api/gadget/bind", g.BindHandler)
+			admin.Post("/api/gadget/unbind", g.UnbindHandler)
+		})
+
+		catalogue := &images.Catalogue{
+			Dir:   config.GetString("images.upload_dir"),
+			Quota: int64(config.GetInt("images.quota")) << 20,
+		}
+		auth.Get("/api/images", catalogue.IndexHandler)
+		auth.Get("/api/images/info", catalogue.ShowHandler)
+		auth.Put("/api/images", catalogue.RenameHandler)
+		auth.Delete("/api/images", catalogue.DeleteHandler)
 
-		images := &ImagesUploader{
-			UploadDir: config.GetString("images.upload_dir"),
+		uploads := &images.Uploads{
+			Catalogue: catalogue,
 		}
-		auth.Post("/api/images", images.UploadHandler)
+
+		m := &media.Manager{
+			Dir:        g.FunctionDir("mass_storage"),
+			Catalogue:  catalogue,
+			Uploads:    uploads,
+			OverlayDir: config.GetString("images.overlay_dir"),
+		}
+		catalogue.InUse = m.InUse
+		auth.Get("/api/media", m.StatusHandler)
+		auth.Post("/api/media", m.MountHandler)
+
+		fetcher := &images.Fetcher{
+			Catalogue: catalogue,
+		}
+		auth.Get("/api/images/fetch", fetcher.FetchIndexHandler)
+		auth.Post("/api/images/fetch", fetcher.FetchHandler)
+		auth.Delete("/api/images/fetch", fetcher.FetchCancelHandler)
+
+		uploader := &ImagesUploader{
+			Uploads: uploads,
+			Media:   m,
+		}
+
+		r.Group(func(auth chi.Router) {
+			auth.Use(authenticator.Authenticated)
+			auth.Post("/api/images", uploader.UploadHandler)
+			auth.Post("/api/images/drop", uploader.DropHandler)
+			auth.Post("/api/images/seed", uploader.SeedHandler)
+			auth.Get("/api/images/files", uploader.FilesHandler)
+			auth.Delete("/api/media", m.EjectHandler)
+			auth.Options("/api/uploads", uploads.UploadOptionsHandler)
+			auth.Post("/api/uploads", uploads.UploadCreateHandler)
+			auth.Head("/api/uploads", uploads.UploadOffsetHandler)
+			auth.Get("/api/uploads", uploads.UploadShowHandler)
+			auth.Patch("/api/uploads", uploads.UploadPatchHandler)
+			auth.Delete("/api/uploads", uploads.UploadDeleteHandler)
+		})
 	})
 
 	ch := make(chan os.Signal, 1)
@@ -193,7 +297,7 @@ func loadConfig(path string) {
 	cookieName = config.GetString("app.cookie_name")
 }
 
-func authRoutes(r *chi.Mux) *auth.JWTMiddleware {
+func authRoutes(r chi.Router) *auth.JWTMiddleware {
 	storeConfig := config.GetStringMapString("keys.store_config")
 	parsedStoreConfig := make(map[string]string)
 
@@ -242,7 +346,7 @@ func authRoutes(r *chi.Mux) *auth.JWTMiddleware {
 	return m
 }
 
-func loadAssets(r *chi.Mux, dev bool) {
+func loadAssets(r chi.Router, dev bool) {
 	webpack.FsPath = "./public"
 	webpack.WebPath = "/"
 	webpack.Plugin = "manifest"
@@ -25,7 +25,6 @@ import (
 	"github.com/adsisto/adsisto/pkg/response"
 	"gopkg.in/go-playground/validator.v9"
 	"net/http"
-	"reflect"
 	"regexp"
 )
 
@@ -36,6 +35,9 @@ type authRequest struct {
 const (
 	claimsKey     int = 0
 	HeaderPattern     = `Bearer ([A-Za-z0-9\-\._~\+\/]+=*)$`
+	// AdminLevel is the access level required to administer the device, e.g.
+	// to manage the accounts or the USB gadget
+	AdminLevel = 100
 )
 
 var (
@@ -116,7 +118,7 @@ func (m *JWTMiddleware) Authenticated(next http.Handler) http.Handler {
 
 		cookie, _ := r.Cookie(m.CookieName)
 
-		if t == "" && cookie.String() == "" {
+		if t == "" && (cookie == nil || cookie.Value == "") {
 			http.Redirect(w, r, "/auth/login", http.StatusTemporaryRedirect)
 			return
 		}
@@ -131,9 +133,9 @@ func (m *JWTMiddleware) Authenticated(next http.Handler) http.Handler {
 				return
 			}
 
-			jwt = match[0]
+			jwt = match[1]
 		} else {
-			jwt = cookie.String()
+			jwt = cookie.Value
 		}
 
 		token, err := jws.ParseJWT([]byte(jwt))
@@ -160,28 +162,48 @@ func (m *JWTMiddleware) Authenticated(next http.Handler) http.Handler {
 	})
 }
 
+// AccessLevel returns the access level of the user authenticated in the request
+// context, or 0 if the request is not authenticated.
+func AccessLevel(ctx context.Context) int {
+	user, ok := ctx.Value(claimsKey).(map[string]interface{})
+	if !ok {
+		return 0
+	}
+
+	switch level := user["AccessLevel"].(type) {
+	case float64:
+		return int(level)
+	case int:
+		return level
+	default:
+		return 0
+	}
+}
+
+// Identity returns the identity of the user authenticated in the request
+// context, or an empty string if the request is not authenticated.
+func Identity(ctx context.Context) string {
+	user, ok := ctx.Value(claimsKey).(map[string]interface{})
+	if !ok {
+		return ""
+	}
+
+	identity, _ := user["Identity"].(string)
+	return identity
+}
+
 // HasAccessLevel returns the middleware which can be used to protect routes from
-// being accessed by user with an access level lower than lv.
+// being accessed by user with an access level lower than lv. It must be used
+// after Authenticated.
 func (m *JWTMiddleware) HasAccessLevel(lv int64) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		fn := func(w http.ResponseWriter, r *http.Request) {
-			user := r.Context().Value(claimsKey)
-			if user == nil {
-				m.Unauthorised(http.StatusForbidden, w)
-				return
-			}
-
-			reflected := reflect.ValueOf(user)
-			if reflected.Kind() != reflect.Map ||
-				reflected.MapIndex(reflect.ValueOf("accessLevel")) == reflect.Zero(reflected.Type()) {
-				response.JSON(w, http.StatusInternalServerError, map[string]interface{}{
-					"code":    http.StatusInternalServerError,
-					"message": "user instance in authentication token is invalid",
-				})
+			if r.Context().Value(claimsKey) == nil {
+				m.Unauthorised(http.StatusUnauthorized, w)
 				return
 			}
 
-			if reflected.MapIndex(reflect.ValueOf("accessLevel")).Int() < lv {
+			if int64(AccessLevel(r.Context())) < lv {
 				m.Unauthorised(http.StatusForbidden, w)
 				return
 			}
@@ -192,3 +214,12 @@ func (m *JWTMiddleware) HasAccessLevel(lv int64) func(http.Handler) http.Handler
 		return http.HandlerFunc(fn)
 	}
 }
+
+// unauthorised responds with the status code when the request is not
+// authenticated or the user is not allowed to access the route.
+func unauthorised(code int, w http.ResponseWriter) {
+	response.JSON(w, code, map[string]interface{}{
+		"code":    code,
+		"message": "unauthorised",
+	})
+}
@@ -19,6 +19,7 @@ package auth
 
 import (
 	"errors"
+	"fmt"
 	"github.com/SermoDigital/jose/crypto"
 	"github.com/SermoDigital/jose/jws"
 	"github.com/SermoDigital/jose/jwt"
@@ -67,6 +68,8 @@ type KeysStoreInterface interface {
 type KeyInstance struct {
 	Key         string
 	AccessLevel int
+	// Identity is the identity the key belongs to
+	Identity string
 }
 
 var (
@@ -140,6 +143,10 @@ func (m *JWTMiddleware) MiddlewareInit() error {
 		return ErrMissingPrivKey
 	}
 
+	if m.Unauthorised == nil {
+		m.Unauthorised = unauthorised
+	}
+
 	if m.AuthorisedKeys == nil {
 		m.AuthorisedKeys = keysInterfaces[m.Interface]
 		m.AuthorisedKeys.New(m.InterfaceConfig)
@@ -216,6 +223,7 @@ func (m *JWTMiddleware) ValidateAuthnRequest(t string) (interface{}, error) {
 		return nil, nil
 	}
 
+	key.Identity = fmt.Sprint(issuer)
 	return key, nil
 }
 
@@ -228,6 +236,9 @@ func (m *JWTMiddleware) GetSessionToken(data interface{}) (string, error) {
 	claim.SetIssuedAt(now)
 	claim.SetNotBefore(now)
 	claim.SetExpiration(now.Add(m.SessionTimeout))
+	if key, ok := data.(KeyInstance); ok {
+		claim.SetSubject(key.Identity)
+	}
 	claim.Set("user", data)
 
 	token := jws.NewJWT(claim, jws.GetSigningMethod(m.SigningAlgorithm))
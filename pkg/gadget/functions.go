@@ -0,0 +1,155 @@
+/*
+ * Adsisto
+ * Copyright (c) 2019 Andrew Ying
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of version 3 of the GNU General Public License as published by the
+ * Free Software Foundation. In addition, this program is also subject to certain
+ * additional terms available at <SUPPLEMENT.md>.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+ * A PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package gadget
+
+import (
+	"fmt"
+	"github.com/adsisto/adsisto/pkg/hid"
+)
+
+// Names of the functions which can be enabled in the configuration.
+const (
+	FunctionKeyboard    = "keyboard"
+	FunctionMouse       = "mouse"
+	FunctionControl     = "control"
+	FunctionMassStorage = "mass_storage"
+	FunctionSerial      = "serial"
+)
+
+// MaxLUNs is the maximum number of logical units of the mass storage function
+// supported by the kernel.
+const MaxLUNs = 16
+
+// Protocols of the HID boot interface subclass.
+const (
+	ProtocolNone     = 0
+	ProtocolKeyboard = 1
+	ProtocolMouse    = 2
+)
+
+// HIDFunction returns a HID function with the report descriptor.
+func HIDFunction(instance string, subclass int, protocol int, reportLength int, descriptor []byte) Function {
+	return Function{
+		Type:     "hid",
+		Instance: instance,
+		Attributes: []Attribute{
+			{"protocol", []byte(fmt.Sprint(protocol))},
+			{"subclass", []byte(fmt.Sprint(subclass))},
+			{"report_length", []byte(fmt.Sprint(reportLength))},
+			{"report_desc", descriptor},
+		},
+	}
+}
+
+// MassStorageFunction returns a mass storage function with the given number of
+// logical units, initially without any medium. The mode of each unit is set
+// when a medium is mounted, see pkg/media.
+func MassStorageFunction(instance string, luns int) Function {
+	attributes := []Attribute{
+		{"stall", []byte("1")},
+	}
+
+	for i := 0; i < luns; i++ {
+		lun := fmt.Sprintf("lun.%d/", i)
+		attributes = append(attributes,
+			Attribute{lun + "nofua", []byte("0")},
+			Attribute{lun + "removable", []byte("1")},
+		)
+	}
+
+	return Function{
+		Type:       "mass_storage",
+		Instance:   instance,
+		Attributes: attributes,
+	}
+}
+
+// SerialFunction returns an ACM serial function.
+func SerialFunction(instance string) Function {
+	return Function{
+		Type:     "acm",
+		Instance: instance,
+	}
+}
+
+// RemoteWakeup returns whether the functions with the given names include the
+// system controls, which can wake up the host from suspend.
+func RemoteWakeup(names []string) bool {
+	for _, name := range names {
+		if name == FunctionControl {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Functions returns the functions with the given names, in the order of the
+// HID devices expected by Adsisto, i.e. /dev/hidg0 is the keyboard, followed by
+// the mouse and the controls. The mass storage function has the given number
+// of logical units.
+func Functions(names []string, luns int) ([]Function, error) {
+	enabled := map[string]bool{}
+	for _, name := range names {
+		switch name {
+		case FunctionKeyboard, FunctionMouse, FunctionControl, FunctionMassStorage, FunctionSerial:
+			enabled[name] = true
+		default:
+			return nil, fmt.Errorf("unknown gadget function %s", name)
+		}
+	}
+
+	if enabled[FunctionMassStorage] && (luns < 1 || luns > MaxLUNs) {
+		return nil, fmt.Errorf("number of logical units must be between 1 and %d", MaxLUNs)
+	}
+
+	var functions []Function
+	hidIndex := 0
+	nextHID := func() string {
+		instance := fmt.Sprintf("usb%d", hidIndex)
+		hidIndex++
+		return instance
+	}
+
+	if enabled[FunctionSerial] {
+		functions = append(functions, SerialFunction("usb0"))
+	}
+	if enabled[FunctionKeyboard] {
+		functions = append(functions, HIDFunction(
+			nextHID(), 1, ProtocolKeyboard,
+			hid.KeyboardReportLength, hid.KeyboardReportDescriptor,
+		))
+	}
+	if enabled[FunctionMouse] {
+		functions = append(functions, HIDFunction(
+			nextHID(), 0, ProtocolMouse,
+			hid.MouseReportLength, hid.MouseReportDescriptor,
+		))
+	}
+	if enabled[FunctionControl] {
+		functions = append(functions, HIDFunction(
+			nextHID(), 0, ProtocolNone,
+			hid.ControlReportLength, hid.ControlReportDescriptor,
+		))
+	}
+	if enabled[FunctionMassStorage] {
+		functions = append(functions, MassStorageFunction("usb0", luns))
+	}
+
+	return functions, nil
+}
@@ -0,0 +1,419 @@
+/*
+ * Adsisto
+ * Copyright (c) 2019 Andrew Ying
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of version 3 of the GNU General Public License as published by the
+ * Free Software Foundation. In addition, this program is also subject to certain
+ * additional terms available at <SUPPLEMENT.md>.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+ * A PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package gadget
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// DefaultRoot is the path to the USB gadget directory of configfs.
+	DefaultRoot = "/sys/kernel/config/usb_gadget"
+	// DefaultUDCDir is the path to the directory listing the USB device
+	// controllers.
+	DefaultUDCDir = "/sys/class/udc"
+	// Language is the language of the strings of the gadget, i.e. US English.
+	Language = "0x409"
+	// ConfigName is the name of the only configuration of the gadget.
+	ConfigName = "c.1"
+	// LegacyName is the name of the gadget created by the former init-usb
+	// script, which claims the same UDC.
+	LegacyName = "ipmi"
+)
+
+// Gadget is a composite USB gadget configured through configfs.
+type Gadget struct {
+	// Root is the path to the USB gadget directory of configfs, or
+	// DefaultRoot if empty
+	Root string
+	// UDCDir is the path to the directory listing the UDCs, or DefaultUDCDir
+	// if empty
+	UDCDir string
+	// Name is the name of the gadget directory
+	Name         string
+	VendorID     uint16
+	ProductID    uint16
+	DeviceBCD    uint16
+	USBBCD       uint16
+	SerialNumber string
+	Manufacturer string
+	Product      string
+	// Configuration is the description of the configuration
+	Configuration string
+	// MaxPower is the maximum power drawn from the bus in mA
+	MaxPower int
+	// RemoteWakeup is whether the configuration supports waking up the host
+	// from suspend, e.g. with the system wake control
+	RemoteWakeup bool
+	// Functions are the functions of the gadget, in the order they are linked
+	// to the configuration
+	Functions []Function
+}
+
+// Function is a function of the gadget, e.g. a HID device.
+type Function struct {
+	// Type is the name of the function driver, e.g. hid or mass_storage
+	Type string
+	// Instance is the name of the instance of the function, e.g. usb0
+	Instance string
+	// Attributes are written to the function directory in order
+	Attributes []Attribute
+}
+
+// Attribute is a file in a configfs directory.
+type Attribute struct {
+	// Path is the path to the file relative to the directory
+	Path  string
+	Value []byte
+}
+
+// Status is the state of the gadget in configfs.
+type Status struct {
+	Created   bool     `json:"created"`
+	UDC       string   `json:"udc"`
+	Functions []string `json:"functions"`
+}
+
+var (
+	ErrNotCreated = errors.New("gadget has not been created")
+	ErrBound      = errors.New("gadget is bound to a UDC")
+	ErrNoUDC      = errors.New("no USB device controller available")
+	ErrUnknownUDC = errors.New("USB device controller not found")
+)
+
+// Name returns the name of the function directory, e.g. hid.usb0.
+func (f *Function) Name() string {
+	return f.Type + "." + f.Instance
+}
+
+// Create creates the gadget, or updates it to match its definition. Functions
+// no longer part of the definition are removed. The gadget must be unbound. The
+// gadget left by the former init-usb script, if any, is removed first.
+func (g *Gadget) Create() error {
+	if udc, err := g.BoundUDC(); err != nil {
+		return err
+	} else if udc != "" {
+		return ErrBound
+	}
+
+	if g.Name != LegacyName {
+		legacy := &Gadget{Root: g.Root, UDCDir: g.UDCDir, Name: LegacyName}
+		if err := legacy.Remove(); err != nil {
+			return fmt.Errorf("unable to remove the gadget %s left by init-usb: %s", LegacyName, err)
+		}
+	}
+
+	attributes := []Attribute{
+		{"idVendor", hex(g.VendorID)},
+		{"idProduct", hex(g.ProductID)},
+		{"bcdDevice", hex(g.DeviceBCD)},
+		{"bcdUSB", hex(g.USBBCD)},
+		{"strings/" + Language + "/serialnumber", []byte(g.SerialNumber)},
+		{"strings/" + Language + "/manufacturer", []byte(g.Manufacturer)},
+		{"strings/" + Language + "/product", []byte(g.Product)},
+		{"configs/" + ConfigName + "/strings/" + Language + "/configuration", []byte(g.Configuration)},
+		{"configs/" + ConfigName + "/MaxPower", []byte(fmt.Sprint(g.MaxPower))},
+		{"configs/" + ConfigName + "/bmAttributes", hex8(g.bmAttributes())},
+	}
+	if err := writeAttributes(g.path(), attributes); err != nil {
+		return err
+	}
+
+	wanted := map[string]bool{}
+	for _, function := range g.Functions {
+		wanted[function.Name()] = true
+	}
+
+	if err := g.removeFunctions(wanted); err != nil {
+		return err
+	}
+
+	for _, function := range g.Functions {
+		dir := g.path("functions", function.Name())
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+
+		if err := writeAttributes(dir, function.Attributes); err != nil {
+			return fmt.Errorf("%s: %s", function.Name(), err)
+		}
+
+		if err := os.Symlink(dir, g.path("configs", ConfigName, function.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Remove tears down the gadget, unbinding it first if needed. The directories
+// are removed in the order required by configfs.
+func (g *Gadget) Remove() error {
+	if _, err := os.Stat(g.path()); os.IsNotExist(err) {
+		return nil
+	}
+
+	if err := g.Unbind(); err != nil {
+		return err
+	}
+
+	if err := g.removeFunctions(map[string]bool{}); err != nil {
+		return err
+	}
+
+	dirs := []string{
+		g.path("configs", ConfigName, "strings", Language),
+		g.path("configs", ConfigName),
+		g.path("strings", Language),
+		g.path(),
+	}
+	for _, dir := range dirs {
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Bind binds the gadget to the UDC, or to the first UDC available if udc is
+// empty.
+func (g *Gadget) Bind(udc string) error {
+	if _, err := os.Stat(g.path()); os.IsNotExist(err) {
+		return ErrNotCreated
+	}
+
+	udcs, err := g.UDCs()
+	if err != nil {
+		return err
+	}
+
+	if udc == "" {
+		if len(udcs) == 0 {
+			return ErrNoUDC
+		}
+		udc = udcs[0]
+	}
+
+	found := false
+	for _, available := range udcs {
+		if available == udc {
+			found = true
+		}
+	}
+	if !found {
+		return ErrUnknownUDC
+	}
+
+	if bound, err := g.BoundUDC(); err != nil {
+		return err
+	} else if bound == udc {
+		return nil
+	} else if bound != "" {
+		return ErrBound
+	}
+
+	return ioutil.WriteFile(g.path("UDC"), []byte(udc+"\n"), 0644)
+}
+
+// Unbind unbinds the gadget from its UDC, if bound.
+func (g *Gadget) Unbind() error {
+	udc, err := g.BoundUDC()
+	if err != nil || udc == "" {
+		return err
+	}
+
+	return ioutil.WriteFile(g.path("UDC"), []byte("\n"), 0644)
+}
+
+// BoundUDC returns the name of the UDC the gadget is bound to, or an empty
+// string if the gadget is not bound or not created.
+func (g *Gadget) BoundUDC() (string, error) {
+	content, err := ioutil.ReadFile(g.path("UDC"))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(content)), nil
+}
+
+// UDCs returns the names of the UDCs available.
+func (g *Gadget) UDCs() ([]string, error) {
+	dir := g.UDCDir
+	if dir == "" {
+		dir = DefaultUDCDir
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	udcs := make([]string, 0, len(files))
+	for _, file := range files {
+		udcs = append(udcs, file.Name())
+	}
+
+	return udcs, nil
+}
+
+// Status returns the state of the gadget in configfs.
+func (g *Gadget) Status() (Status, error) {
+	status := Status{
+		Functions: []string{},
+	}
+
+	if _, err := os.Stat(g.path()); os.IsNotExist(err) {
+		return status, nil
+	} else if err != nil {
+		return status, err
+	}
+	status.Created = true
+
+	udc, err := g.BoundUDC()
+	if err != nil {
+		return status, err
+	}
+	status.UDC = udc
+
+	files, err := ioutil.ReadDir(g.path("configs", ConfigName))
+	if err != nil && !os.IsNotExist(err) {
+		return status, err
+	}
+
+	for _, file := range files {
+		if file.Mode()&os.ModeSymlink != 0 {
+			status.Functions = append(status.Functions, file.Name())
+		}
+	}
+
+	return status, nil
+}
+
+// removeFunctions unlinks every function from the configuration, as the
+// kernel refuses to change the attributes of linked functions, and removes the
+// functions which are not wanted.
+func (g *Gadget) removeFunctions(wanted map[string]bool) error {
+	links, err := ioutil.ReadDir(g.path("configs", ConfigName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, link := range links {
+		if link.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+
+		if err = os.Remove(g.path("configs", ConfigName, link.Name())); err != nil {
+			return err
+		}
+	}
+
+	functions, err := ioutil.ReadDir(g.path("functions"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, function := range functions {
+		if wanted[function.Name()] {
+			continue
+		}
+
+		if err = os.RemoveAll(g.path("functions", function.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// FunctionDir returns the path to the directory of the first function of the
+// given type, or an empty string if the gadget has no such function.
+func (g *Gadget) FunctionDir(functionType string) string {
+	for _, function := range g.Functions {
+		if function.Type == functionType {
+			return g.path("functions", function.Name())
+		}
+	}
+
+	return ""
+}
+
+func (g *Gadget) path(elem ...string) string {
+	root := g.Root
+	if root == "" {
+		root = DefaultRoot
+	}
+
+	return filepath.Join(append([]string{root, g.Name}, elem...)...)
+}
+
+// writeAttributes writes the attributes to the files in dir, creating the
+// parent directories as needed. Attributes already holding the value are left
+// untouched, as configfs refuses most writes to a function linked to the
+// configuration.
+func writeAttributes(dir string, attributes []Attribute) error {
+	for _, attribute := range attributes {
+		path := filepath.Join(dir, attribute.Path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+
+		current, err := ioutil.ReadFile(path)
+		if err == nil && bytes.Equal(bytes.TrimRight(current, "\n"), bytes.TrimRight(attribute.Value, "\n")) {
+			continue
+		}
+
+		if err := ioutil.WriteFile(path, attribute.Value, 0644); err != nil {
+			return fmt.Errorf("unable to write %s: %s", attribute.Path, err)
+		}
+	}
+
+	return nil
+}
+
+// bmAttributes returns the attributes of the configuration descriptor, i.e.
+// bus-powered, and remote wakeup if supported.
+func (g *Gadget) bmAttributes() byte {
+	attributes := byte(0x80)
+	if g.RemoteWakeup {
+		attributes |= 0x20
+	}
+
+	return attributes
+}
+
+func hex8(value byte) []byte {
+	return []byte(fmt.Sprintf("0x%02x", value))
+}
+
+func hex(value uint16) []byte {
+	return []byte(fmt.Sprintf("0x%04x", value))
+}
@@ -0,0 +1,331 @@
+/*
+ * Adsisto
+ * Copyright (c) 2019 Andrew Ying
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of version 3 of the GNU General Public License as published by the
+ * Free Software Foundation. In addition, this program is also subject to certain
+ * additional terms available at <SUPPLEMENT.md>.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+ * A PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package gadget
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestGadget returns a gadget whose configfs and UDC directories are
+// temporary directories mimicking the kernel's, removed by removeTestGadget.
+func newTestGadget(t *testing.T, udcs ...string) *Gadget {
+	dir, err := ioutil.TempDir("", "gadget")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := filepath.Join(dir, "usb_gadget")
+	udcDir := filepath.Join(dir, "udc")
+	if err = os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Mkdir(udcDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, udc := range udcs {
+		if err := os.Mkdir(filepath.Join(udcDir, udc), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	functions, err := Functions([]string{
+		FunctionSerial, FunctionKeyboard, FunctionMouse, FunctionMassStorage,
+	}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &Gadget{
+		Root:          root,
+		UDCDir:        udcDir,
+		Name:          "adsisto",
+		VendorID:      0x1d6b,
+		ProductID:     0x0104,
+		DeviceBCD:     0x0100,
+		USBBCD:        0x0200,
+		SerialNumber:  "0123456789",
+		Manufacturer:  "Adsisto",
+		Product:       "IPMI Device",
+		Configuration: "Adsisto",
+		MaxPower:      250,
+		Functions:     functions,
+	}
+}
+
+func removeTestGadget(g *Gadget) {
+	_ = os.RemoveAll(filepath.Dir(g.Root))
+}
+
+func readFile(t *testing.T, path string) string {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(content)
+}
+
+func TestCreate(t *testing.T) {
+	g := newTestGadget(t)
+	defer removeTestGadget(g)
+	if err := g.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	attributes := map[string]string{
+		"idVendor":                   "0x1d6b",
+		"idProduct":                  "0x0104",
+		"bcdUSB":                     "0x0200",
+		"strings/0x409/serialnumber": "0123456789",
+		"configs/c.1/bmAttributes":   "0x80",
+		"configs/c.1/MaxPower":       "250",
+		"configs/c.1/strings/0x409/configuration": "Adsisto",
+		"functions/hid.usb0/protocol":             "1",
+		"functions/hid.usb1/protocol":             "2",
+		"functions/mass_storage.usb0/lun.1/nofua": "0",
+	}
+	for path, expected := range attributes {
+		if value := readFile(t, g.path(path)); value != expected {
+			t.Errorf("%s = %q, expected %q", path, value, expected)
+		}
+	}
+
+	for _, function := range g.Functions {
+		target, err := os.Readlink(g.path("configs", ConfigName, function.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if target != g.path("functions", function.Name()) {
+			t.Errorf("%s is linked to %s", function.Name(), target)
+		}
+	}
+}
+
+func TestCreateRemoteWakeup(t *testing.T) {
+	g := newTestGadget(t)
+	defer removeTestGadget(g)
+	g.RemoteWakeup = true
+	if err := g.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	if value := readFile(t, g.path("configs", ConfigName, "bmAttributes")); value != "0xa0" {
+		t.Errorf("bmAttributes = %q, expected %q", value, "0xa0")
+	}
+}
+
+func TestCreateUpdatesFunctions(t *testing.T) {
+	g := newTestGadget(t)
+	defer removeTestGadget(g)
+	if err := g.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	g.Functions = g.Functions[:2]
+	if err := g.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := g.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Functions) != 2 {
+		t.Errorf("functions = %v, expected 2 functions", status.Functions)
+	}
+
+	if _, err = os.Stat(g.path("functions", "mass_storage.usb0")); !os.IsNotExist(err) {
+		t.Errorf("removed function still exists: %v", err)
+	}
+}
+
+func TestCreateRelinksFunctions(t *testing.T) {
+	g := newTestGadget(t)
+	defer removeTestGadget(g)
+	if err := g.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The functions are linked again in the order of the definition.
+	g.Functions[0], g.Functions[1] = g.Functions[1], g.Functions[0]
+	if err := g.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, function := range g.Functions {
+		target, err := os.Readlink(g.path("configs", ConfigName, function.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if target != g.path("functions", function.Name()) {
+			t.Errorf("%s linked to %s", function.Name(), target)
+		}
+	}
+}
+
+func TestCreateRemovesLegacy(t *testing.T) {
+	g := newTestGadget(t, "fe980000.usb")
+	defer removeTestGadget(g)
+	legacy := &Gadget{
+		Root:      g.Root,
+		UDCDir:    g.UDCDir,
+		Name:      LegacyName,
+		Functions: g.Functions[:1],
+	}
+	if err := legacy.Create(); err != nil {
+		t.Fatal(err)
+	}
+	if err := legacy.Bind(""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := g.Create(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(legacy.path()); !os.IsNotExist(err) {
+		t.Errorf("legacy gadget still exists: %v", err)
+	}
+	if err := g.Bind(""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	g := newTestGadget(t, "fe980000.usb")
+	defer removeTestGadget(g)
+	if err := g.Create(); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Bind(""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := g.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(g.path()); !os.IsNotExist(err) {
+		t.Errorf("gadget directory still exists: %v", err)
+	}
+
+	// Removing a gadget which does not exist is not an error.
+	if err := g.Remove(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBind(t *testing.T) {
+	tests := []struct {
+		name     string
+		udcs     []string
+		udc      string
+		expected string
+		err      error
+	}{
+		{"first UDC", []string{"a.usb", "b.usb"}, "", "a.usb", nil},
+		{"given UDC", []string{"a.usb", "b.usb"}, "b.usb", "b.usb", nil},
+		{"unknown UDC", []string{"a.usb"}, "c.usb", "", ErrUnknownUDC},
+		{"no UDC", nil, "", "", ErrNoUDC},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := newTestGadget(t, test.udcs...)
+			defer removeTestGadget(g)
+			if err := g.Create(); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := g.Bind(test.udc); err != test.err {
+				t.Fatalf("Bind(%q) = %v, expected %v", test.udc, err, test.err)
+			}
+
+			udc, err := g.BoundUDC()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if udc != test.expected {
+				t.Errorf("bound to %q, expected %q", udc, test.expected)
+			}
+		})
+	}
+}
+
+func TestBindNotCreated(t *testing.T) {
+	g := newTestGadget(t, "a.usb")
+	defer removeTestGadget(g)
+	if err := g.Bind(""); err != ErrNotCreated {
+		t.Errorf("Bind() = %v, expected %v", err, ErrNotCreated)
+	}
+}
+
+func TestCreateBound(t *testing.T) {
+	g := newTestGadget(t, "a.usb")
+	defer removeTestGadget(g)
+	if err := g.Create(); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Bind(""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := g.Create(); err != ErrBound {
+		t.Errorf("Create() = %v, expected %v", err, ErrBound)
+	}
+	if err := g.Bind("a.usb"); err != nil {
+		t.Errorf("Bind() to the bound UDC = %v", err)
+	}
+
+	if err := g.Unbind(); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Create(); err != nil {
+		t.Errorf("Create() after Unbind() = %v", err)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	g := newTestGadget(t, "a.usb")
+	defer removeTestGadget(g)
+
+	status, err := g.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Created || status.UDC != "" || len(status.Functions) != 0 {
+		t.Errorf("status before Create() = %+v", status)
+	}
+
+	if err = g.Create(); err != nil {
+		t.Fatal(err)
+	}
+	if err = g.Bind(""); err != nil {
+		t.Fatal(err)
+	}
+
+	status, err = g.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Created || status.UDC != "a.usb" || len(status.Functions) != len(g.Functions) {
+		t.Errorf("status after Bind() = %+v", status)
+	}
+}
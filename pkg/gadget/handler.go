@@ -0,0 +1,129 @@
+/*
+ * Adsisto
+ * Copyright (c) 2019 Andrew Ying
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of version 3 of the GNU General Public License as published by the
+ * Free Software Foundation. In addition, this program is also subject to certain
+ * additional terms available at <SUPPLEMENT.md>.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+ * A PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package gadget
+
+import (
+	"encoding/json"
+	"github.com/adsisto/adsisto/pkg/response"
+	"log"
+	"net/http"
+	"strings"
+)
+
+type bindRequest struct {
+	// UDC is the name of the UDC, or empty for the first UDC available
+	UDC string `json:"udc"`
+}
+
+// StatusHandler reports the state of the gadget and the UDCs available.
+func (g *Gadget) StatusHandler(w http.ResponseWriter, r *http.Request) {
+	status, err := g.Status()
+	if err != nil {
+		internalError(w, "unable to retrieve gadget status", err)
+		return
+	}
+
+	udcs, err := g.UDCs()
+	if err != nil {
+		internalError(w, "unable to list USB device controllers", err)
+		return
+	}
+
+	response.JSON(w, http.StatusOK, map[string]interface{}{
+		"code":   http.StatusOK,
+		"status": status,
+		"udcs":   udcs,
+	})
+}
+
+// ApplyHandler re-creates the gadget from its definition, i.e. the
+// configuration loaded at startup, e.g. after the configfs tree was changed
+// by other means. A bound gadget is unbound while it is updated, then bound
+// again to the same UDC.
+func (g *Gadget) ApplyHandler(w http.ResponseWriter, r *http.Request) {
+	udc, err := g.BoundUDC()
+	if err != nil {
+		internalError(w, "unable to retrieve gadget status", err)
+		return
+	}
+
+	if err = g.Unbind(); err != nil {
+		internalError(w, "unable to unbind gadget", err)
+		return
+	}
+
+	if err = g.Create(); err != nil {
+		internalError(w, "unable to create gadget", err)
+		return
+	}
+
+	if udc != "" {
+		if err = g.Bind(udc); err != nil {
+			internalError(w, "unable to bind gadget", err)
+			return
+		}
+	}
+
+	g.StatusHandler(w, r)
+}
+
+// BindHandler binds the gadget to the UDC in the request.
+func (g *Gadget) BindHandler(w http.ResponseWriter, r *http.Request) {
+	request := &bindRequest{}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(request); err != nil {
+		response.JSON(w, http.StatusBadRequest, map[string]interface{}{
+			"code":    http.StatusBadRequest,
+			"message": "invalid user inputs",
+		})
+		return
+	}
+
+	if err := g.Bind(request.UDC); err != nil {
+		switch err {
+		case ErrNotCreated, ErrBound, ErrNoUDC, ErrUnknownUDC:
+			response.JSON(w, http.StatusConflict, map[string]interface{}{
+				"code":    http.StatusConflict,
+				"message": err.Error(),
+			})
+		default:
+			internalError(w, "unable to bind gadget", err)
+		}
+		return
+	}
+
+	g.StatusHandler(w, r)
+}
+
+// UnbindHandler unbinds the gadget from its UDC.
+func (g *Gadget) UnbindHandler(w http.ResponseWriter, r *http.Request) {
+	if err := g.Unbind(); err != nil {
+		internalError(w, "unable to unbind gadget", err)
+		return
+	}
+
+	g.StatusHandler(w, r)
+}
+
+func internalError(w http.ResponseWriter, message string, err error) {
+	log.Printf("[ERROR] %s%s: %s\n", strings.ToUpper(message[:1]), message[1:], err)
+	response.JSON(w, http.StatusInternalServerError, map[string]interface{}{
+		"code":    http.StatusInternalServerError,
+		"message": message,
+	})
+}
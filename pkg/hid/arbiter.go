@@ -0,0 +1,443 @@
+/*
+ * Adsisto
+ * Copyright (c) 2019 Andrew Ying
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of version 3 of the GNU General Public License as published by the
+ * Free Software Foundation. In addition, this program is also subject to certain
+ * additional terms available at <SUPPLEMENT.md>.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+ * A PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package hid
+
+import (
+	"errors"
+	"github.com/adsisto/adsisto/pkg/auth"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Only one client, the controller, may send input to the target at any time.
+// The other clients are observers until they are granted control.
+const (
+	// MessageRequestControl is the type of message sent by an observer to
+	// request control. Control is granted immediately if nobody holds it, and
+	// taken over if the observer has a higher access level than the
+	// controller. Otherwise, the controller is asked to grant control.
+	MessageRequestControl = "requestControl"
+	// MessageGrantControl is the type of message sent by the controller to
+	// hand control over to the client which last requested it.
+	MessageGrantControl = "grantControl"
+	// MessageReleaseControl is the type of message sent by the controller to
+	// give up control.
+	MessageReleaseControl = "releaseControl"
+)
+
+const (
+	// EventLock is the type of event sent to the clients when the controller
+	// changes.
+	EventLock = "lock"
+	// EventControlRequested is the type of event sent to the controller when
+	// an observer requests control.
+	EventControlRequested = "controlRequested"
+)
+
+var (
+	ErrNotController = errors.New("client does not hold control of the input")
+)
+
+// jobWriter sends the reports written by a job, e.g. text being typed, as
+// long as the job holds control.
+type jobWriter struct {
+	stream *Stream
+	job    *client
+	writer ReportWriter
+}
+
+// arbitrate handles the messages controlling the input lock, and returns
+// whether the message was one of them.
+func (s *Stream) arbitrate(c *client, message StreamMessage) bool {
+	switch message.Type {
+	case MessageRequestControl:
+		s.requestControl(c)
+	case MessageGrantControl:
+		s.grantControl(c)
+	case MessageReleaseControl:
+		s.releaseControl(c)
+	default:
+		return false
+	}
+
+	return true
+}
+
+// handleInput applies an input message received from the client if it holds
+// control. Control is granted to the client if nobody holds it.
+func (s *Stream) handleInput(c *client, message StreamMessage, layout *Layout) error {
+	s.lockMutex.Lock()
+
+	granted := false
+	if s.controller == nil {
+		s.setController(c)
+		granted = true
+	}
+
+	if s.controller != c {
+		s.lockMutex.Unlock()
+		return ErrNotController
+	}
+
+	s.lastInput = time.Now()
+	s.record(c, message)
+	err := s.handleMessage(c, message, layout)
+	s.lockMutex.Unlock()
+
+	if granted {
+		s.broadcastLock()
+	}
+
+	return err
+}
+
+func (s *Stream) requestControl(c *client) {
+	s.lockMutex.Lock()
+
+	switch {
+	case s.controller == c:
+		s.lockMutex.Unlock()
+		return
+	case s.controller == nil || c.level > s.controller.level:
+		if s.controller != nil {
+			log.Printf("[INFO] Input control taken over by %s from %s\n", c.name, s.controller.name)
+			s.release(s.controller)
+		}
+
+		s.setController(c)
+		s.lockMutex.Unlock()
+	default:
+		s.requester = c
+		controller := s.controller
+		s.lockMutex.Unlock()
+
+		err := controller.send(map[string]interface{}{
+			"type": EventControlRequested,
+			"by":   c.name,
+		})
+		if err != nil {
+			log.Printf("[ERROR] Unable to send event to client: %s\n", err)
+		}
+		return
+	}
+
+	s.broadcastLock()
+}
+
+func (s *Stream) grantControl(c *client) {
+	s.lockMutex.Lock()
+
+	if s.controller != c || s.requester == nil {
+		s.lockMutex.Unlock()
+		return
+	}
+
+	log.Printf("[INFO] Input control granted by %s to %s\n", c.name, s.requester.name)
+	s.release(c)
+	s.setController(s.requester)
+	s.lockMutex.Unlock()
+
+	s.broadcastLock()
+}
+
+func (s *Stream) releaseControl(c *client) {
+	s.lockMutex.Lock()
+
+	if s.controller != c {
+		s.lockMutex.Unlock()
+		return
+	}
+
+	s.release(c)
+	s.controller = nil
+	s.requester = nil
+	s.lockMutex.Unlock()
+
+	s.broadcastLock()
+}
+
+// leave releases the keys held by a disconnecting client, and the control if
+// it holds it.
+func (s *Stream) leave(c *client) {
+	s.lockMutex.Lock()
+
+	s.release(c)
+	if s.requester == c {
+		s.requester = nil
+	}
+
+	if c.recorder != nil {
+		if err := c.recorder.Close(); err != nil {
+			log.Printf("[ERROR] Unable to close recording %s: %s\n", c.recorder.ID, err)
+		}
+		c.recorder = nil
+	}
+
+	c.left = true
+	changed := s.controller == c
+	if changed {
+		s.controller = nil
+		s.requester = nil
+	}
+	s.lockMutex.Unlock()
+
+	if changed {
+		s.broadcastLock()
+	}
+}
+
+// newJob returns the client running a job on behalf of the user who sent the
+// request.
+func newJob(r *http.Request) *client {
+	name := auth.Identity(r.Context())
+	if name == "" {
+		name = r.RemoteAddr
+	}
+
+	return &client{
+		name:     name + " (job)",
+		identity: auth.Identity(r.Context()),
+		level:    auth.AccessLevel(r.Context()),
+		pressed:  map[byte]bool{},
+	}
+}
+
+// acquire grants control to a job, so that its input is not interleaved with
+// the input of the clients. Control is taken over from a controller with a
+// lower access level, and from a controller which is the same user, to whom
+// it is handed back when the job ends. Otherwise, ErrNotController is
+// returned.
+func (s *Stream) acquire(job *client) error {
+	s.once.Do(s.init)
+	s.lockMutex.Lock()
+
+	controller := s.controller
+	switch {
+	case controller == nil:
+	case controller.identity != "" && controller.identity == job.identity:
+		job.resume = controller
+	case job.level > controller.level:
+		log.Printf("[INFO] Input control taken over by %s from %s\n", job.name, controller.name)
+	default:
+		s.lockMutex.Unlock()
+		return ErrNotController
+	}
+
+	if controller != nil {
+		s.release(controller)
+	}
+	s.setController(job)
+	s.lockMutex.Unlock()
+
+	s.broadcastLock()
+	return nil
+}
+
+// finish releases the keys held by a job and the control it holds.
+func (s *Stream) finish(job *client) {
+	s.lockMutex.Lock()
+
+	s.release(job)
+	changed := s.controller == job
+	if changed {
+		s.controller = nil
+		s.requester = nil
+		if job.resume != nil && !job.resume.left {
+			s.setController(job.resume)
+		}
+	}
+	s.lockMutex.Unlock()
+
+	if changed {
+		s.broadcastLock()
+	}
+}
+
+// jobInput applies an input message of a job if it still holds control.
+func (s *Stream) jobInput(job *client, message StreamMessage) error {
+	s.lockMutex.Lock()
+	defer s.lockMutex.Unlock()
+
+	if s.controller != job {
+		return ErrNotController
+	}
+
+	s.lastInput = time.Now()
+	return s.handleMessage(job, message, nil)
+}
+
+// WriteReport sends the report if the job still holds control.
+func (w *jobWriter) WriteReport(report []byte) error {
+	w.stream.lockMutex.Lock()
+	defer w.stream.lockMutex.Unlock()
+
+	if w.stream.controller != w.job {
+		return ErrNotController
+	}
+
+	w.stream.lastInput = time.Now()
+	return w.writer.WriteReport(report)
+}
+
+// updateKeyboard changes the state of the keyboard shared with the clients and
+// sends the report, under the same lock as the input of the clients, if the
+// job still holds control.
+func (w *jobWriter) updateKeyboard(keyboard *Keyboard, change func(keyboard *Keyboard)) error {
+	w.stream.lockMutex.Lock()
+	defer w.stream.lockMutex.Unlock()
+
+	if w.stream.controller != w.job {
+		return ErrNotController
+	}
+
+	change(keyboard)
+	report := keyboard.Report()
+
+	w.stream.lastInput = time.Now()
+	return w.writer.WriteReport(report[:])
+}
+
+// Close does nothing, as the writer is shared with the clients.
+func (w *jobWriter) Close() error {
+	return nil
+}
+
+// record records the message in the session of the client, starting the
+// recording on the first message. The caller must hold the lock mutex.
+func (s *Stream) record(c *client, message StreamMessage) {
+	if !s.RecordSessions || s.Recordings == nil || c.unrecorded {
+		return
+	}
+
+	if c.recorder == nil {
+		recorder, err := s.Recordings.Create(c.name)
+		if err != nil {
+			log.Printf("[ERROR] Unable to start recording session of %s: %s\n", c.name, err)
+			c.unrecorded = true
+			return
+		}
+
+		log.Printf("[INFO] Recording session of %s as %s\n", c.name, recorder.ID)
+		c.recorder = recorder
+
+		if err = recorder.Redact(c.redacting); err != nil {
+			log.Printf("[ERROR] Unable to record event: %s\n", err)
+		}
+	}
+
+	if err := c.recorder.Record(message); err != nil {
+		log.Printf("[ERROR] Unable to record event: %s\n", err)
+	}
+}
+
+// redact handles the messages starting and ending a redacted segment of the
+// recording, and returns whether the message was one of them.
+func (s *Stream) redact(c *client, message StreamMessage) bool {
+	if message.Type != MessageRedactStart && message.Type != MessageRedactEnd {
+		return false
+	}
+
+	s.lockMutex.Lock()
+	defer s.lockMutex.Unlock()
+
+	c.redacting = message.Type == MessageRedactStart
+	if c.recorder != nil {
+		if err := c.recorder.Redact(c.redacting); err != nil {
+			log.Printf("[ERROR] Unable to record event: %s\n", err)
+		}
+	}
+
+	return true
+}
+
+// setController grants control to the client. The caller must hold the lock
+// mutex.
+func (s *Stream) setController(c *client) {
+	s.controller = c
+	s.requester = nil
+	s.lastInput = time.Now()
+
+	if s.IdleTimeout <= 0 {
+		return
+	}
+
+	if s.idleTimer == nil {
+		s.idleTimer = time.AfterFunc(s.IdleTimeout, s.checkIdle)
+	} else {
+		s.idleTimer.Reset(s.IdleTimeout)
+	}
+}
+
+// checkIdle releases the control held by a controller which has not sent any
+// input for longer than IdleTimeout.
+func (s *Stream) checkIdle() {
+	s.lockMutex.Lock()
+
+	// Jobs may wait for longer than the timeout between events, e.g. when
+	// replaying a recording, and give control up when they end.
+	if s.controller == nil || s.controller.ws == nil {
+		s.lockMutex.Unlock()
+		return
+	}
+
+	idle := time.Since(s.lastInput)
+	if idle < s.IdleTimeout {
+		s.idleTimer.Reset(s.IdleTimeout - idle)
+		s.lockMutex.Unlock()
+		return
+	}
+
+	log.Printf("[INFO] Releasing input control held by idle client %s\n", s.controller.name)
+	s.release(s.controller)
+	s.controller = nil
+	s.requester = nil
+	s.lockMutex.Unlock()
+
+	s.broadcastLock()
+}
+
+// broadcastLock notifies every client of the current controller.
+func (s *Stream) broadcastLock() {
+	s.clientsMutex.Lock()
+	defer s.clientsMutex.Unlock()
+
+	for c := range s.clients {
+		if err := c.send(s.lockEvent(c)); err != nil {
+			log.Printf("[ERROR] Unable to send event to client: %s\n", err)
+		}
+	}
+}
+
+// lockEvent returns the event describing the input lock as seen by the client.
+func (s *Stream) lockEvent(c *client) map[string]interface{} {
+	s.lockMutex.Lock()
+	defer s.lockMutex.Unlock()
+
+	event := map[string]interface{}{
+		"type":        EventLock,
+		"locked":      s.controller != nil,
+		"controlling": s.controller == c,
+		"controller":  "",
+	}
+	if s.controller != nil {
+		event["controller"] = s.controller.name
+	}
+
+	return event
+}
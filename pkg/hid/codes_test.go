@@ -0,0 +1,158 @@
+/*
+ * Adsisto
+ * Copyright (c) 2019 Andrew Ying
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of version 3 of the GNU General Public License as published by the
+ * Free Software Foundation. In addition, this program is also subject to certain
+ * additional terms available at <SUPPLEMENT.md>.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+ * A PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package hid
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// readCodes returns the usage IDs of the codes listed in codes.txt.
+func readCodes(t *testing.T) map[string]byte {
+	file, err := os.Open("codes.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	codes := map[string]byte{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			t.Fatalf("invalid line %q", text)
+		}
+
+		usage, err := strconv.ParseUint(fields[1], 0, 8)
+		if err != nil {
+			t.Fatal(err)
+		}
+		codes[fields[0]] = byte(usage)
+	}
+	if err = scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return codes
+}
+
+func TestCodeMap(t *testing.T) {
+	codes := readCodes(t)
+	if len(CodeMap) != len(codes) {
+		t.Errorf("CodeMap has %d entries, codes.txt has %d", len(CodeMap), len(codes))
+	}
+
+	for code, usage := range codes {
+		if mapped, found := CodeMap[code]; !found || mapped != usage {
+			t.Errorf("CodeMap[%q] = 0x%02x, %v, expected 0x%02x", code, mapped, found, usage)
+		}
+	}
+}
+
+func TestParseMessageCodes(t *testing.T) {
+	for code, usage := range readCodes(t) {
+		for _, layout := range []*Layout{nil, Layouts[DefaultLayout]} {
+			// The key is ignored in favour of the physical key.
+			message := StreamMessage{Type: MessageKeyDown, Key: "q", Code: code}
+			message.ParseMessage(layout)
+
+			if message.Usage() != usage {
+				t.Errorf("usage of %s = 0x%02x, expected 0x%02x", code, message.Usage(), usage)
+			}
+		}
+	}
+}
+
+func TestParseMessageWithoutCode(t *testing.T) {
+	tests := []struct {
+		key      string
+		location int
+		usage    byte
+	}{
+		{"a", LocationStandard, 0x04},
+		{"Enter", LocationStandard, 0x28},
+		{"ArrowRight", LocationStandard, 0x4f},
+		{"Shift", LocationLeft, 0xe1},
+		{"Shift", LocationRight, 0xe5},
+		{"+", LocationNumpad, 0x57},
+		{"Unidentified", LocationRight, 0x00},
+	}
+
+	for _, test := range tests {
+		message := StreamMessage{Key: test.key, Location: test.location}
+		message.ParseMessage(nil)
+
+		if message.Usage() != test.usage {
+			t.Errorf("usage of %q at location %d = 0x%02x, expected 0x%02x",
+				test.key, test.location, message.Usage(), test.usage)
+		}
+	}
+}
+
+func TestGeneratedCodes(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go is not installed")
+	}
+
+	dir, err := ioutil.TempDir("", "codes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"codes.txt", "gen_codes.go"} {
+		content, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(filepath.Join(dir, name), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	command := exec.Command("go", "run", "gen_codes.go")
+	command.Dir = dir
+	if output, err := command.CombinedOutput(); err != nil {
+		t.Fatalf("go run gen_codes.go: %s: %s", err, output)
+	}
+
+	generated, err := ioutil.ReadFile(filepath.Join(dir, "codes.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	committed, err := ioutil.ReadFile("codes.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(generated, committed) {
+		t.Error("codes.go is out of date, run go generate")
+	}
+}
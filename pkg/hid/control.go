@@ -0,0 +1,161 @@
+/*
+ * Adsisto
+ * Copyright (c) 2019 Andrew Ying
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of version 3 of the GNU General Public License as published by the
+ * Free Software Foundation. In addition, this program is also subject to certain
+ * additional terms available at <SUPPLEMENT.md>.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+ * A PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package hid
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+const (
+	// ReportIDSystem is the ID of the System Control report.
+	ReportIDSystem byte = 0x01
+	// ReportIDConsumer is the ID of the Consumer Control report.
+	ReportIDConsumer byte = 0x02
+	// ControlReportLength is the length of the control reports. The System
+	// Control report is padded to the length of the Consumer Control report,
+	// as the function has a single report length.
+	ControlReportLength = 3
+	// ControlHoldTime is how long a control is held down when pressed.
+	ControlHoldTime = time.Millisecond * 100
+)
+
+// ControlReportDescriptor describes a device with a System Control collection
+// on the Generic Desktop page, and a Consumer Control collection on the
+// Consumer page.
+var ControlReportDescriptor = []byte{
+	0x05, 0x01, // Usage Page (Generic Desktop)
+	0x09, 0x80, // Usage (System Control)
+	0xa1, 0x01, // Collection (Application)
+	0x85, ReportIDSystem, //   Report ID (1)
+	0x19, 0x81, //   Usage Minimum (System Power Down)
+	0x29, 0x83, //   Usage Maximum (System Wake Up)
+	0x15, 0x01, //   Logical Minimum (1)
+	0x25, 0x03, //   Logical Maximum (3)
+	0x75, 0x08, //   Report Size (8)
+	0x95, 0x01, //   Report Count (1)
+	0x81, 0x00, //   Input (Data, Array, Absolute)
+	0x75, 0x08, //   Report Size (8)
+	0x95, 0x01, //   Report Count (1)
+	0x81, 0x03, //   Input (Constant)
+	0xc0,       // End Collection
+	0x05, 0x0c, // Usage Page (Consumer)
+	0x09, 0x01, // Usage (Consumer Control)
+	0xa1, 0x01, // Collection (Application)
+	0x85, ReportIDConsumer, //   Report ID (2)
+	0x19, 0x00, //   Usage Minimum (0)
+	0x2a, 0x3c, 0x02, //   Usage Maximum (0x23c)
+	0x15, 0x00, //   Logical Minimum (0)
+	0x26, 0x3c, 0x02, //   Logical Maximum (0x23c)
+	0x75, 0x10, //   Report Size (16)
+	0x95, 0x01, //   Report Count (1)
+	0x81, 0x00, //   Input (Data, Array, Absolute)
+	0xc0, // End Collection
+}
+
+// Maps the system controls with their usage IDs on the Generic Desktop page
+var SystemMap = map[string]uint16{
+	"POWER": 0x81,
+	"SLEEP": 0x82,
+	"WAKE":  0x83,
+}
+
+// Maps the consumer controls with their usage IDs on the Consumer page
+var ConsumerMap = map[string]uint16{
+	"BRIGHTNESSUP":   0x6f,
+	"BRIGHTNESSDOWN": 0x70,
+	"NEXTTRACK":      0xb5,
+	"PREVIOUSTRACK":  0xb6,
+	"STOP":           0xb7,
+	"EJECT":          0xb8,
+	"PLAYPAUSE":      0xcd,
+	"MUTE":           0xe2,
+	"VOLUMEUP":       0xe9,
+	"VOLUMEDOWN":     0xea,
+	"MAIL":           0x18a,
+	"CALCULATOR":     0x192,
+	"SEARCH":         0x221,
+	"BROWSER":        0x223,
+}
+
+// Maps the values of KeyboardEvent.key for media keys to the controls
+var ControlAliasMap = map[string]string{
+	"WAKEUP":             "WAKE",
+	"STANDBY":            "SLEEP",
+	"AUDIOVOLUMEUP":      "VOLUMEUP",
+	"AUDIOVOLUMEDOWN":    "VOLUMEDOWN",
+	"AUDIOVOLUMEMUTE":    "MUTE",
+	"MEDIAPLAYPAUSE":     "PLAYPAUSE",
+	"MEDIASTOP":          "STOP",
+	"MEDIATRACKNEXT":     "NEXTTRACK",
+	"MEDIATRACKPREVIOUS": "PREVIOUSTRACK",
+	"LAUNCHMAIL":         "MAIL",
+	"LAUNCHCALCULATOR":   "CALCULATOR",
+	"BROWSERHOME":        "BROWSER",
+	"BROWSERSEARCH":      "SEARCH",
+	"MEDIAPLAY":          "PLAYPAUSE",
+	"MEDIAPAUSE":         "PLAYPAUSE",
+}
+
+// Control sends System Control and Consumer Control reports to the target.
+type Control struct {
+	Writer ReportWriter
+}
+
+var (
+	ErrUnknownControl = errors.New("control not recognised")
+)
+
+// ControlReport returns the report pressing the control with the given name,
+// and the report releasing it.
+func ControlReport(name string) ([]byte, []byte, error) {
+	name = strings.ToUpper(name)
+	if alias, found := ControlAliasMap[name]; found {
+		name = alias
+	}
+
+	if usage, found := SystemMap[name]; found {
+		return []byte{ReportIDSystem, byte(usage - 0x80), 0x00},
+			[]byte{ReportIDSystem, 0x00, 0x00},
+			nil
+	}
+
+	if usage, found := ConsumerMap[name]; found {
+		return []byte{ReportIDConsumer, byte(usage), byte(usage >> 8)},
+			[]byte{ReportIDConsumer, 0x00, 0x00},
+			nil
+	}
+
+	return nil, nil, ErrUnknownControl
+}
+
+// Press presses and releases the control with the given name.
+func (c *Control) Press(name string) error {
+	press, release, err := ControlReport(name)
+	if err != nil {
+		return err
+	}
+
+	if err = c.Writer.WriteReport(press); err != nil {
+		return err
+	}
+
+	time.Sleep(ControlHoldTime)
+	return c.Writer.WriteReport(release)
+}
@@ -0,0 +1,113 @@
+//go:build ignore
+// +build ignore
+
+/*
+ * Adsisto
+ * Copyright (c) 2019 Andrew Ying
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of version 3 of the GNU General Public License as published by the
+ * Free Software Foundation. In addition, this program is also subject to certain
+ * additional terms available at <SUPPLEMENT.md>.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+ * A PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// gen_codes generates codes.go from the mapping between KeyboardEvent.code and
+// HID usage IDs in codes.txt.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const header = `/*
+ * Adsisto
+ * Copyright (c) 2019 Andrew Ying
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of version 3 of the GNU General Public License as published by the
+ * Free Software Foundation. In addition, this program is also subject to certain
+ * additional terms available at <SUPPLEMENT.md>.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+ * A PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Code generated by gen_codes.go from codes.txt; DO NOT EDIT.
+
+package hid
+
+// CodeMap maps the values of KeyboardEvent.code to the usage IDs on the HID
+// Keyboard/Keypad page. The codes identify the physical keys regardless of the
+// layout configured on the client.
+var CodeMap = map[string]byte{
+`
+
+func main() {
+	file, err := os.Open("codes.txt")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer file.Close()
+
+	buf := &bytes.Buffer{}
+	buf.WriteString(header)
+
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			log.Fatalf("codes.txt:%d: expected a code and a usage ID\n", line)
+		}
+
+		usage, err := strconv.ParseUint(fields[1], 0, 8)
+		if err != nil {
+			log.Fatalf("codes.txt:%d: invalid usage ID %s\n", line, fields[1])
+		}
+
+		if seen[fields[0]] {
+			log.Fatalf("codes.txt:%d: duplicated code %s\n", line, fields[0])
+		}
+		seen[fields[0]] = true
+
+		fmt.Fprintf(buf, "\t%q: 0x%02x,\n", fields[0], usage)
+	}
+	if err = scanner.Err(); err != nil {
+		log.Fatalln(err)
+	}
+
+	buf.WriteString("}\n")
+
+	source, err := format.Source(buf.Bytes())
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if err = ioutil.WriteFile("codes.go", source, 0644); err != nil {
+		log.Fatalln(err)
+	}
+}
@@ -0,0 +1,681 @@
+/*
+ * Adsisto
+ * Copyright (c) 2019 Andrew Ying
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of version 3 of the GNU General Public License as published by the
+ * Free Software Foundation. In addition, this program is also subject to certain
+ * additional terms available at <SUPPLEMENT.md>.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+ * A PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package hid
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/adsisto/adsisto/pkg/response"
+	"gopkg.in/go-playground/validator.v9"
+	"log"
+	"net/http"
+	"time"
+	"unicode/utf8"
+)
+
+// TypingStatus is the progress of the text being typed on the target.
+type TypingStatus struct {
+	Typing bool   `json:"typing"`
+	Typed  int    `json:"typed"`
+	Total  int    `json:"total"`
+	Error  string `json:"error,omitempty"`
+}
+
+type typeRequest struct {
+	Text string `json:"text" validate:"required"`
+	// Delay is the interval between consecutive reports in milliseconds
+	Delay int `json:"delay" validate:"omitempty,gte=0,lte=1000"`
+	// Layout overrides the keyboard layout configured for the target
+	Layout string `json:"layout"`
+}
+
+type controlRequest struct {
+	Control string `json:"control" validate:"required"`
+}
+
+type macroRequest struct {
+	Name string `json:"name" validate:"required"`
+}
+
+type recordingRequest struct {
+	ID string `json:"id" validate:"required"`
+}
+
+type redactRequest struct {
+	ID string `json:"id" validate:"required"`
+	// From and To are the offsets of the redacted segment in milliseconds
+	From int64 `json:"from" validate:"gte=0"`
+	To   int64 `json:"to" validate:"gtefield=From"`
+}
+
+type replayRequest struct {
+	ID string `json:"id" validate:"required"`
+	// Speed is the factor by which the recording is sped up
+	Speed float64 `json:"speed" validate:"omitempty,gt=0,lte=100"`
+	// MaxDelay caps the time between consecutive events in milliseconds
+	MaxDelay int `json:"maxDelay" validate:"omitempty,gte=0"`
+}
+
+// MaxRecordingSize is the maximum size of a recording imported.
+const MaxRecordingSize = 16 << 20
+
+var (
+	ErrJobRunning = errors.New("another text is being typed")
+)
+
+var (
+	validate = validator.New()
+)
+
+// TypeHandler starts typing the text in the request on the target. The text
+// is typed in the background; its progress is reported by TypeStatusHandler.
+func (s *Stream) TypeHandler(w http.ResponseWriter, r *http.Request) {
+	request := &typeRequest{}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(request); err != nil {
+		invalidUserInput(w)
+		return
+	}
+
+	if err := validate.Struct(request); err != nil {
+		invalidUserInput(w)
+		return
+	}
+
+	s.once.Do(s.init)
+
+	layout := s.layout
+	if request.Layout != "" {
+		var err error
+		layout, err = GetLayout(request.Layout)
+		if err != nil {
+			response.JSON(w, http.StatusUnprocessableEntity, map[string]interface{}{
+				"code":    http.StatusUnprocessableEntity,
+				"message": err.Error(),
+			})
+			return
+		}
+	}
+
+	delay := s.TypeDelay
+	if request.Delay > 0 {
+		delay = time.Millisecond * time.Duration(request.Delay)
+	}
+
+	job := newJob(r)
+	typer := s.newTyper(job, layout, delay)
+	typer.Progress = func(typed int, total int) {
+		s.setProgress(typed)
+	}
+
+	// The progress counts the characters actually typed.
+	text := NormaliseText(request.Text)
+	if err := typer.Validate(text); err != nil {
+		response.JSON(w, http.StatusUnprocessableEntity, map[string]interface{}{
+			"code":    http.StatusUnprocessableEntity,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	status, err := s.startJob(
+		job,
+		utf8.RuneCountInString(text),
+		func(ctx context.Context) error {
+			return typer.Type(ctx, text)
+		},
+	)
+	if err != nil {
+		jobError(w, err)
+		return
+	}
+
+	response.JSON(w, http.StatusAccepted, map[string]interface{}{
+		"code":   http.StatusAccepted,
+		"status": status,
+	})
+}
+
+// TypeStatusHandler reports the progress of the text being typed.
+func (s *Stream) TypeStatusHandler(w http.ResponseWriter, r *http.Request) {
+	s.typingMutex.Lock()
+	status := s.typing
+	s.typingMutex.Unlock()
+
+	response.JSON(w, http.StatusOK, map[string]interface{}{
+		"code":   http.StatusOK,
+		"status": status,
+	})
+}
+
+// TypeCancelHandler stops typing the text being typed.
+func (s *Stream) TypeCancelHandler(w http.ResponseWriter, r *http.Request) {
+	s.typingMutex.Lock()
+	if s.typing.Typing && s.cancelTyping != nil {
+		s.cancelTyping()
+	}
+	s.typingMutex.Unlock()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ControlHandler presses a system or consumer control, e.g. to wake up the
+// target from sleep.
+func (s *Stream) ControlHandler(w http.ResponseWriter, r *http.Request) {
+	request := &controlRequest{}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(request); err != nil {
+		invalidUserInput(w)
+		return
+	}
+
+	if err := validate.Struct(request); err != nil {
+		invalidUserInput(w)
+		return
+	}
+
+	if err := s.PressControl(request.Control); err != nil {
+		switch err {
+		case ErrUnknownControl:
+			response.JSON(w, http.StatusUnprocessableEntity, map[string]interface{}{
+				"code":    http.StatusUnprocessableEntity,
+				"message": err.Error(),
+			})
+		default:
+			log.Printf("[ERROR] Unable to send control report: %s\n", err)
+			response.JSON(w, http.StatusInternalServerError, map[string]interface{}{
+				"code":    http.StatusInternalServerError,
+				"message": "unable to send control to target",
+			})
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// LEDsHandler reports the state of the keyboard LEDs on the target.
+func (s *Stream) LEDsHandler(w http.ResponseWriter, r *http.Request) {
+	response.JSON(w, http.StatusOK, map[string]interface{}{
+		"code": http.StatusOK,
+		"leds": s.LEDs(),
+	})
+}
+
+// MacrosIndexHandler lists the macros stored.
+func (s *Stream) MacrosIndexHandler(w http.ResponseWriter, r *http.Request) {
+	macros, err := s.Macros.All()
+	if err != nil {
+		log.Printf("[ERROR] Unable to load macros: %s\n", err)
+		response.JSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"code":    http.StatusInternalServerError,
+			"message": "unable to retrieve macros",
+		})
+		return
+	}
+
+	response.JSON(w, http.StatusOK, map[string]interface{}{
+		"code":   http.StatusOK,
+		"macros": macros,
+	})
+}
+
+// MacroInsertHandler stores a new macro.
+func (s *Stream) MacroInsertHandler(w http.ResponseWriter, r *http.Request) {
+	macro, ok := s.decodeMacro(w, r)
+	if !ok {
+		return
+	}
+
+	if err := s.Macros.Insert(macro); err != nil {
+		if err == ErrMacroExists {
+			response.JSON(w, http.StatusConflict, map[string]interface{}{
+				"code":    http.StatusConflict,
+				"message": err.Error(),
+			})
+			return
+		}
+
+		log.Printf("[ERROR] Unable to save macro: %s\n", err)
+		response.JSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"code":    http.StatusInternalServerError,
+			"message": "unable to insert new macro",
+		})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// MacroUpdateHandler replaces the steps of an existing macro.
+func (s *Stream) MacroUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	macro, ok := s.decodeMacro(w, r)
+	if !ok {
+		return
+	}
+
+	if err := s.Macros.Update(macro); err != nil {
+		if err == ErrMacroNotFound {
+			macroNotFound(w)
+			return
+		}
+
+		log.Printf("[ERROR] Unable to save macro: %s\n", err)
+		response.JSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"code":    http.StatusInternalServerError,
+			"message": "unable to update macro",
+		})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// MacroDeleteHandler deletes a macro.
+func (s *Stream) MacroDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	request := &macroRequest{}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(request); err != nil {
+		invalidUserInput(w)
+		return
+	}
+
+	if err := validate.Struct(request); err != nil {
+		invalidUserInput(w)
+		return
+	}
+
+	if err := s.Macros.Delete(request.Name); err != nil {
+		if err == ErrMacroNotFound {
+			macroNotFound(w)
+			return
+		}
+
+		log.Printf("[ERROR] Unable to save macros: %s\n", err)
+		response.JSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"code":    http.StatusInternalServerError,
+			"message": "unable to delete macro",
+		})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// MacroRunHandler starts executing a macro on the target. The macro is run in
+// the background; its progress is reported by TypeStatusHandler, in steps.
+func (s *Stream) MacroRunHandler(w http.ResponseWriter, r *http.Request) {
+	request := &macroRequest{}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(request); err != nil {
+		invalidUserInput(w)
+		return
+	}
+
+	if err := validate.Struct(request); err != nil {
+		invalidUserInput(w)
+		return
+	}
+
+	macro, err := s.Macros.Get(request.Name)
+	if err != nil {
+		if err == ErrMacroNotFound {
+			macroNotFound(w)
+			return
+		}
+
+		log.Printf("[ERROR] Unable to load macros: %s\n", err)
+		response.JSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"code":    http.StatusInternalServerError,
+			"message": "unable to retrieve macro",
+		})
+		return
+	}
+
+	s.once.Do(s.init)
+	job := newJob(r)
+	typer := s.newTyper(job, s.layout, s.TypeDelay)
+
+	if err := macro.Validate(typer.Layout); err != nil {
+		response.JSON(w, http.StatusUnprocessableEntity, map[string]interface{}{
+			"code":    http.StatusUnprocessableEntity,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	status, err := s.startJob(job, len(macro.Steps), func(ctx context.Context) error {
+		return macro.Run(ctx, typer, s.setProgress)
+	})
+	if err != nil {
+		jobError(w, err)
+		return
+	}
+
+	response.JSON(w, http.StatusAccepted, map[string]interface{}{
+		"code":   http.StatusAccepted,
+		"status": status,
+	})
+}
+
+// RecordingsIndexHandler lists the recorded sessions.
+func (s *Stream) RecordingsIndexHandler(w http.ResponseWriter, r *http.Request) {
+	recordings, err := s.Recordings.All()
+	if err != nil {
+		log.Printf("[ERROR] Unable to list recordings: %s\n", err)
+		response.JSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"code":    http.StatusInternalServerError,
+			"message": "unable to retrieve recordings",
+		})
+		return
+	}
+
+	response.JSON(w, http.StatusOK, map[string]interface{}{
+		"code":       http.StatusOK,
+		"recordings": recordings,
+	})
+}
+
+// RecordingDownloadHandler sends the recording identified by the id query
+// parameter.
+func (s *Stream) RecordingDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	path, err := s.Recordings.Path(id)
+	if err != nil {
+		if err == ErrRecordingNotFound {
+			recordingNotFound(w)
+			return
+		}
+
+		log.Printf("[ERROR] Unable to retrieve recording: %s\n", err)
+		response.JSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"code":    http.StatusInternalServerError,
+			"message": "unable to retrieve recording",
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+id+RecordingExtension+"\"")
+	http.ServeFile(w, r, path)
+}
+
+// RecordingImportHandler stores a recording sent in the request body, e.g. one
+// downloaded from another target.
+func (s *Stream) RecordingImportHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := s.Recordings.Import(http.MaxBytesReader(w, r.Body, MaxRecordingSize))
+	if err != nil {
+		if err == ErrInvalidRecording {
+			response.JSON(w, http.StatusUnprocessableEntity, map[string]interface{}{
+				"code":    http.StatusUnprocessableEntity,
+				"message": err.Error(),
+			})
+			return
+		}
+
+		log.Printf("[ERROR] Unable to import recording: %s\n", err)
+		response.JSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"code":    http.StatusInternalServerError,
+			"message": "unable to save recording",
+		})
+		return
+	}
+
+	response.JSON(w, http.StatusCreated, map[string]interface{}{
+		"code": http.StatusCreated,
+		"id":   id,
+	})
+}
+
+// RecordingRedactHandler removes the key events of a segment of a recording.
+func (s *Stream) RecordingRedactHandler(w http.ResponseWriter, r *http.Request) {
+	request := &redactRequest{}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(request); err != nil {
+		invalidUserInput(w)
+		return
+	}
+
+	if err := validate.Struct(request); err != nil {
+		invalidUserInput(w)
+		return
+	}
+
+	if err := s.Recordings.Redact(request.ID, request.From, request.To); err != nil {
+		if err == ErrRecordingNotFound {
+			recordingNotFound(w)
+			return
+		}
+		if err == ErrRecordingActive {
+			response.JSON(w, http.StatusConflict, map[string]interface{}{
+				"code":    http.StatusConflict,
+				"message": err.Error(),
+			})
+			return
+		}
+
+		log.Printf("[ERROR] Unable to redact recording: %s\n", err)
+		response.JSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"code":    http.StatusInternalServerError,
+			"message": "unable to redact recording",
+		})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RecordingDeleteHandler deletes a recording.
+func (s *Stream) RecordingDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	request := &recordingRequest{}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(request); err != nil {
+		invalidUserInput(w)
+		return
+	}
+
+	if err := validate.Struct(request); err != nil {
+		invalidUserInput(w)
+		return
+	}
+
+	if err := s.Recordings.Delete(request.ID); err != nil {
+		if err == ErrRecordingNotFound {
+			recordingNotFound(w)
+			return
+		}
+
+		log.Printf("[ERROR] Unable to delete recording: %s\n", err)
+		response.JSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"code":    http.StatusInternalServerError,
+			"message": "unable to delete recording",
+		})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RecordingReplayHandler starts replaying a recording on the target. The
+// recording is replayed in the background like a text being typed.
+func (s *Stream) RecordingReplayHandler(w http.ResponseWriter, r *http.Request) {
+	request := &replayRequest{}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(request); err != nil {
+		invalidUserInput(w)
+		return
+	}
+
+	if err := validate.Struct(request); err != nil {
+		invalidUserInput(w)
+		return
+	}
+
+	events, err := s.Recordings.Load(request.ID)
+	if err != nil {
+		switch err {
+		case ErrRecordingNotFound:
+			recordingNotFound(w)
+		case ErrInvalidRecording:
+			response.JSON(w, http.StatusUnprocessableEntity, map[string]interface{}{
+				"code":    http.StatusUnprocessableEntity,
+				"message": err.Error(),
+			})
+		default:
+			log.Printf("[ERROR] Unable to load recording: %s\n", err)
+			response.JSON(w, http.StatusInternalServerError, map[string]interface{}{
+				"code":    http.StatusInternalServerError,
+				"message": "unable to retrieve recording",
+			})
+		}
+		return
+	}
+
+	maxDelay := time.Millisecond * time.Duration(request.MaxDelay)
+	job := newJob(r)
+	send := func(message StreamMessage) error {
+		return s.jobInput(job, message)
+	}
+
+	// Keys pressed within a redacted segment, or before the replay was
+	// cancelled, may not have been released: they are tracked as held by the
+	// job, and released once it finishes, unlike those of the other clients.
+	status, err := s.startJob(job, len(events), func(ctx context.Context) error {
+		return Replay(ctx, events, request.Speed, maxDelay, send, s.setProgress)
+	})
+	if err != nil {
+		jobError(w, err)
+		return
+	}
+
+	response.JSON(w, http.StatusAccepted, map[string]interface{}{
+		"code":   http.StatusAccepted,
+		"status": status,
+	})
+}
+
+func (s *Stream) decodeMacro(w http.ResponseWriter, r *http.Request) (Macro, bool) {
+	macro := Macro{}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&macro); err != nil {
+		invalidUserInput(w)
+		return macro, false
+	}
+
+	if err := validate.Struct(macro); err != nil {
+		invalidUserInput(w)
+		return macro, false
+	}
+
+	s.once.Do(s.init)
+	if err := macro.Validate(s.layout); err != nil {
+		response.JSON(w, http.StatusUnprocessableEntity, map[string]interface{}{
+			"code":    http.StatusUnprocessableEntity,
+			"message": err.Error(),
+		})
+		return macro, false
+	}
+
+	return macro, true
+}
+
+func (s *Stream) newTyper(job *client, layout *Layout, delay time.Duration) *Typer {
+	return &Typer{
+		Keyboard: s.keyboard,
+		Writer:   &jobWriter{stream: s, job: job, writer: s.KeyboardWriter},
+		Layout:   layout,
+		Delay:    delay,
+		LEDs:     s.LEDs,
+	}
+}
+
+// startJob runs a job typing on the target in the background, unless another
+// job is already running or another client holds control of the input. Only
+// one job runs at a time so that the keystrokes of different jobs are not
+// interleaved, and the job holds control while it runs.
+func (s *Stream) startJob(job *client, total int, run func(ctx context.Context) error) (TypingStatus, error) {
+	s.typingMutex.Lock()
+	defer s.typingMutex.Unlock()
+
+	if s.typing.Typing {
+		return s.typing, ErrJobRunning
+	}
+
+	if err := s.acquire(job); err != nil {
+		return s.typing, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancelTyping = cancel
+	s.typing = TypingStatus{
+		Typing: true,
+		Total:  total,
+	}
+
+	go func() {
+		err := run(ctx)
+		cancel()
+		s.finish(job)
+
+		s.typingMutex.Lock()
+		defer s.typingMutex.Unlock()
+
+		s.typing.Typing = false
+		if err != nil {
+			log.Printf("[ERROR] Typing stopped: %s\n", err)
+			s.typing.Error = err.Error()
+		}
+	}()
+
+	return s.typing, nil
+}
+
+func (s *Stream) setProgress(typed int) {
+	s.typingMutex.Lock()
+	s.typing.Typed = typed
+	s.typingMutex.Unlock()
+}
+
+func jobError(w http.ResponseWriter, err error) {
+	response.JSON(w, http.StatusConflict, map[string]interface{}{
+		"code":    http.StatusConflict,
+		"message": err.Error(),
+	})
+}
+
+func macroNotFound(w http.ResponseWriter) {
+	response.JSON(w, http.StatusNotFound, map[string]interface{}{
+		"code":    http.StatusNotFound,
+		"message": ErrMacroNotFound.Error(),
+	})
+}
+
+func recordingNotFound(w http.ResponseWriter) {
+	response.JSON(w, http.StatusNotFound, map[string]interface{}{
+		"code":    http.StatusNotFound,
+		"message": ErrRecordingNotFound.Error(),
+	})
+}
+
+func invalidUserInput(w http.ResponseWriter) {
+	response.JSON(w, http.StatusBadRequest, map[string]interface{}{
+		"code":    http.StatusBadRequest,
+		"message": "invalid user inputs",
+	})
+}
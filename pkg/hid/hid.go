@@ -18,64 +18,580 @@
 package hid
 
 import (
-	"encoding/hex"
-	"fmt"
+	"context"
+	"encoding/json"
+	"github.com/adsisto/adsisto/pkg/auth"
 	"github.com/gorilla/websocket"
 	"log"
 	"net/http"
-	"os"
-	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// EventLEDs is the type of event sent to the clients when the target
+	// changes the state of the keyboard LEDs.
+	EventLEDs = "leds"
+)
+
+const (
+	// MessageKeyDown is the type of message sent when a key is pressed.
+	MessageKeyDown = "keydown"
+	// MessageKeyUp is the type of message sent when a key is released.
+	MessageKeyUp = "keyup"
+	// MessageMouse is the type of message sent when the pointer is moved, a
+	// button is pressed or released, or the wheel is scrolled.
+	MessageMouse = "mouse"
+	// MessageControl is the type of message sent when a system or consumer
+	// control, e.g. power or volume up, is pressed.
+	MessageControl = "control"
+)
+
+const (
+	// PongWait is how long a client may remain silent before its connection
+	// is considered dead and closed.
+	PongWait = time.Second * 30
+	// PingInterval is the interval between pings sent to the clients. It must
+	// be shorter than PongWait.
+	PingInterval = PongWait * 9 / 10
 )
 
 // Stream is a instance of HID device.
 type Stream struct {
-	Device string
+	Device        string
+	MouseDevice   string
+	ControlDevice string
+	// KeyboardWriter, MouseWriter and ControlWriter send the reports to the
+	// target. If not set, they are created from Device, MouseDevice and
+	// ControlDevice respectively.
+	KeyboardWriter ReportWriter
+	MouseWriter    ReportWriter
+	ControlWriter  ReportWriter
+	// TypeDelay is the default interval between reports when typing text
+	TypeDelay time.Duration
+	// Layout is the name of the keyboard layout configured on the target
+	Layout string
+	// Macros is the store of the keyboard macros which can be run
+	Macros *MacroStore
+	// HoldTimeout is how long a key may be held down without being refreshed
+	// before it is released by the watchdog. The watchdog is disabled if zero.
+	HoldTimeout time.Duration
+	// IdleTimeout is how long the controller may remain without sending any
+	// input before its control is released. Control is never released for
+	// inactivity if zero.
+	IdleTimeout time.Duration
+	// Recordings is the store of the recorded sessions
+	Recordings *RecordingStore
+	// RecordSessions is whether the key events of the controller are recorded
+	RecordSessions bool
+	layout         *Layout
+	keyboard       *Keyboard
+	mouse          *Mouse
+	once           sync.Once
+	typing         TypingStatus
+	cancelTyping   context.CancelFunc
+	typingMutex    sync.Mutex
+	leds           LEDs
+	ledsMutex      sync.Mutex
+	clients        map[*client]bool
+	clientsMutex   sync.Mutex
+	controller     *client
+	requester      *client
+	lastInput      time.Time
+	idleTimer      *time.Timer
+	lockMutex      sync.Mutex
+}
+
+// client is a client connected to the stream via WebSocket. The keys and
+// buttons it holds down are released when it disconnects.
+type client struct {
+	ws    *websocket.Conn
+	mutex sync.Mutex
+	// name identifies the client to the other clients
+	name string
+	// identity and level are the identity and access level of the
+	// authenticated user
+	identity string
+	level    int
+	pressed  map[byte]bool
+	buttons  byte
+	// recorder records the key events of the client once it sends input
+	recorder   *Recorder
+	unrecorded bool
+	redacting  bool
+	// left is whether the client has disconnected
+	left bool
+	// resume is the controller control is handed back to when the job run
+	// by the client ends
+	resume *client
 }
 
 // StreamMessage is a instance of the message to be streamed to the HID device.
+// Messages without a type are treated as a single keystroke, i.e. the key is
+// pressed and released immediately.
 type StreamMessage struct {
-	Key   string
-	Ctrl  bool
-	Shift bool
-	Alt   bool
-	Meta  bool
+	Type string
+	Key  string
+	// Code is the value of KeyboardEvent.code identifying the physical key
+	Code     string
+	Location int
+	Ctrl     bool
+	Shift    bool
+	Alt      bool
+	Meta     bool
+	AltGraph bool
+	// CtrlRight, ShiftRight, AltRight and MetaRight report that the modifier
+	// held down is the key on the right-hand side of the keyboard.
+	CtrlRight  bool
+	ShiftRight bool
+	AltRight   bool
+	MetaRight  bool
+	// X and Y are the position of the pointer as fractions of the width and
+	// height of the target screen.
+	X       float64
+	Y       float64
+	Buttons int
+	Wheel   int
+}
+
+// Keyboard returns the keyboard state shared by all the clients of the stream.
+func (s *Stream) Keyboard() *Keyboard {
+	s.once.Do(s.init)
+	return s.keyboard
+}
+
+// Mouse returns the mouse state shared by all the clients of the stream.
+func (s *Stream) Mouse() *Mouse {
+	s.once.Do(s.init)
+	return s.mouse
+}
+
+func (s *Stream) init() {
+	s.keyboard = &Keyboard{}
+	s.mouse = &Mouse{}
+	s.clients = map[*client]bool{}
+
+	layout, err := GetLayout(s.Layout)
+	if err != nil {
+		log.Printf("[ERROR] Unable to load keyboard layout %s: %s\n", s.Layout, err)
+		layout = Layouts[DefaultLayout]
+	}
+	s.layout = layout
+
+	if s.KeyboardWriter == nil {
+		s.KeyboardWriter = &DeviceWriter{
+			Path:          s.Device,
+			Retries:       3,
+			RetryInterval: time.Millisecond * 100,
+		}
+	}
+	if s.MouseWriter == nil && s.MouseDevice != "" {
+		s.MouseWriter = &DeviceWriter{
+			Path:          s.MouseDevice,
+			Retries:       3,
+			RetryInterval: time.Millisecond * 100,
+		}
+	}
+	if s.ControlWriter == nil && s.ControlDevice != "" {
+		s.ControlWriter = &DeviceWriter{
+			Path:          s.ControlDevice,
+			Retries:       3,
+			RetryInterval: time.Millisecond * 100,
+		}
+	}
+}
+
+// LEDs returns the state of the keyboard LEDs last set by the target.
+func (s *Stream) LEDs() LEDs {
+	s.ledsMutex.Lock()
+	defer s.ledsMutex.Unlock()
+
+	return s.leds
+}
+
+// ListenLEDs reads the LED output reports sent by the target until ctx is
+// cancelled, and notifies the connected clients of every change.
+func (s *Stream) ListenLEDs(ctx context.Context) {
+	s.once.Do(s.init)
+
+	reader := &LEDReader{
+		Path:          s.Device,
+		RetryInterval: time.Second * 5,
+	}
+	reader.Run(ctx, func(leds LEDs) {
+		s.ledsMutex.Lock()
+		changed := s.leds != leds
+		s.leds = leds
+		s.ledsMutex.Unlock()
+
+		if changed {
+			s.broadcast(map[string]interface{}{
+				"type": EventLEDs,
+				"leds": leds,
+			})
+		}
+	})
+}
+
+// Watchdog releases the keys held down for longer than HoldTimeout without
+// being refreshed until ctx is cancelled. Browsers repeat the keydown events of
+// a key held down, so a key which is not refreshed has most likely missed its
+// keyup event.
+func (s *Stream) Watchdog(ctx context.Context) {
+	s.once.Do(s.init)
+
+	if s.HoldTimeout <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(s.HoldTimeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		s.releaseStale()
+	}
+}
+
+// releaseStale releases the keys held down for longer than HoldTimeout, and
+// forgets them in the state of the clients holding them, so that they are not
+// released again once the client releases or presses them.
+func (s *Stream) releaseStale() {
+	// The clients are listed first, as the lock on the clients must not be
+	// taken while holding the lock on the control.
+	s.clientsMutex.Lock()
+	clients := make([]*client, 0, len(s.clients))
+	for c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.clientsMutex.Unlock()
+
+	s.lockMutex.Lock()
+	defer s.lockMutex.Unlock()
+
+	released := s.keyboard.ReleaseStale(s.HoldTimeout)
+	if len(released) == 0 {
+		return
+	}
+
+	// Jobs are not listed in the clients, but only hold keys while in
+	// control.
+	if s.controller != nil {
+		clients = append(clients, s.controller)
+	}
+	for _, c := range clients {
+		for _, usage := range released {
+			delete(c.pressed, usage)
+		}
+	}
+
+	log.Printf("[INFO] Releasing %d stuck keys\n", len(released))
+	if err := s.writeKeyboardReport(); err != nil {
+		log.Printf("[ERROR] Unable to send HID report: %s\n", err)
+	}
+}
+
+// HandleMessage applies a message received from a client to the state of the
+// HID devices, and sends a report to the target for every change. If layout is
+// nil, the layout configured for the target is used.
+func (s *Stream) HandleMessage(message StreamMessage, layout *Layout) error {
+	return s.handleMessage(nil, message, layout)
+}
+
+// handleMessage applies a message received from the client c, if not nil, and
+// keeps track of the keys and buttons held down by the client.
+func (s *Stream) handleMessage(c *client, message StreamMessage, layout *Layout) error {
+	s.once.Do(s.init)
+
+	if layout == nil {
+		layout = s.layout
+	}
+
+	if message.Type == MessageMouse {
+		// Clients may send mouse messages regardless of whether the target
+		// has an emulated mouse.
+		if s.MouseWriter == nil {
+			return nil
+		}
+
+		s.mouse.Move(message.X, message.Y)
+		s.mouse.SetButtons(byte(message.Buttons))
+		if c != nil {
+			c.buttons = byte(message.Buttons)
+		}
+		report := s.mouse.Report(message.Wheel)
+		return s.MouseWriter.WriteReport(report[:])
+	}
+
+	if message.Type == MessageControl {
+		return s.PressControl(message.Key)
+	}
+
+	message.ParseMessage(layout)
+	if message.Key == "" {
+		return nil
+	}
+
+	keyboard := s.keyboard
+	usage := message.Usage()
+
+	switch message.Type {
+	case MessageKeyDown:
+		if c != nil {
+			c.pressed[usage] = true
+		}
+		changed := keyboard.Press(usage)
+		if keyboard.SyncModifiers(message.Modifiers()|ModifierBit(usage)) || changed {
+			return s.writeKeyboardReport()
+		}
+	case MessageKeyUp:
+		if c != nil {
+			delete(c.pressed, usage)
+		}
+		changed := keyboard.Release(usage)
+		if keyboard.SyncModifiers(message.Modifiers()) || changed {
+			return s.writeKeyboardReport()
+		}
+	default:
+		modifiers := ModifierUsages(message.Modifiers() &^ keyboard.Modifiers())
+		for _, modifier := range modifiers {
+			keyboard.Press(modifier)
+		}
+		if keyboard.Press(usage) {
+			if err := s.writeKeyboardReport(); err != nil {
+				return err
+			}
+		}
+
+		keyboard.Release(usage)
+		for _, modifier := range modifiers {
+			keyboard.Release(modifier)
+		}
+		return s.writeKeyboardReport()
+	}
+
+	return nil
+}
+
+// PressControl presses and releases a system or consumer control.
+func (s *Stream) PressControl(name string) error {
+	s.once.Do(s.init)
+
+	if s.ControlWriter == nil {
+		return ErrDeviceUndefined
+	}
+
+	control := &Control{Writer: s.ControlWriter}
+	return control.Press(name)
 }
 
 // WebsocketHandler sets up a WebSocket instance for receiving keystrokes events
-// from the client.
+// from the client. The layout configured for the target can be overridden by
+// the layout query parameter. The keys held down by the client are released
+// when the connection is closed, fails or times out. Input is only accepted
+// from the client holding control. Clients negotiating SubprotocolV1 may send
+// the input events as binary frames instead of JSON messages.
 func (s *Stream) WebsocketHandler(w http.ResponseWriter, r *http.Request) {
-	upgrader := websocket.Upgrader{}
+	var layout *Layout
+	if name := r.URL.Query().Get("layout"); name != "" {
+		var err error
+		layout, err = GetLayout(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	upgrader := websocket.Upgrader{
+		Subprotocols: []string{SubprotocolV1},
+	}
 	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		panic(err)
 	}
+	defer ws.Close()
+
+	c := s.register(ws, r.RemoteAddr, auth.Identity(r.Context()), auth.AccessLevel(r.Context()))
+	defer s.unregister(c)
+	defer s.leave(c)
 
-	file, err := os.Create(s.Device)
+	done := make(chan struct{})
+	defer close(done)
+	go c.keepAlive(done)
+
+	_ = ws.SetReadDeadline(time.Now().Add(PongWait))
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(PongWait))
+	})
+
+	err = c.send(map[string]interface{}{
+		"type": EventLEDs,
+		"leds": s.LEDs(),
+	})
 	if err != nil {
-		panic(err)
+		log.Printf("[ERROR] Unable to send keyboard LEDs state: %s\n", err)
 	}
 
-	defer ws.Close()
-	defer file.Close()
+	if err = c.send(s.lockEvent(c)); err != nil {
+		log.Printf("[ERROR] Unable to send input lock state: %s\n", err)
+	}
+
+	binaryFrames := ws.Subprotocol() == SubprotocolV1
+	frames := &sequencer{}
 
 	for {
-		message := StreamMessage{}
-		err := ws.ReadJSON(message)
+		kind, data, err := ws.ReadMessage()
 		if err != nil {
-			log.Print(err)
+			log.Printf("[INFO] Closing keystrokes stream: %s\n", err)
+			return
+		}
+
+		_ = ws.SetReadDeadline(time.Now().Add(PongWait))
+
+		if kind == websocket.BinaryMessage {
+			if !binaryFrames {
+				log.Printf("[ERROR] Binary message received without negotiating %s\n", SubprotocolV1)
+				continue
+			}
+
+			s.handleFrames(c, frames, data, layout)
+			continue
+		}
+
+		message := StreamMessage{}
+		if err = json.Unmarshal(data, &message); err != nil {
+			log.Printf("[ERROR] Unable to decode message: %s\n", err)
+			continue
+		}
+
+		s.dispatch(c, message, layout)
+	}
+}
+
+// dispatch handles a message received from the client.
+func (s *Stream) dispatch(c *client, message StreamMessage, layout *Layout) {
+	if s.redact(c, message) || s.arbitrate(c, message) {
+		return
+	}
+
+	err := s.handleInput(c, message, layout)
+	if err != nil && err != ErrNotController {
+		log.Printf("[ERROR] Unable to send HID report: %s\n", err)
+	}
+}
+
+func (s *Stream) register(ws *websocket.Conn, name string, identity string, level int) *client {
+	s.once.Do(s.init)
+
+	c := &client{
+		ws:       ws,
+		name:     name,
+		identity: identity,
+		level:    level,
+		pressed:  map[byte]bool{},
+	}
+
+	s.clientsMutex.Lock()
+	s.clients[c] = true
+	s.clientsMutex.Unlock()
+
+	return c
+}
+
+func (s *Stream) unregister(c *client) {
+	s.clientsMutex.Lock()
+	delete(s.clients, c)
+	s.clientsMutex.Unlock()
+}
+
+// release releases the keys and mouse buttons held down by the client, and
+// sends the resulting reports to the target. The caller must hold the lock
+// mutex.
+func (s *Stream) release(c *client) {
+	changed := false
+	for usage := range c.pressed {
+		if s.keyboard.Release(usage) {
+			changed = true
+		}
+	}
+	c.pressed = map[byte]bool{}
+
+	if changed {
+		log.Printf("[INFO] Releasing keys held by client %s\n", c.name)
+		if err := s.writeKeyboardReport(); err != nil {
+			log.Printf("[ERROR] Unable to send HID report: %s\n", err)
+		}
+	}
+
+	if c.buttons != 0 && s.MouseWriter != nil {
+		c.buttons = 0
+		s.mouse.SetButtons(0)
+		report := s.mouse.Report(0)
+		if err := s.MouseWriter.WriteReport(report[:]); err != nil {
+			log.Printf("[ERROR] Unable to send HID report: %s\n", err)
+		}
+	}
+}
+
+// broadcast sends an event to every connected client.
+func (s *Stream) broadcast(event interface{}) {
+	s.clientsMutex.Lock()
+	defer s.clientsMutex.Unlock()
+
+	for c := range s.clients {
+		if err := c.send(event); err != nil {
+			log.Printf("[ERROR] Unable to send event to client: %s\n", err)
 		}
+	}
+}
+
+// send sends an event to the client. Writes are serialised as the WebSocket
+// connection supports only one concurrent writer. Events sent to jobs, which
+// have no connection, are dropped.
+func (c *client) send(event interface{}) error {
+	if c.ws == nil {
+		return nil
+	}
 
-		message.ParseMessage()
-		if message.Key != "" {
-			bytes := message.GenerateHID()
-			bytesEncoded := hex.EncodeToString(bytes[:])
-			bytesEncoded = strings.Replace(bytesEncoded, "0x", "\\x", -1)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
-			command := fmt.Sprintf("printf \"%%b\" '%v' | hid-ops keyboard", bytesEncoded)
-			_, err = file.Write([]byte(command))
-			if err != nil {
-				log.Print(err)
+	return c.ws.WriteJSON(event)
+}
+
+// sendBinary sends a binary message to the client.
+func (c *client) sendBinary(data []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.ws.WriteMessage(websocket.BinaryMessage, data)
+}
+
+// keepAlive pings the client until done is closed, so that a dead connection
+// is detected by the read deadline.
+func (c *client) keepAlive(done chan struct{}) {
+	ticker := time.NewTicker(PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			deadline := time.Now().Add(PingInterval)
+			if err := c.ws.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+				return
 			}
 		}
 	}
 }
+
+func (s *Stream) writeKeyboardReport() error {
+	report := s.keyboard.Report()
+	return s.KeyboardWriter.WriteReport(report[:])
+}
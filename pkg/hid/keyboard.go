@@ -0,0 +1,304 @@
+/*
+ * Adsisto
+ * Copyright (c) 2019 Andrew Ying
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of version 3 of the GNU General Public License as published by the
+ * Free Software Foundation. In addition, this program is also subject to certain
+ * additional terms available at <SUPPLEMENT.md>.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+ * A PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package hid
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// KeySlots is the number of simultaneous non-modifier keys which can be
+	// reported in a boot keyboard report.
+	KeySlots = 6
+	// UsageErrorRollOver is reported in every key slot when more than KeySlots
+	// keys are held down.
+	UsageErrorRollOver byte = 0x01
+	// UsageLeftCtrl is the first of the eight modifier usages.
+	UsageLeftCtrl byte = 0xe0
+	// UsageRightGUI is the last of the eight modifier usages.
+	UsageRightGUI byte = 0xe7
+)
+
+// KeyboardReportLength is the length of a boot keyboard report.
+const KeyboardReportLength = 8
+
+// KeyboardReportDescriptor describes a boot keyboard with eight modifiers, five
+// LEDs and six key slots. The key slots cover every usage up to the modifiers,
+// so that the international and language keys can be reported.
+var KeyboardReportDescriptor = []byte{
+	0x05, 0x01, // Usage Page (Generic Desktop)
+	0x09, 0x06, // Usage (Keyboard)
+	0xa1, 0x01, // Collection (Application)
+	0x05, 0x07, //   Usage Page (Keyboard/Keypad)
+	0x19, 0xe0, //   Usage Minimum (Left Control)
+	0x29, 0xe7, //   Usage Maximum (Right GUI)
+	0x15, 0x00, //   Logical Minimum (0)
+	0x25, 0x01, //   Logical Maximum (1)
+	0x75, 0x01, //   Report Size (1)
+	0x95, 0x08, //   Report Count (8)
+	0x81, 0x02, //   Input (Data, Variable, Absolute)
+	0x95, 0x01, //   Report Count (1)
+	0x75, 0x08, //   Report Size (8)
+	0x81, 0x03, //   Input (Constant)
+	0x95, 0x05, //   Report Count (5)
+	0x75, 0x01, //   Report Size (1)
+	0x05, 0x08, //   Usage Page (LEDs)
+	0x19, 0x01, //   Usage Minimum (Num Lock)
+	0x29, 0x05, //   Usage Maximum (Kana)
+	0x91, 0x02, //   Output (Data, Variable, Absolute)
+	0x95, 0x01, //   Report Count (1)
+	0x75, 0x03, //   Report Size (3)
+	0x91, 0x03, //   Output (Constant)
+	0x95, 0x06, //   Report Count (6)
+	0x75, 0x08, //   Report Size (8)
+	0x15, 0x00, //   Logical Minimum (0)
+	0x26, 0xe7, 0x00, //   Logical Maximum (231)
+	0x05, 0x07, //   Usage Page (Keyboard/Keypad)
+	0x19, 0x00, //   Usage Minimum (0)
+	0x29, 0xe7, //   Usage Maximum (231)
+	0x81, 0x00, //   Input (Data, Array, Absolute)
+	0xc0, // End Collection
+}
+
+// Bits of the modifier byte in a keyboard report.
+const (
+	ModLeftCtrl byte = 1 << iota
+	ModLeftShift
+	ModLeftAlt
+	ModLeftGUI
+	ModRightCtrl
+	ModRightShift
+	ModRightAlt
+	ModRightGUI
+)
+
+// Keyboard is a stateful model of a HID boot keyboard. It keeps track of the
+// modifiers and keys currently held down on the target, and when each of them
+// was last pressed.
+type Keyboard struct {
+	modifiers byte
+	pressed   []byte
+	refreshed map[byte]time.Time
+	mutex     sync.Mutex
+}
+
+// IsModifier returns whether the usage ID belongs to one of the modifier keys.
+func IsModifier(usage byte) bool {
+	return usage >= UsageLeftCtrl && usage <= UsageRightGUI
+}
+
+// ModifierBit returns the bit in the modifier byte corresponding to the usage
+// ID, or 0 if the usage ID does not belong to a modifier key.
+func ModifierBit(usage byte) byte {
+	if !IsModifier(usage) {
+		return 0
+	}
+
+	return 1 << (usage - UsageLeftCtrl)
+}
+
+// ModifierUsages returns the usage IDs of the modifier keys set in the mask.
+func ModifierUsages(mask byte) []byte {
+	var usages []byte
+
+	for i := byte(0); i < 8; i++ {
+		if mask&(1<<i) != 0 {
+			usages = append(usages, UsageLeftCtrl+i)
+		}
+	}
+
+	return usages
+}
+
+// Press marks the key as held down, and returns whether the state of the
+// keyboard has changed as a result. Pressing a key already held down, e.g. on
+// auto-repeat, refreshes it.
+func (k *Keyboard) Press(usage byte) bool {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if usage == 0 {
+		return false
+	}
+
+	k.refresh(usage)
+
+	if IsModifier(usage) {
+		bit := ModifierBit(usage)
+		if k.modifiers&bit != 0 {
+			return false
+		}
+
+		k.modifiers |= bit
+		return true
+	}
+
+	for _, key := range k.pressed {
+		if key == usage {
+			return false
+		}
+	}
+
+	k.pressed = append(k.pressed, usage)
+	return true
+}
+
+// Release marks the key as no longer held down, and returns whether the state
+// of the keyboard has changed as a result.
+func (k *Keyboard) Release(usage byte) bool {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	delete(k.refreshed, usage)
+
+	if IsModifier(usage) {
+		bit := ModifierBit(usage)
+		if k.modifiers&bit == 0 {
+			return false
+		}
+
+		k.modifiers &^= bit
+		return true
+	}
+
+	for i, key := range k.pressed {
+		if key == usage {
+			k.pressed = append(k.pressed[:i], k.pressed[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// Modifiers returns the bitmask of the modifiers currently held down.
+func (k *Keyboard) Modifiers() byte {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	return k.modifiers
+}
+
+// SyncModifiers releases any modifier which is not held down on either side
+// according to mask, and returns whether the state of the keyboard has changed
+// as a result. It is used to recover from release events missed by the client,
+// e.g. when the browser window loses focus. The modifiers still held down are
+// refreshed.
+func (k *Keyboard) SyncModifiers(mask byte) bool {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	held := mask&0x0f | mask>>4
+	held |= held << 4
+
+	released := k.modifiers &^ held
+	for _, usage := range ModifierUsages(released) {
+		delete(k.refreshed, usage)
+	}
+	for _, usage := range ModifierUsages(k.modifiers & held) {
+		k.refresh(usage)
+	}
+
+	if released == 0 {
+		return false
+	}
+
+	k.modifiers &= held
+	return true
+}
+
+// ReleaseAll releases every key and modifier, and returns whether the state
+// of the keyboard has changed as a result.
+func (k *Keyboard) ReleaseAll() bool {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if k.modifiers == 0 && len(k.pressed) == 0 {
+		return false
+	}
+
+	k.modifiers = 0
+	k.pressed = nil
+	k.refreshed = nil
+	return true
+}
+
+// ReleaseStale releases every key and modifier which has not been refreshed
+// for longer than timeout, and returns the usage IDs of the keys released.
+func (k *Keyboard) ReleaseStale(timeout time.Duration) []byte {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	var released []byte
+	now := time.Now()
+
+	for usage, refreshed := range k.refreshed {
+		if now.Sub(refreshed) <= timeout {
+			continue
+		}
+
+		delete(k.refreshed, usage)
+		released = append(released, usage)
+
+		if IsModifier(usage) {
+			k.modifiers &^= ModifierBit(usage)
+			continue
+		}
+
+		for i, key := range k.pressed {
+			if key == usage {
+				k.pressed = append(k.pressed[:i], k.pressed[i+1:]...)
+				break
+			}
+		}
+	}
+
+	return released
+}
+
+// refresh records that the key has just been pressed. The caller must hold the
+// mutex.
+func (k *Keyboard) refresh(usage byte) {
+	if k.refreshed == nil {
+		k.refreshed = map[byte]time.Time{}
+	}
+
+	k.refreshed[usage] = time.Now()
+}
+
+// Report generates the 8-byte boot keyboard report for the current state. When
+// more than KeySlots keys are held down, every slot reports a roll over error
+// as required by the HID specification.
+func (k *Keyboard) Report() [8]byte {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	var report [8]byte
+	report[0] = k.modifiers
+
+	if len(k.pressed) > KeySlots {
+		for i := 0; i < KeySlots; i++ {
+			report[2+i] = UsageErrorRollOver
+		}
+		return report
+	}
+
+	copy(report[2:], k.pressed)
+	return report
+}
@@ -0,0 +1,222 @@
+/*
+ * Adsisto
+ * Copyright (c) 2019 Andrew Ying
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of version 3 of the GNU General Public License as published by the
+ * Free Software Foundation. In addition, this program is also subject to certain
+ * additional terms available at <SUPPLEMENT.md>.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+ * A PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package hid
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// newTestStream returns a stream whose keyboard reports are kept in memory.
+func newTestStream() (*Stream, *MemoryWriter) {
+	writer := &MemoryWriter{}
+	return &Stream{KeyboardWriter: writer}, writer
+}
+
+func keyDown(code string) StreamMessage {
+	return StreamMessage{Type: MessageKeyDown, Code: code}
+}
+
+func keyUp(code string) StreamMessage {
+	return StreamMessage{Type: MessageKeyUp, Code: code}
+}
+
+func checkReports(t *testing.T, writer *MemoryWriter, expected [][]byte) {
+	t.Helper()
+
+	reports := writer.Reports()
+	if len(reports) != len(expected) {
+		t.Fatalf("%d reports written, expected %d: %x", len(reports), len(expected), reports)
+	}
+
+	for i, report := range reports {
+		if !bytes.Equal(report, expected[i]) {
+			t.Errorf("report %d = %x, expected %x", i, report, expected[i])
+		}
+	}
+}
+
+func TestKeyboardPressRelease(t *testing.T) {
+	s, writer := newTestStream()
+
+	messages := []StreamMessage{
+		keyDown("KeyA"),
+		keyUp("KeyA"),
+	}
+	for _, message := range messages {
+		if err := s.HandleMessage(message, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checkReports(t, writer, [][]byte{
+		{0x00, 0x00, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00},
+		{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+	})
+}
+
+func TestKeyboardModifiers(t *testing.T) {
+	s, writer := newTestStream()
+
+	messages := []StreamMessage{
+		{Type: MessageKeyDown, Code: "ShiftLeft", Shift: true},
+		{Type: MessageKeyDown, Code: "KeyB", Shift: true},
+		{Type: MessageKeyDown, Code: "ControlRight", Shift: true, Ctrl: true},
+		{Type: MessageKeyUp, Code: "KeyB", Shift: true, Ctrl: true},
+		{Type: MessageKeyUp, Code: "ShiftLeft", Ctrl: true},
+		{Type: MessageKeyUp, Code: "ControlRight"},
+	}
+	for _, message := range messages {
+		if err := s.HandleMessage(message, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checkReports(t, writer, [][]byte{
+		{ModLeftShift, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+		{ModLeftShift, 0x00, 0x05, 0x00, 0x00, 0x00, 0x00, 0x00},
+		{ModLeftShift | ModRightCtrl, 0x00, 0x05, 0x00, 0x00, 0x00, 0x00, 0x00},
+		{ModLeftShift | ModRightCtrl, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+		{ModRightCtrl, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+		{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+	})
+}
+
+func TestKeyboardAutoRepeat(t *testing.T) {
+	s, writer := newTestStream()
+
+	for i := 0; i < 3; i++ {
+		if err := s.HandleMessage(keyDown("KeyC"), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checkReports(t, writer, [][]byte{
+		{0x00, 0x00, 0x06, 0x00, 0x00, 0x00, 0x00, 0x00},
+	})
+}
+
+func TestKeyboardRollOver(t *testing.T) {
+	s, writer := newTestStream()
+
+	codes := []string{"KeyA", "KeyB", "KeyC", "KeyD", "KeyE", "KeyF", "KeyG"}
+	for _, code := range codes {
+		if err := s.HandleMessage(keyDown(code), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.HandleMessage(keyUp("KeyA"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	checkReports(t, writer, [][]byte{
+		{0x00, 0x00, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00},
+		{0x00, 0x00, 0x04, 0x05, 0x00, 0x00, 0x00, 0x00},
+		{0x00, 0x00, 0x04, 0x05, 0x06, 0x00, 0x00, 0x00},
+		{0x00, 0x00, 0x04, 0x05, 0x06, 0x07, 0x00, 0x00},
+		{0x00, 0x00, 0x04, 0x05, 0x06, 0x07, 0x08, 0x00},
+		{0x00, 0x00, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09},
+		// A seventh key reports a roll over error in every slot.
+		{0x00, 0x00, 0x01, 0x01, 0x01, 0x01, 0x01, 0x01},
+		{0x00, 0x00, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a},
+	})
+}
+
+func TestKeyboardReleaseAll(t *testing.T) {
+	s, writer := newTestStream()
+
+	messages := []StreamMessage{
+		{Type: MessageKeyDown, Code: "AltLeft", Alt: true},
+		{Type: MessageKeyDown, Code: "Tab", Alt: true},
+	}
+	for _, message := range messages {
+		if err := s.HandleMessage(message, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writer.Reset()
+
+	if !s.Keyboard().ReleaseAll() {
+		t.Fatal("ReleaseAll() reported no change")
+	}
+	if err := s.writeKeyboardReport(); err != nil {
+		t.Fatal(err)
+	}
+	if s.Keyboard().ReleaseAll() {
+		t.Error("ReleaseAll() on a released keyboard reported a change")
+	}
+
+	checkReports(t, writer, [][]byte{
+		{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+	})
+}
+
+func TestKeyboardKeystroke(t *testing.T) {
+	s, writer := newTestStream()
+
+	// Messages without a type press and release the key immediately.
+	message := StreamMessage{Code: "Digit1", Shift: true}
+	if err := s.HandleMessage(message, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	checkReports(t, writer, [][]byte{
+		{ModLeftShift, 0x00, 0x1e, 0x00, 0x00, 0x00, 0x00, 0x00},
+		{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+	})
+}
+
+func TestKeyboardClosedWriter(t *testing.T) {
+	s, writer := newTestStream()
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.HandleMessage(keyDown("KeyA"), nil); err != ErrWriterClosed {
+		t.Errorf("HandleMessage() = %v, expected %v", err, ErrWriterClosed)
+	}
+}
+
+func TestKeyboardReleaseStale(t *testing.T) {
+	s, writer := newTestStream()
+	s.HoldTimeout = time.Millisecond * 10
+	s.once.Do(s.init)
+
+	c := &client{name: "test", pressed: map[byte]bool{}}
+	s.clients[c] = true
+
+	if err := s.handleInput(c, keyDown("KeyA"), nil); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(s.HoldTimeout * 2)
+	s.releaseStale()
+
+	if len(c.pressed) != 0 {
+		t.Errorf("keys still held by the client: %v", c.pressed)
+	}
+
+	// The key released by the watchdog is not released again once the client
+	// leaves.
+	s.release(c)
+
+	checkReports(t, writer, [][]byte{
+		{0x00, 0x00, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00},
+		{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+	})
+}
@@ -18,132 +18,158 @@
 package hid
 
 import (
-	"encoding/hex"
+	"fmt"
+	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
+//go:generate go run gen_codes.go
+
 // Maps the physical keys with their corresponding byte values
 var KeyMap = map[string]string{
-	"A":          "0x04",
-	"B":          "0x05",
-	"C":          "0x06",
-	"D":          "0x07",
-	"E":          "0x08",
-	"F":          "0x09",
-	"G":          "0x0a",
-	"H":          "0x0b",
-	"I":          "0x0c",
-	"J":          "0x0d",
-	"K":          "0x0e",
-	"L":          "0x0f",
-	"M":          "0x10",
-	"N":          "0x11",
-	"O":          "0x12",
-	"P":          "0x13",
-	"Q":          "0x14",
-	"R":          "0x15",
-	"S":          "0x16",
-	"T":          "0x17",
-	"U":          "0x18",
-	"V":          "0x19",
-	"W":          "0x1a",
-	"X":          "0x1b",
-	"Y":          "0x1c",
-	"Z":          "0x1d",
-	"1":          "0x1e",
-	"2":          "0x1f",
-	"3":          "0x20",
-	"4":          "0x21",
-	"5":          "0x22",
-	"6":          "0x23",
-	"7":          "0x24",
-	"8":          "0x25",
-	"9":          "0x26",
-	"0":          "0x27",
-	"ENTER":      "0x28",
-	"ESC":        "0x29",
-	"BACKSPACE":  "0x2a",
-	"TAB":        "0x2b",
-	"SPACE":      "0x2c",
-	"MINUS":      "0x2d",
-	"EQUAL":      "0x2e",
-	"LEFTBRACE":  "0x2f",
-	"RIGHTBRACE": "0x30",
-	"BACKSLASH":  "0x31",
-	"HASHTILDE":  "0x32",
-	"SEMICOLON":  "0x33",
-	"APOSTROPHE": "0x34",
-	"GRAVE":      "0x35",
-	"COMMA":      "0x36",
-	"DOT":        "0x37",
-	"SLASH":      "0x38",
-	"CAPSLOCK":   "0x39",
-	"F1":         "0x3a",
-	"F2":         "0x3b",
-	"F3":         "0x3c",
-	"F4":         "0x3d",
-	"F5":         "0x3e",
-	"F6":         "0x3f",
-	"F7":         "0x40",
-	"F8":         "0x41",
-	"F9":         "0x42",
-	"F10":        "0x43",
-	"F11":        "0x44",
-	"F12":        "0x45",
-	"SYSRQ":      "0x46",
-	"SCROLLLOCK": "0x47",
-	"PAUSE":      "0x48",
-	"INSERT":     "0x49",
-	"HOME":       "0x4a",
-	"PAGEUP":     "0x4b",
-	"DELETE":     "0x4c",
-	"END":        "0x4d",
-	"PAGEDOWN":   "0x4e",
-	"RIGHT":      "0x4f",
-	"LEFT":       "0x50",
-	"DOWN":       "0x51",
-	"UP":         "0x52",
-	"NUMLOCK":    "0x53",
-	"KPSLASH":    "0x54",
-	"KPASTERISK": "0x55",
-	"KPMINUS":    "0x56",
-	"KPPLUS":     "0x57",
-	"KPENTER":    "0x58",
-	"KPDOT":      "0x63",
-	"102ND":      "0x64",
-	"COMPOSE":    "0x65",
-	"POWER":      "0x66",
-	"KPEQUAL":    "0x67",
-	"F13":        "0x68",
-	"F14":        "0x69",
-	"F15":        "0x6a",
-	"F16":        "0x6b",
-	"F17":        "0x6c",
-	"F18":        "0x6d",
-	"F19":        "0x6e",
-	"F20":        "0x6f",
-	"F21":        "0x70",
-	"F22":        "0x71",
-	"F23":        "0x72",
-	"F24":        "0x73",
-	"OPEN":       "0x74",
-	"HELP":       "0x75",
-	"PROPS":      "0x76",
-	"FRONT":      "0x77",
-	"STOP":       "0x78",
-	"AGAIN":      "0x79",
-	"UNDO":       "0x7a",
-	"CUT":        "0x7b",
-	"COPY":       "0x7c",
-	"PASTE":      "0x7d",
-	"FIND":       "0x7e",
-	"MUTE":       "0x7f",
-	"VOLUMEUP":   "0x80",
-	"VOLUMEDOWN": "0x81",
-	"KPCOMMA":    "0x85",
-	"CTRL":       "0xe0",
-	"SHIFT":      "0xe1",
-	"ALT":        "0xe2",
+	"A":                "0x04",
+	"B":                "0x05",
+	"C":                "0x06",
+	"D":                "0x07",
+	"E":                "0x08",
+	"F":                "0x09",
+	"G":                "0x0a",
+	"H":                "0x0b",
+	"I":                "0x0c",
+	"J":                "0x0d",
+	"K":                "0x0e",
+	"L":                "0x0f",
+	"M":                "0x10",
+	"N":                "0x11",
+	"O":                "0x12",
+	"P":                "0x13",
+	"Q":                "0x14",
+	"R":                "0x15",
+	"S":                "0x16",
+	"T":                "0x17",
+	"U":                "0x18",
+	"V":                "0x19",
+	"W":                "0x1a",
+	"X":                "0x1b",
+	"Y":                "0x1c",
+	"Z":                "0x1d",
+	"1":                "0x1e",
+	"2":                "0x1f",
+	"3":                "0x20",
+	"4":                "0x21",
+	"5":                "0x22",
+	"6":                "0x23",
+	"7":                "0x24",
+	"8":                "0x25",
+	"9":                "0x26",
+	"0":                "0x27",
+	"ENTER":            "0x28",
+	"ESC":              "0x29",
+	"BACKSPACE":        "0x2a",
+	"TAB":              "0x2b",
+	"SPACE":            "0x2c",
+	"MINUS":            "0x2d",
+	"EQUAL":            "0x2e",
+	"LEFTBRACE":        "0x2f",
+	"RIGHTBRACE":       "0x30",
+	"BACKSLASH":        "0x31",
+	"HASHTILDE":        "0x32",
+	"SEMICOLON":        "0x33",
+	"APOSTROPHE":       "0x34",
+	"GRAVE":            "0x35",
+	"COMMA":            "0x36",
+	"DOT":              "0x37",
+	"SLASH":            "0x38",
+	"CAPSLOCK":         "0x39",
+	"F1":               "0x3a",
+	"F2":               "0x3b",
+	"F3":               "0x3c",
+	"F4":               "0x3d",
+	"F5":               "0x3e",
+	"F6":               "0x3f",
+	"F7":               "0x40",
+	"F8":               "0x41",
+	"F9":               "0x42",
+	"F10":              "0x43",
+	"F11":              "0x44",
+	"F12":              "0x45",
+	"SYSRQ":            "0x46",
+	"SCROLLLOCK":       "0x47",
+	"PAUSE":            "0x48",
+	"INSERT":           "0x49",
+	"HOME":             "0x4a",
+	"PAGEUP":           "0x4b",
+	"DELETE":           "0x4c",
+	"END":              "0x4d",
+	"PAGEDOWN":         "0x4e",
+	"RIGHT":            "0x4f",
+	"LEFT":             "0x50",
+	"DOWN":             "0x51",
+	"UP":               "0x52",
+	"NUMLOCK":          "0x53",
+	"KPSLASH":          "0x54",
+	"KPASTERISK":       "0x55",
+	"KPMINUS":          "0x56",
+	"KPPLUS":           "0x57",
+	"KPENTER":          "0x58",
+	"KP1":              "0x59",
+	"KP2":              "0x5a",
+	"KP3":              "0x5b",
+	"KP4":              "0x5c",
+	"KP5":              "0x5d",
+	"KP6":              "0x5e",
+	"KP7":              "0x5f",
+	"KP8":              "0x60",
+	"KP9":              "0x61",
+	"KP0":              "0x62",
+	"KPDOT":            "0x63",
+	"102ND":            "0x64",
+	"COMPOSE":          "0x65",
+	"POWER":            "0x66",
+	"KPEQUAL":          "0x67",
+	"F13":              "0x68",
+	"F14":              "0x69",
+	"F15":              "0x6a",
+	"F16":              "0x6b",
+	"F17":              "0x6c",
+	"F18":              "0x6d",
+	"F19":              "0x6e",
+	"F20":              "0x6f",
+	"F21":              "0x70",
+	"F22":              "0x71",
+	"F23":              "0x72",
+	"F24":              "0x73",
+	"OPEN":             "0x74",
+	"HELP":             "0x75",
+	"PROPS":            "0x76",
+	"FRONT":            "0x77",
+	"STOP":             "0x78",
+	"AGAIN":            "0x79",
+	"UNDO":             "0x7a",
+	"CUT":              "0x7b",
+	"COPY":             "0x7c",
+	"PASTE":            "0x7d",
+	"FIND":             "0x7e",
+	"MUTE":             "0x7f",
+	"VOLUMEUP":         "0x80",
+	"VOLUMEDOWN":       "0x81",
+	"KPCOMMA":          "0x85",
+	"RO":               "0x87",
+	"KATAKANAHIRAGANA": "0x88",
+	"YEN":              "0x89",
+	"HENKAN":           "0x8a",
+	"MUHENKAN":         "0x8b",
+	"HANGEUL":          "0x90",
+	"HANJA":            "0x91",
+	"CTRL":             "0xe0",
+	"SHIFT":            "0xe1",
+	"ALT":              "0xe2",
+	"META":             "0xe3",
+	"RIGHTCTRL":        "0xe4",
+	"RIGHTSHIFT":       "0xe5",
+	"RIGHTALT":         "0xe6",
+	"RIGHTMETA":        "0xe7",
 }
 
 var AliasMap = map[string]string{
@@ -155,7 +181,7 @@ var AliasMap = map[string]string{
 	"DIVIDE":    "KPSLASH",
 	"SEPARATOR": "KPCOMMA",
 	// Obsolete mapping ends
-	"+":          "PLUS",
+	"+":          "KPPLUS",
 	".":          "DOT",
 	"-":          "MINUS",
 	"=":          "EQUAL",
@@ -173,49 +199,112 @@ var AliasMap = map[string]string{
 	"ARROWLEFT":  "LEFT",
 	"ARROWRIGHT": "RIGHT",
 	"ARROWUP":    "UP",
+	"CONTROL":    "CTRL",
+	"OS":         "META",
+	"GUI":        "META",
+	"WIN":        "META",
+	"ALTGRAPH":   "RIGHTALT",
 }
 
-func (m *StreamMessage) ParseMessage() {
-	m.Key = strings.ToUpper(m.Key)
+// Values of KeyboardEvent.location sent by the client.
+const (
+	LocationStandard = 0
+	LocationLeft     = 1
+	LocationRight    = 2
+	LocationNumpad   = 3
+)
 
-	if value, found := KeyMap[m.Key]; found {
-		m.Key = value
+// ParseMessage resolves the key of the message into its usage ID. The physical
+// key identified by the code of the message takes precedence. Otherwise, keys
+// which produce a character are looked up in the layout configured on the
+// target, so that the character typed on the client is also typed on the
+// target.
+func (m *StreamMessage) ParseMessage(layout *Layout) {
+	if usage, found := CodeMap[m.Code]; found {
+		m.Key = fmt.Sprintf("0x%02x", usage)
 		return
 	}
 
-	if alias, found := AliasMap[m.Key]; found {
-		m.Key = KeyMap[alias]
-		return
+	if layout != nil && utf8.RuneCountInString(m.Key) == 1 {
+		r, _ := utf8.DecodeRuneInString(m.Key)
+		if usage, found := layout.Usage(r); found {
+			m.Key = fmt.Sprintf("0x%02x", usage)
+			return
+		}
 	}
 
-	m.Key = ""
-}
+	name := strings.ToUpper(m.Key)
 
-func (m *StreamMessage) GenerateHID() [8]byte {
-	var array [8]byte
+	if _, found := KeyMap[name]; !found {
+		name = AliasMap[name]
+	}
 
-	if m.Key == "" {
-		return array
+	// Keys present on both sides of the keyboard are distinguished by the
+	// location of the key pressed. Unknown keys must not resolve to the right
+	// arrow key.
+	if m.Location == LocationRight && name != "" {
+		if _, found := KeyMap["RIGHT"+name]; found {
+			name = "RIGHT" + name
+		}
 	}
 
-	bytes, err := hex.DecodeString(m.Key)
-	if err != nil {
-		return array
+	m.Key = KeyMap[name]
+}
+
+// Modifiers returns the bitmask of the modifiers held down according to the
+// message. A modifier is held down on the left side unless the client reports
+// the key on the right-hand side.
+func (m *StreamMessage) Modifiers() byte {
+	mask := sideModifier(m.Ctrl, m.CtrlRight, ModLeftCtrl, ModRightCtrl) |
+		sideModifier(m.Shift, m.ShiftRight, ModLeftShift, ModRightShift) |
+		sideModifier(m.Alt, m.AltRight, ModLeftAlt, ModRightAlt) |
+		sideModifier(m.Meta, m.MetaRight, ModLeftGUI, ModRightGUI)
+
+	// Some platforms report AltGr as Ctrl+Alt in addition to the AltGraph
+	// modifier state.
+	if m.AltGraph {
+		mask &^= ModLeftCtrl | ModLeftAlt
+		mask |= ModRightAlt
 	}
 
-	array[2] = bytes[0]
+	return mask
+}
 
+// sideModifier returns the bit of a modifier held down on the given side, or 0
+// if the modifier is not held down.
+func sideModifier(held bool, right bool, leftBit byte, rightBit byte) byte {
 	switch {
-	case m.Ctrl:
-		array[0] = 0x01
-	case m.Shift:
-		array[0] = 0x02
-	case m.Alt:
-		array[0] = 0x04
-	case m.Meta:
-		array[0] = 0x08
+	case !held:
+		return 0
+	case right:
+		return rightBit
 	default:
-		array[0] = 0x00
+		return leftBit
+	}
+}
+
+// Usage returns the HID usage ID of a parsed message, or 0 if the key is not
+// recognised.
+func (m *StreamMessage) Usage() byte {
+	value, err := strconv.ParseUint(strings.TrimPrefix(m.Key, "0x"), 16, 8)
+	if err != nil {
+		return 0
+	}
+
+	return byte(value)
+}
+
+func (m *StreamMessage) GenerateHID() [8]byte {
+	var array [8]byte
+
+	if m.Key == "" {
+		return array
+	}
+
+	usage := m.Usage()
+	array[0] = m.Modifiers() | ModifierBit(usage)
+	if !IsModifier(usage) {
+		array[2] = usage
 	}
 
 	return array
@@ -0,0 +1,343 @@
+/*
+ * Adsisto
+ * Copyright (c) 2019 Andrew Ying
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of version 3 of the GNU General Public License as published by the
+ * Free Software Foundation. In addition, this program is also subject to certain
+ * additional terms available at <SUPPLEMENT.md>.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+ * A PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package hid
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+)
+
+// Layout maps the characters of a keyboard layout configured on the target to
+// the keystrokes producing them.
+type Layout struct {
+	Name    string
+	keys    map[rune]Keystroke
+	dead    map[rune]Keystroke
+	compose map[rune][2]rune
+}
+
+// layoutKey lists the characters produced by a physical key at each shift
+// level. A zero rune means that the key produces no character at that level.
+type layoutKey struct {
+	Key        string
+	Base       rune
+	Shift      rune
+	AltGr      rune
+	ShiftAltGr rune
+	// Dead lists the characters produced by the key which are dead keys
+	Dead string
+}
+
+const (
+	// DefaultLayout is the name of the layout used when none is configured.
+	DefaultLayout = "us"
+)
+
+var (
+	// Layouts maps the names of the supported layouts to their instances
+	Layouts = map[string]*Layout{
+		"us": newLayout("us", layoutUS),
+		"gb": newLayout("gb", layoutGB),
+		"de": newLayout("de", layoutDE),
+		"fr": newLayout("fr", layoutFR),
+	}
+
+	// LayoutAliases maps alternative names to the names of layouts
+	LayoutAliases = map[string]string{
+		"en-us": "us",
+		"uk":    "gb",
+		"en-gb": "gb",
+		"de-de": "de",
+		"fr-fr": "fr",
+	}
+
+	ErrUnknownLayout = errors.New("keyboard layout not supported")
+)
+
+// Characters composed by pressing a dead key followed by a base character.
+var deadKeyCompositions = map[rune]map[rune]rune{
+	'^': {'a': 'â', 'e': 'ê', 'i': 'î', 'o': 'ô', 'u': 'û'},
+	'´': {'a': 'á', 'e': 'é', 'i': 'í', 'o': 'ó', 'u': 'ú', 'y': 'ý'},
+	'`': {'a': 'à', 'e': 'è', 'i': 'ì', 'o': 'ò', 'u': 'ù'},
+	'¨': {'a': 'ä', 'e': 'ë', 'i': 'ï', 'o': 'ö', 'u': 'ü', 'y': 'ÿ'},
+	'~': {'a': 'ã', 'n': 'ñ', 'o': 'õ'},
+}
+
+var layoutUS = []layoutKey{
+	{Key: "GRAVE", Base: '`', Shift: '~'},
+	{Key: "1", Base: '1', Shift: '!'},
+	{Key: "2", Base: '2', Shift: '@'},
+	{Key: "3", Base: '3', Shift: '#'},
+	{Key: "4", Base: '4', Shift: '$'},
+	{Key: "5", Base: '5', Shift: '%'},
+	{Key: "6", Base: '6', Shift: '^'},
+	{Key: "7", Base: '7', Shift: '&'},
+	{Key: "8", Base: '8', Shift: '*'},
+	{Key: "9", Base: '9', Shift: '('},
+	{Key: "0", Base: '0', Shift: ')'},
+	{Key: "MINUS", Base: '-', Shift: '_'},
+	{Key: "EQUAL", Base: '=', Shift: '+'},
+	{Key: "LEFTBRACE", Base: '[', Shift: '{'},
+	{Key: "RIGHTBRACE", Base: ']', Shift: '}'},
+	{Key: "BACKSLASH", Base: '\\', Shift: '|'},
+	{Key: "SEMICOLON", Base: ';', Shift: ':'},
+	{Key: "APOSTROPHE", Base: '\'', Shift: '"'},
+	{Key: "COMMA", Base: ',', Shift: '<'},
+	{Key: "DOT", Base: '.', Shift: '>'},
+	{Key: "SLASH", Base: '/', Shift: '?'},
+}
+
+var layoutGB = []layoutKey{
+	{Key: "GRAVE", Base: '`', Shift: '¬', AltGr: '¦'},
+	{Key: "1", Base: '1', Shift: '!'},
+	{Key: "2", Base: '2', Shift: '"'},
+	{Key: "3", Base: '3', Shift: '£'},
+	{Key: "4", Base: '4', Shift: '$', AltGr: '€'},
+	{Key: "5", Base: '5', Shift: '%'},
+	{Key: "6", Base: '6', Shift: '^'},
+	{Key: "7", Base: '7', Shift: '&'},
+	{Key: "8", Base: '8', Shift: '*'},
+	{Key: "9", Base: '9', Shift: '('},
+	{Key: "0", Base: '0', Shift: ')'},
+	{Key: "MINUS", Base: '-', Shift: '_'},
+	{Key: "EQUAL", Base: '=', Shift: '+'},
+	{Key: "LEFTBRACE", Base: '[', Shift: '{'},
+	{Key: "RIGHTBRACE", Base: ']', Shift: '}'},
+	{Key: "HASHTILDE", Base: '#', Shift: '~'},
+	{Key: "SEMICOLON", Base: ';', Shift: ':'},
+	{Key: "APOSTROPHE", Base: '\'', Shift: '@'},
+	{Key: "COMMA", Base: ',', Shift: '<'},
+	{Key: "DOT", Base: '.', Shift: '>'},
+	{Key: "SLASH", Base: '/', Shift: '?'},
+	{Key: "102ND", Base: '\\', Shift: '|'},
+	{Key: "A", Base: 'a', Shift: 'A', AltGr: 'á', ShiftAltGr: 'Á'},
+	{Key: "E", Base: 'e', Shift: 'E', AltGr: 'é', ShiftAltGr: 'É'},
+	{Key: "I", Base: 'i', Shift: 'I', AltGr: 'í', ShiftAltGr: 'Í'},
+	{Key: "O", Base: 'o', Shift: 'O', AltGr: 'ó', ShiftAltGr: 'Ó'},
+	{Key: "U", Base: 'u', Shift: 'U', AltGr: 'ú', ShiftAltGr: 'Ú'},
+}
+
+var layoutDE = []layoutKey{
+	{Key: "GRAVE", Base: '^', Shift: '°', Dead: "^"},
+	{Key: "1", Base: '1', Shift: '!'},
+	{Key: "2", Base: '2', Shift: '"', AltGr: '²'},
+	{Key: "3", Base: '3', Shift: '§', AltGr: '³'},
+	{Key: "4", Base: '4', Shift: '$'},
+	{Key: "5", Base: '5', Shift: '%'},
+	{Key: "6", Base: '6', Shift: '&'},
+	{Key: "7", Base: '7', Shift: '/', AltGr: '{'},
+	{Key: "8", Base: '8', Shift: '(', AltGr: '['},
+	{Key: "9", Base: '9', Shift: ')', AltGr: ']'},
+	{Key: "0", Base: '0', Shift: '=', AltGr: '}'},
+	{Key: "MINUS", Base: 'ß', Shift: '?', AltGr: '\\'},
+	{Key: "EQUAL", Base: '´', Shift: '`', Dead: "´`"},
+	{Key: "LEFTBRACE", Base: 'ü', Shift: 'Ü'},
+	{Key: "RIGHTBRACE", Base: '+', Shift: '*', AltGr: '~'},
+	{Key: "HASHTILDE", Base: '#', Shift: '\''},
+	{Key: "SEMICOLON", Base: 'ö', Shift: 'Ö'},
+	{Key: "APOSTROPHE", Base: 'ä', Shift: 'Ä'},
+	{Key: "COMMA", Base: ',', Shift: ';'},
+	{Key: "DOT", Base: '.', Shift: ':'},
+	{Key: "SLASH", Base: '-', Shift: '_'},
+	{Key: "102ND", Base: '<', Shift: '>', AltGr: '|'},
+	{Key: "Q", Base: 'q', Shift: 'Q', AltGr: '@'},
+	{Key: "E", Base: 'e', Shift: 'E', AltGr: '€'},
+	{Key: "M", Base: 'm', Shift: 'M', AltGr: 'µ'},
+	{Key: "Y", Base: 'z', Shift: 'Z'},
+	{Key: "Z", Base: 'y', Shift: 'Y'},
+}
+
+var layoutFR = []layoutKey{
+	{Key: "GRAVE", Base: '²'},
+	{Key: "1", Base: '&', Shift: '1'},
+	{Key: "2", Base: 'é', Shift: '2', AltGr: '~', Dead: "~"},
+	{Key: "3", Base: '"', Shift: '3', AltGr: '#'},
+	{Key: "4", Base: '\'', Shift: '4', AltGr: '{'},
+	{Key: "5", Base: '(', Shift: '5', AltGr: '['},
+	{Key: "6", Base: '-', Shift: '6', AltGr: '|'},
+	{Key: "7", Base: 'è', Shift: '7', AltGr: '`', Dead: "`"},
+	{Key: "8", Base: '_', Shift: '8', AltGr: '\\'},
+	{Key: "9", Base: 'ç', Shift: '9', AltGr: '^'},
+	{Key: "0", Base: 'à', Shift: '0', AltGr: '@'},
+	{Key: "MINUS", Base: ')', Shift: '°', AltGr: ']'},
+	{Key: "EQUAL", Base: '=', Shift: '+', AltGr: '}'},
+	{Key: "LEFTBRACE", Base: '^', Shift: '¨', Dead: "^¨"},
+	{Key: "RIGHTBRACE", Base: '$', Shift: '£', AltGr: '¤'},
+	{Key: "HASHTILDE", Base: '*', Shift: 'µ'},
+	{Key: "SEMICOLON", Base: 'm', Shift: 'M'},
+	{Key: "APOSTROPHE", Base: 'ù', Shift: '%'},
+	{Key: "M", Base: ',', Shift: '?'},
+	{Key: "COMMA", Base: ';', Shift: '.'},
+	{Key: "DOT", Base: ':', Shift: '/'},
+	{Key: "SLASH", Base: '!', Shift: '§'},
+	{Key: "102ND", Base: '<', Shift: '>'},
+	{Key: "A", Base: 'q', Shift: 'Q'},
+	{Key: "Q", Base: 'a', Shift: 'A'},
+	{Key: "W", Base: 'z', Shift: 'Z'},
+	{Key: "Z", Base: 'w', Shift: 'W'},
+	{Key: "E", Base: 'e', Shift: 'E', AltGr: '€'},
+}
+
+// GetLayout returns the layout with the given name, or the default layout if
+// name is empty.
+func GetLayout(name string) (*Layout, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		name = DefaultLayout
+	}
+
+	if alias, found := LayoutAliases[name]; found {
+		name = alias
+	}
+
+	layout, found := Layouts[name]
+	if !found {
+		return nil, ErrUnknownLayout
+	}
+
+	return layout, nil
+}
+
+// Lookup returns the sequence of keystrokes typing the character on the
+// layout. Characters which are only available as dead keys are typed by the
+// dead key followed by a space.
+func (l *Layout) Lookup(r rune) ([]Keystroke, bool) {
+	if r == '\r' {
+		r = '\n'
+	}
+
+	if stroke, found := l.keys[r]; found {
+		return []Keystroke{stroke}, true
+	}
+
+	if stroke, found := l.dead[r]; found {
+		return []Keystroke{stroke, l.keys[' ']}, true
+	}
+
+	if sequence, found := l.compose[r]; found {
+		return []Keystroke{l.dead[sequence[0]], l.keys[sequence[1]]}, true
+	}
+
+	return nil, false
+}
+
+// Usage returns the usage ID of the physical key producing the character,
+// regardless of the modifiers required.
+func (l *Layout) Usage(r rune) (byte, bool) {
+	if stroke, found := l.keys[r]; found {
+		return stroke.Usage, true
+	}
+
+	if stroke, found := l.dead[r]; found {
+		return stroke.Usage, true
+	}
+
+	return 0, false
+}
+
+func newLayout(name string, keys []layoutKey) *Layout {
+	layout := &Layout{
+		Name:    name,
+		keys:    map[rune]Keystroke{},
+		dead:    map[rune]Keystroke{},
+		compose: map[rune][2]rune{},
+	}
+
+	overridden := map[string]bool{}
+	for _, key := range keys {
+		overridden[key.Key] = true
+	}
+
+	// Letters and digits are on the keys of the same name unless the layout
+	// defines otherwise.
+	for r := 'a'; r <= 'z'; r++ {
+		name := string(unicode.ToUpper(r))
+		if !overridden[name] {
+			layout.add(layoutKey{Key: name, Base: r, Shift: unicode.ToUpper(r)})
+		}
+	}
+	for r := '0'; r <= '9'; r++ {
+		if !overridden[string(r)] {
+			layout.add(layoutKey{Key: string(r), Base: r})
+		}
+	}
+
+	layout.add(layoutKey{Key: "SPACE", Base: ' '})
+	layout.add(layoutKey{Key: "ENTER", Base: '\n'})
+	layout.add(layoutKey{Key: "TAB", Base: '\t'})
+
+	for _, key := range keys {
+		layout.add(key)
+	}
+
+	for dead, compositions := range deadKeyCompositions {
+		if _, found := layout.dead[dead]; !found {
+			continue
+		}
+
+		for base, composed := range compositions {
+			for _, pair := range [][2]rune{
+				{base, composed},
+				{unicode.ToUpper(base), unicode.ToUpper(composed)},
+			} {
+				_, direct := layout.keys[pair[1]]
+				if _, found := layout.keys[pair[0]]; found && !direct {
+					layout.compose[pair[1]] = [2]rune{dead, pair[0]}
+				}
+			}
+		}
+	}
+
+	return layout
+}
+
+func (l *Layout) add(key layoutKey) {
+	message := &StreamMessage{Key: KeyMap[key.Key]}
+	usage := message.Usage()
+	if usage == 0 {
+		panic("keyboard layout refers to unknown key " + key.Key)
+	}
+
+	levels := []struct {
+		char      rune
+		modifiers byte
+	}{
+		{key.Base, 0},
+		{key.Shift, ModLeftShift},
+		{key.AltGr, ModRightAlt},
+		{key.ShiftAltGr, ModLeftShift | ModRightAlt},
+	}
+
+	for _, level := range levels {
+		if level.char == 0 {
+			continue
+		}
+
+		stroke := Keystroke{Usage: usage, Modifiers: level.modifiers}
+		if strings.ContainsRune(key.Dead, level.char) {
+			l.dead[level.char] = stroke
+			continue
+		}
+
+		// Keep the first, i.e. the simplest, keystroke producing a character
+		if _, found := l.keys[level.char]; !found {
+			l.keys[level.char] = stroke
+		}
+	}
+}
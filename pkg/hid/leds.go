@@ -0,0 +1,129 @@
+/*
+ * Adsisto
+ * Copyright (c) 2019 Andrew Ying
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of version 3 of the GNU General Public License as published by the
+ * Free Software Foundation. In addition, this program is also subject to certain
+ * additional terms available at <SUPPLEMENT.md>.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+ * A PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package hid
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+)
+
+// Bits of the LED output report sent by the target.
+const (
+	LEDNumLock byte = 1 << iota
+	LEDCapsLock
+	LEDScrollLock
+	LEDCompose
+	LEDKana
+)
+
+// LEDs is the state of the keyboard LEDs as set by the target.
+type LEDs struct {
+	NumLock    bool `json:"numLock"`
+	CapsLock   bool `json:"capsLock"`
+	ScrollLock bool `json:"scrollLock"`
+	Compose    bool `json:"compose"`
+	Kana       bool `json:"kana"`
+}
+
+// LEDReader reads the LED output reports sent by the target to the keyboard.
+type LEDReader struct {
+	// Path is the path to the keyboard device
+	Path string
+	// RetryInterval is the interval between attempts to re-open the device
+	RetryInterval time.Duration
+}
+
+// ParseLEDs parses a LED output report.
+func ParseLEDs(report byte) LEDs {
+	return LEDs{
+		NumLock:    report&LEDNumLock != 0,
+		CapsLock:   report&LEDCapsLock != 0,
+		ScrollLock: report&LEDScrollLock != 0,
+		Compose:    report&LEDCompose != 0,
+		Kana:       report&LEDKana != 0,
+	}
+}
+
+// Run reads reports from the device until ctx is cancelled, and calls
+// onChange with every report received. The device is re-opened whenever it
+// becomes unavailable.
+func (l *LEDReader) Run(ctx context.Context, onChange func(LEDs)) {
+	interval := l.RetryInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	failing := false
+
+	for {
+		file, err := os.OpenFile(l.Path, os.O_RDONLY, 0)
+		if err != nil {
+			if !failing {
+				log.Printf("[ERROR] Unable to open HID device %s: %s\n", l.Path, err)
+				failing = true
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+				continue
+			}
+		}
+
+		failing = false
+
+		// Closing the file interrupts the pending read once ctx is cancelled.
+		done := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				_ = file.Close()
+			case <-done:
+			}
+		}()
+
+		buf := make([]byte, 8)
+		for {
+			var n int
+			n, err = file.Read(buf)
+			if err != nil {
+				break
+			}
+
+			if n > 0 {
+				onChange(ParseLEDs(buf[0]))
+			}
+		}
+
+		close(done)
+		_ = file.Close()
+
+		if ctx.Err() == nil {
+			log.Printf("[ERROR] Unable to read from HID device %s: %s\n", l.Path, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
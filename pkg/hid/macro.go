@@ -0,0 +1,356 @@
+/*
+ * Adsisto
+ * Copyright (c) 2019 Andrew Ying
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of version 3 of the GNU General Public License as published by the
+ * Free Software Foundation. In addition, this program is also subject to certain
+ * additional terms available at <SUPPLEMENT.md>.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+ * A PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package hid
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Types of macro steps.
+const (
+	// StepChord presses a set of keys together, then releases them
+	StepChord = "chord"
+	// StepText types a text
+	StepText = "text"
+	// StepDelay waits before the next step
+	StepDelay = "delay"
+)
+
+// ChordHoldTime is how long the keys of a chord are held down.
+const ChordHoldTime = time.Millisecond * 50
+
+// Macro is a named sequence of steps executed on the target.
+type Macro struct {
+	Name  string      `json:"name" validate:"required,max=64"`
+	Steps []MacroStep `json:"steps" validate:"required,min=1,dive"`
+}
+
+// MacroStep is a single step of a macro.
+type MacroStep struct {
+	Type string `json:"type" validate:"required,oneof=chord text delay"`
+	// Keys are the names of the keys pressed together in a chord, in the
+	// order they are pressed, e.g. ["CTRL", "ALT", "DELETE"]
+	Keys []string `json:"keys,omitempty"`
+	// Text is the text typed
+	Text string `json:"text,omitempty"`
+	// Delay is the time waited in milliseconds
+	Delay int `json:"delay,omitempty" validate:"gte=0,lte=60000"`
+}
+
+// MacroStore keeps the macros in a JSON file.
+type MacroStore struct {
+	// Path is the path to the JSON file
+	Path   string
+	macros map[string]Macro
+	mutex  sync.Mutex
+}
+
+var (
+	ErrMacroNotFound = errors.New("macro not found")
+	ErrMacroExists   = errors.New("macro with the same name already exists")
+	ErrEmptyChord    = errors.New("chord does not contain any key")
+)
+
+// LookupKey returns the usage ID of the key with the given name in CodeMap,
+// KeyMap or AliasMap.
+func LookupKey(name string) (byte, bool) {
+	if usage, found := CodeMap[name]; found {
+		return usage, true
+	}
+
+	message := &StreamMessage{Key: name}
+	message.ParseMessage(nil)
+	if message.Key == "" {
+		return 0, false
+	}
+
+	return message.Usage(), true
+}
+
+// Validate checks that every step of the macro can be executed on the layout.
+func (m *Macro) Validate(layout *Layout) error {
+	for i, step := range m.Steps {
+		switch step.Type {
+		case StepChord:
+			if len(step.Keys) == 0 {
+				return fmt.Errorf("step %d: %s", i+1, ErrEmptyChord)
+			}
+
+			for _, key := range step.Keys {
+				if _, found := LookupKey(key); !found {
+					return fmt.Errorf("step %d: key %s not recognised", i+1, key)
+				}
+			}
+		case StepText:
+			typer := &Typer{Layout: layout}
+			if err := typer.Validate(step.Text); err != nil {
+				return fmt.Errorf("step %d: %s", i+1, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Run executes the macro on the target. Execution stops when ctx is cancelled.
+// Progress, if not nil, is called after every step completed.
+func (m *Macro) Run(ctx context.Context, typer *Typer, progress func(int)) error {
+	for i, step := range m.Steps {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		var err error
+
+		switch step.Type {
+		case StepChord:
+			err = runChord(typer, step.Keys)
+		case StepText:
+			err = typer.Type(ctx, step.Text)
+		case StepDelay:
+			select {
+			case <-ctx.Done():
+				err = ctx.Err()
+			case <-time.After(time.Millisecond * time.Duration(step.Delay)):
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if progress != nil {
+			progress(i + 1)
+		}
+	}
+
+	return nil
+}
+
+func runChord(typer *Typer, keys []string) error {
+	var usages []byte
+	for _, key := range keys {
+		usage, _ := LookupKey(key)
+		usages = append(usages, usage)
+	}
+
+	var err error
+
+	for _, usage := range usages {
+		usage := usage
+		err = typer.update(func(keyboard *Keyboard) {
+			keyboard.Press(usage)
+		})
+		if err != nil {
+			break
+		}
+	}
+
+	if err == nil {
+		time.Sleep(ChordHoldTime)
+	}
+
+	releaseErr := typer.update(func(keyboard *Keyboard) {
+		for i := len(usages) - 1; i >= 0; i-- {
+			keyboard.Release(usages[i])
+		}
+	})
+	if err == nil {
+		err = releaseErr
+	}
+
+	return err
+}
+
+// All returns every macro, sorted by name.
+func (s *MacroStore) All() ([]Macro, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	macros := make([]Macro, 0, len(s.macros))
+	for _, macro := range s.macros {
+		macros = append(macros, macro)
+	}
+
+	sort.Slice(macros, func(i, j int) bool {
+		return macros[i].Name < macros[j].Name
+	})
+	return macros, nil
+}
+
+// Get returns the macro with the given name.
+func (s *MacroStore) Get(name string) (Macro, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.load(); err != nil {
+		return Macro{}, err
+	}
+
+	macro, found := s.macros[name]
+	if !found {
+		return Macro{}, ErrMacroNotFound
+	}
+
+	return macro, nil
+}
+
+// Insert adds a new macro.
+func (s *MacroStore) Insert(macro Macro) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.load(); err != nil {
+		return err
+	}
+
+	if _, found := s.macros[macro.Name]; found {
+		return ErrMacroExists
+	}
+
+	s.macros[macro.Name] = macro
+	if err := s.save(); err != nil {
+		delete(s.macros, macro.Name)
+		return err
+	}
+
+	return nil
+}
+
+// Update replaces the steps of an existing macro.
+func (s *MacroStore) Update(macro Macro) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.load(); err != nil {
+		return err
+	}
+
+	previous, found := s.macros[macro.Name]
+	if !found {
+		return ErrMacroNotFound
+	}
+
+	s.macros[macro.Name] = macro
+	if err := s.save(); err != nil {
+		s.macros[macro.Name] = previous
+		return err
+	}
+
+	return nil
+}
+
+// Delete removes the macro with the given name.
+func (s *MacroStore) Delete(name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.load(); err != nil {
+		return err
+	}
+
+	previous, found := s.macros[name]
+	if !found {
+		return ErrMacroNotFound
+	}
+
+	delete(s.macros, name)
+	if err := s.save(); err != nil {
+		s.macros[name] = previous
+		return err
+	}
+
+	return nil
+}
+
+func (s *MacroStore) load() error {
+	if s.macros != nil {
+		return nil
+	}
+
+	content, err := ioutil.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		s.macros = map[string]Macro{}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var macros []Macro
+	if err = json.Unmarshal(content, &macros); err != nil {
+		return err
+	}
+
+	s.macros = map[string]Macro{}
+	for _, macro := range macros {
+		s.macros[macro.Name] = macro
+	}
+
+	return nil
+}
+
+// save writes the macros to a temporary file first, so that the file is never
+// left partially written.
+func (s *MacroStore) save() error {
+	macros := make([]Macro, 0, len(s.macros))
+	for _, macro := range s.macros {
+		macros = append(macros, macro)
+	}
+
+	sort.Slice(macros, func(i, j int) bool {
+		return macros[i].Name < macros[j].Name
+	})
+
+	encoded, err := json.MarshalIndent(macros, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(s.Path), ".macros")
+	if err != nil {
+		return err
+	}
+
+	if _, err = file.Write(encoded); err != nil {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		return err
+	}
+	if err = file.Close(); err != nil {
+		_ = os.Remove(file.Name())
+		return err
+	}
+
+	return os.Rename(file.Name(), s.Path)
+}
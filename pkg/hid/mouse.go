@@ -0,0 +1,138 @@
+/*
+ * Adsisto
+ * Copyright (c) 2019 Andrew Ying
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of version 3 of the GNU General Public License as published by the
+ * Free Software Foundation. In addition, this program is also subject to certain
+ * additional terms available at <SUPPLEMENT.md>.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+ * A PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package hid
+
+import (
+	"math"
+	"sync"
+)
+
+const (
+	// MouseReportLength is the length of the reports sent by the mouse.
+	MouseReportLength = 6
+	// MouseMaxCoordinate is the logical maximum of the X and Y axes.
+	MouseMaxCoordinate = 32767
+)
+
+// Bits of the button byte in a mouse report. The order is the same as the
+// one used by MouseEvent.buttons in the browser.
+const (
+	ButtonLeft byte = 1 << iota
+	ButtonRight
+	ButtonMiddle
+	ButtonBack
+	ButtonForward
+)
+
+// MouseReportDescriptor describes an absolute pointing device with five
+// buttons, two 16-bit axes and a relative wheel.
+var MouseReportDescriptor = []byte{
+	0x05, 0x01, // Usage Page (Generic Desktop)
+	0x09, 0x02, // Usage (Mouse)
+	0xa1, 0x01, // Collection (Application)
+	0x09, 0x01, //   Usage (Pointer)
+	0xa1, 0x00, //   Collection (Physical)
+	0x05, 0x09, //     Usage Page (Button)
+	0x19, 0x01, //     Usage Minimum (1)
+	0x29, 0x05, //     Usage Maximum (5)
+	0x15, 0x00, //     Logical Minimum (0)
+	0x25, 0x01, //     Logical Maximum (1)
+	0x95, 0x05, //     Report Count (5)
+	0x75, 0x01, //     Report Size (1)
+	0x81, 0x02, //     Input (Data, Variable, Absolute)
+	0x95, 0x01, //     Report Count (1)
+	0x75, 0x03, //     Report Size (3)
+	0x81, 0x03, //     Input (Constant)
+	0x05, 0x01, //     Usage Page (Generic Desktop)
+	0x09, 0x30, //     Usage (X)
+	0x09, 0x31, //     Usage (Y)
+	0x16, 0x00, 0x00, //     Logical Minimum (0)
+	0x26, 0xff, 0x7f, //     Logical Maximum (32767)
+	0x75, 0x10, //     Report Size (16)
+	0x95, 0x02, //     Report Count (2)
+	0x81, 0x02, //     Input (Data, Variable, Absolute)
+	0x09, 0x38, //     Usage (Wheel)
+	0x15, 0x81, //     Logical Minimum (-127)
+	0x25, 0x7f, //     Logical Maximum (127)
+	0x75, 0x08, //     Report Size (8)
+	0x95, 0x01, //     Report Count (1)
+	0x81, 0x06, //     Input (Data, Variable, Relative)
+	0xc0, //   End Collection
+	0xc0, // End Collection
+}
+
+// Mouse is a stateful model of an absolute pointing device. It keeps track of
+// the position of the pointer and the buttons currently held down.
+type Mouse struct {
+	buttons byte
+	x       uint16
+	y       uint16
+	mutex   sync.Mutex
+}
+
+// Move moves the pointer to the position given as fractions of the width and
+// height of the target screen, between 0 and 1.
+func (m *Mouse) Move(x float64, y float64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.x = scaleCoordinate(x)
+	m.y = scaleCoordinate(y)
+}
+
+// SetButtons sets the buttons currently held down.
+func (m *Mouse) SetButtons(buttons byte) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.buttons = buttons & (ButtonLeft | ButtonRight | ButtonMiddle | ButtonBack |
+		ButtonForward)
+}
+
+// Report generates the mouse report for the current state, with the wheel
+// scrolled by the given number of detents. Positive values scroll up.
+func (m *Mouse) Report(wheel int) [MouseReportLength]byte {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if wheel > 127 {
+		wheel = 127
+	} else if wheel < -127 {
+		wheel = -127
+	}
+
+	return [MouseReportLength]byte{
+		m.buttons,
+		byte(m.x),
+		byte(m.x >> 8),
+		byte(m.y),
+		byte(m.y >> 8),
+		byte(int8(wheel)),
+	}
+}
+
+func scaleCoordinate(value float64) uint16 {
+	if math.IsNaN(value) || value < 0 {
+		return 0
+	}
+	if value > 1 {
+		return MouseMaxCoordinate
+	}
+
+	return uint16(math.Round(value * MouseMaxCoordinate))
+}
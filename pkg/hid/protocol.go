@@ -0,0 +1,294 @@
+/*
+ * Adsisto
+ * Copyright (c) 2019 Andrew Ying
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of version 3 of the GNU General Public License as published by the
+ * Free Software Foundation. In addition, this program is also subject to certain
+ * additional terms available at <SUPPLEMENT.md>.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+ * A PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package hid
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"sort"
+)
+
+// SubprotocolV1 is the name of the binary subprotocol negotiated by the client
+// with the Sec-WebSocket-Protocol header. Without it, the client sends every
+// input event as a JSON text message.
+//
+// Each binary message sent by the client is a batch of frames. A frame starts
+// with a 6-byte header: the frame type, the sequence number as a big-endian
+// uint32, and the length of the payload. Input frames are numbered from 1 and
+// applied in order; every batch is acknowledged with the sequence number of the
+// last frame applied. Text messages are still accepted for the messages without
+// a binary frame, e.g. to request control.
+const SubprotocolV1 = "adsisto.v1"
+
+// Types of binary frames.
+const (
+	// FrameKeyDown and FrameKeyUp carry the modifiers byte, the byte of the
+	// modifiers held down on the right-hand side, the location of the key and
+	// the value of KeyboardEvent.code.
+	FrameKeyDown byte = 0x01
+	FrameKeyUp   byte = 0x02
+	// FrameMouse carries the position of the pointer as big-endian uint16
+	// scaled to MouseMaxCoordinate, the buttons byte and the wheel as int8.
+	FrameMouse byte = 0x03
+	// FrameControl carries the name of a system or consumer control.
+	FrameControl byte = 0x04
+	// FramePing carries an arbitrary payload, e.g. a timestamp, echoed back in
+	// a FramePong frame so that the client can measure the latency.
+	FramePing byte = 0x10
+	FramePong byte = 0x11
+	// FrameAck is sent to the client with the sequence number of the last
+	// input frame applied.
+	FrameAck byte = 0x20
+)
+
+// FrameHeaderLength is the length of the header of a frame.
+const FrameHeaderLength = 6
+
+// SequenceWindow is the number of input frames received ahead of a missing
+// frame which are kept until the missing frame arrives. The missing frames are
+// given up once the window is full.
+const SequenceWindow = 64
+
+// Bits of the modifiers bytes in key frames. Only the bits of Ctrl, Shift, Alt
+// and Meta are used in the byte of the right-hand modifiers.
+const (
+	FrameModCtrl byte = 1 << iota
+	FrameModShift
+	FrameModAlt
+	FrameModMeta
+	FrameModAltGraph
+)
+
+// Frame is a frame decoded from a binary message.
+type Frame struct {
+	Type    byte
+	Seq     uint32
+	Payload []byte
+}
+
+// sequencer puts the input frames received from a client back in order.
+type sequencer struct {
+	last    uint32
+	pending map[uint32]Frame
+}
+
+var (
+	ErrInvalidFrame = errors.New("invalid binary frame")
+)
+
+// DecodeFrames decodes the frames of a binary message. Frames of unknown types
+// are skipped.
+func DecodeFrames(data []byte) ([]Frame, error) {
+	var frames []Frame
+
+	for len(data) > 0 {
+		if len(data) < FrameHeaderLength {
+			return nil, ErrInvalidFrame
+		}
+
+		length := int(data[5])
+		if len(data) < FrameHeaderLength+length {
+			return nil, ErrInvalidFrame
+		}
+
+		frame := Frame{
+			Type:    data[0],
+			Seq:     binary.BigEndian.Uint32(data[1:5]),
+			Payload: data[FrameHeaderLength : FrameHeaderLength+length],
+		}
+		data = data[FrameHeaderLength+length:]
+
+		switch frame.Type {
+		case FrameKeyDown, FrameKeyUp, FrameMouse, FrameControl, FramePing:
+			frames = append(frames, frame)
+		}
+	}
+
+	return frames, nil
+}
+
+// EncodeFrame encodes a frame sent to the client.
+func EncodeFrame(frame Frame) []byte {
+	data := make([]byte, FrameHeaderLength+len(frame.Payload))
+	data[0] = frame.Type
+	binary.BigEndian.PutUint32(data[1:5], frame.Seq)
+	data[5] = byte(len(frame.Payload))
+	copy(data[FrameHeaderLength:], frame.Payload)
+
+	return data
+}
+
+// Message converts an input frame to the equivalent JSON message.
+func (f *Frame) Message() (StreamMessage, error) {
+	switch f.Type {
+	case FrameKeyDown, FrameKeyUp:
+		if len(f.Payload) < 4 {
+			return StreamMessage{}, ErrInvalidFrame
+		}
+
+		modifiers, right := f.Payload[0], f.Payload[1]
+		message := StreamMessage{
+			Type:     MessageKeyDown,
+			Code:     string(f.Payload[3:]),
+			Location: int(f.Payload[2]),
+			Ctrl:     modifiers&FrameModCtrl != 0,
+			Shift:    modifiers&FrameModShift != 0,
+			Alt:      modifiers&FrameModAlt != 0,
+			Meta:     modifiers&FrameModMeta != 0,
+			AltGraph: modifiers&FrameModAltGraph != 0,
+
+			CtrlRight:  right&FrameModCtrl != 0,
+			ShiftRight: right&FrameModShift != 0,
+			AltRight:   right&FrameModAlt != 0,
+			MetaRight:  right&FrameModMeta != 0,
+		}
+		if f.Type == FrameKeyUp {
+			message.Type = MessageKeyUp
+		}
+
+		return message, nil
+	case FrameMouse:
+		if len(f.Payload) != 6 {
+			return StreamMessage{}, ErrInvalidFrame
+		}
+
+		return StreamMessage{
+			Type:    MessageMouse,
+			X:       float64(binary.BigEndian.Uint16(f.Payload[0:2])) / MouseMaxCoordinate,
+			Y:       float64(binary.BigEndian.Uint16(f.Payload[2:4])) / MouseMaxCoordinate,
+			Buttons: int(f.Payload[4]),
+			Wheel:   int(int8(f.Payload[5])),
+		}, nil
+	case FrameControl:
+		if len(f.Payload) == 0 {
+			return StreamMessage{}, ErrInvalidFrame
+		}
+
+		return StreamMessage{
+			Type: MessageControl,
+			Key:  string(f.Payload),
+		}, nil
+	default:
+		return StreamMessage{}, ErrInvalidFrame
+	}
+}
+
+// handleFrames applies the frames of a binary message received from the client
+// in order. The pongs and the acknowledgement are sent back in a single binary
+// message.
+func (s *Stream) handleFrames(c *client, q *sequencer, data []byte, layout *Layout) {
+	frames, err := DecodeFrames(data)
+	if err != nil {
+		log.Printf("[ERROR] Unable to decode message: %s\n", err)
+		return
+	}
+
+	var reply []byte
+	acknowledge := false
+
+	for _, frame := range frames {
+		if frame.Type == FramePing {
+			reply = append(reply, EncodeFrame(Frame{
+				Type:    FramePong,
+				Seq:     frame.Seq,
+				Payload: frame.Payload,
+			})...)
+			continue
+		}
+
+		acknowledge = true
+		ready, skipped := q.push(frame)
+		if skipped {
+			// The keyup events of the keys held down may have been lost.
+			log.Printf("[ERROR] Input frames from %s lost, releasing held keys\n", c.name)
+			s.lockMutex.Lock()
+			s.release(c)
+			s.lockMutex.Unlock()
+		}
+
+		for _, frame := range ready {
+			message, err := frame.Message()
+			if err != nil {
+				log.Printf("[ERROR] Unable to decode message: %s\n", err)
+				continue
+			}
+
+			s.dispatch(c, message, layout)
+		}
+	}
+
+	if acknowledge {
+		reply = append(reply, EncodeFrame(Frame{
+			Type: FrameAck,
+			Seq:  q.last,
+		})...)
+	}
+
+	if len(reply) == 0 {
+		return
+	}
+
+	if err = c.sendBinary(reply); err != nil {
+		log.Printf("[ERROR] Unable to send acknowledgement to client: %s\n", err)
+	}
+}
+
+// push adds an input frame received, and returns the frames which can be
+// applied in order, and whether any frame has been given up. Frames already
+// applied are discarded.
+func (q *sequencer) push(frame Frame) ([]Frame, bool) {
+	if frame.Seq <= q.last {
+		return nil, false
+	}
+
+	if q.pending == nil {
+		q.pending = map[uint32]Frame{}
+	}
+	q.pending[frame.Seq] = frame
+
+	skipped := false
+	if len(q.pending) > SequenceWindow {
+		// Give up the missing frames, and resume from the earliest frame
+		// received.
+		seqs := make([]uint32, 0, len(q.pending))
+		for seq := range q.pending {
+			seqs = append(seqs, seq)
+		}
+		sort.Slice(seqs, func(i, j int) bool {
+			return seqs[i] < seqs[j]
+		})
+
+		q.last = seqs[0] - 1
+		skipped = true
+	}
+
+	var ready []Frame
+	for {
+		next, found := q.pending[q.last+1]
+		if !found {
+			break
+		}
+
+		delete(q.pending, q.last+1)
+		q.last++
+		ready = append(ready, next)
+	}
+
+	return ready, skipped
+}
@@ -0,0 +1,230 @@
+/*
+ * Adsisto
+ * Copyright (c) 2019 Andrew Ying
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of version 3 of the GNU General Public License as published by the
+ * Free Software Foundation. In addition, this program is also subject to certain
+ * additional terms available at <SUPPLEMENT.md>.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+ * A PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package hid
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDecodeFrames(t *testing.T) {
+	keyDown := []byte{FrameKeyDown, 0, 0, 0, 1, 7, 0, 0, 0, 'K', 'e', 'y', 'A'}
+	keyUp := []byte{FrameKeyUp, 0, 0, 0, 2, 7, 0, 0, 0, 'K', 'e', 'y', 'A'}
+	ping := []byte{FramePing, 0, 0, 0, 0, 2, 0xca, 0xfe}
+	unknown := []byte{0x7f, 0, 0, 0, 3, 1, 0}
+
+	tests := []struct {
+		name     string
+		data     []byte
+		expected []Frame
+		err      error
+	}{
+		{"empty", nil, nil, nil},
+		{
+			"single frame",
+			keyDown,
+			[]Frame{{Type: FrameKeyDown, Seq: 1, Payload: keyDown[6:]}},
+			nil,
+		},
+		{
+			"batch",
+			concat(keyDown, ping, keyUp),
+			[]Frame{
+				{Type: FrameKeyDown, Seq: 1, Payload: keyDown[6:]},
+				{Type: FramePing, Seq: 0, Payload: ping[6:]},
+				{Type: FrameKeyUp, Seq: 2, Payload: keyUp[6:]},
+			},
+			nil,
+		},
+		{
+			"unknown type skipped",
+			concat(unknown, keyUp),
+			[]Frame{{Type: FrameKeyUp, Seq: 2, Payload: keyUp[6:]}},
+			nil,
+		},
+		{"truncated header", keyDown[:4], nil, ErrInvalidFrame},
+		{"truncated payload", keyDown[:len(keyDown)-1], nil, ErrInvalidFrame},
+		{"truncated second frame", concat(keyDown, keyUp[:7]), nil, ErrInvalidFrame},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			frames, err := DecodeFrames(test.data)
+			if err != test.err {
+				t.Fatalf("DecodeFrames() = %v, expected %v", err, test.err)
+			}
+			if !reflect.DeepEqual(frames, test.expected) {
+				t.Errorf("DecodeFrames() = %+v, expected %+v", frames, test.expected)
+			}
+		})
+	}
+}
+
+func TestEncodeFrame(t *testing.T) {
+	tests := []struct {
+		name     string
+		frame    Frame
+		expected []byte
+	}{
+		{
+			"ack",
+			Frame{Type: FrameAck, Seq: 0x01020304},
+			[]byte{FrameAck, 0x01, 0x02, 0x03, 0x04, 0},
+		},
+		{
+			"pong",
+			Frame{Type: FramePong, Seq: 7, Payload: []byte{0xca, 0xfe}},
+			[]byte{FramePong, 0, 0, 0, 7, 2, 0xca, 0xfe},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := EncodeFrame(test.frame)
+			if !reflect.DeepEqual(data, test.expected) {
+				t.Errorf("EncodeFrame() = %x, expected %x", data, test.expected)
+			}
+		})
+	}
+}
+
+func TestEncodeDecodeFrames(t *testing.T) {
+	frames := []Frame{
+		{Type: FrameKeyDown, Seq: 1, Payload: []byte{FrameModShift, 0, 1, 'K', 'e', 'y', 'B'}},
+		{Type: FrameMouse, Seq: 2, Payload: []byte{0x40, 0x00, 0x20, 0x00, 1, 0xff}},
+		{Type: FrameControl, Seq: 3, Payload: []byte("POWER")},
+	}
+
+	var data []byte
+	for _, frame := range frames {
+		data = append(data, EncodeFrame(frame)...)
+	}
+
+	decoded, err := DecodeFrames(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, frames) {
+		t.Errorf("DecodeFrames(EncodeFrame()) = %+v, expected %+v", decoded, frames)
+	}
+}
+
+func TestFrameModifiers(t *testing.T) {
+	tests := []struct {
+		name      string
+		modifiers byte
+		right     byte
+		expected  byte
+	}{
+		{"none", 0, 0, 0},
+		{"left Ctrl and Shift", FrameModCtrl | FrameModShift, 0, ModLeftCtrl | ModLeftShift},
+		{"right Ctrl", FrameModCtrl, FrameModCtrl, ModRightCtrl},
+		{"right Shift and left Meta", FrameModShift | FrameModMeta, FrameModShift, ModRightShift | ModLeftGUI},
+		{"right Alt", FrameModAlt, FrameModAlt, ModRightAlt},
+		{"right Meta", FrameModMeta, FrameModMeta, ModRightGUI},
+		{"AltGr as Ctrl and Alt", FrameModCtrl | FrameModAlt | FrameModAltGraph, 0, ModRightAlt},
+		{"right side without modifier", 0, FrameModCtrl, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			frame := Frame{
+				Type:    FrameKeyDown,
+				Payload: []byte{test.modifiers, test.right, LocationStandard, 'K', 'e', 'y', 'A'},
+			}
+
+			message, err := frame.Message()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if modifiers := message.Modifiers(); modifiers != test.expected {
+				t.Errorf("Modifiers() = %08b, expected %08b", modifiers, test.expected)
+			}
+		})
+	}
+}
+
+func TestSequencerPush(t *testing.T) {
+	// window returns the sequence numbers from first to last.
+	window := func(first uint32, last uint32) []uint32 {
+		var seqs []uint32
+		for seq := first; seq <= last; seq++ {
+			seqs = append(seqs, seq)
+		}
+		return seqs
+	}
+
+	tests := []struct {
+		name    string
+		pushed  []uint32
+		ready   []uint32
+		skipped bool
+		last    uint32
+	}{
+		{"in order", []uint32{1, 2, 3}, []uint32{1, 2, 3}, false, 3},
+		{"out of order", []uint32{2, 3, 1, 4}, []uint32{1, 2, 3, 4}, false, 4},
+		{"duplicates", []uint32{1, 1, 2, 1, 2}, []uint32{1, 2}, false, 2},
+		{"missing frame", []uint32{1, 3, 4}, []uint32{1}, false, 1},
+		{
+			"frames past the window",
+			window(2, SequenceWindow+2),
+			window(2, SequenceWindow+2),
+			true, SequenceWindow + 2,
+		},
+		{
+			"missing frame arriving after the window",
+			append(window(2, SequenceWindow+2), 1),
+			window(2, SequenceWindow+2),
+			true, SequenceWindow + 2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q := &sequencer{}
+			var ready []uint32
+			skipped := false
+
+			for _, seq := range test.pushed {
+				frames, skip := q.push(Frame{Type: FrameKeyDown, Seq: seq})
+				for _, frame := range frames {
+					ready = append(ready, frame.Seq)
+				}
+				skipped = skipped || skip
+			}
+
+			if !reflect.DeepEqual(ready, test.ready) {
+				t.Errorf("frames applied = %v, expected %v", ready, test.ready)
+			}
+			if skipped != test.skipped {
+				t.Errorf("skipped = %v, expected %v", skipped, test.skipped)
+			}
+			if q.last != test.last {
+				t.Errorf("last = %d, expected %d", q.last, test.last)
+			}
+		})
+	}
+}
+
+func concat(frames ...[]byte) []byte {
+	var data []byte
+	for _, frame := range frames {
+		data = append(data, frame...)
+	}
+	return data
+}
@@ -0,0 +1,533 @@
+/*
+ * Adsisto
+ * Copyright (c) 2019 Andrew Ying
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of version 3 of the GNU General Public License as published by the
+ * Free Software Foundation. In addition, this program is also subject to certain
+ * additional terms available at <SUPPLEMENT.md>.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+ * A PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package hid
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Types of recorded events which are not messages received from the client.
+const (
+	// RecordSession is the type of the first event of a recording, which
+	// identifies the client recorded.
+	RecordSession = "session"
+	// RecordRedactStart marks the start of a redacted segment. The keys
+	// pressed within the segment are not recorded.
+	RecordRedactStart = "redactStart"
+	// RecordRedactEnd marks the end of a redacted segment.
+	RecordRedactEnd = "redactEnd"
+)
+
+// Types of messages sent by the client to redact the keys which follow, e.g.
+// when a password field is focused.
+const (
+	MessageRedactStart = RecordRedactStart
+	MessageRedactEnd   = RecordRedactEnd
+)
+
+// RecordingExtension is the extension of the recording files. Recordings are
+// stored as one JSON encoded event per line.
+const RecordingExtension = ".jsonl"
+
+// RecordedEvent is a key event recorded in a session.
+type RecordedEvent struct {
+	// Offset is the time elapsed since the start of the recording in
+	// milliseconds
+	Offset   int64  `json:"offset"`
+	Type     string `json:"type"`
+	Client   string `json:"client,omitempty"`
+	Key      string `json:"key,omitempty"`
+	Code     string `json:"code,omitempty"`
+	Location int    `json:"location,omitempty"`
+	Ctrl     bool   `json:"ctrl,omitempty"`
+	Shift    bool   `json:"shift,omitempty"`
+	Alt      bool   `json:"alt,omitempty"`
+	Meta     bool   `json:"meta,omitempty"`
+	AltGraph bool   `json:"altGraph,omitempty"`
+
+	CtrlRight  bool `json:"ctrlRight,omitempty"`
+	ShiftRight bool `json:"shiftRight,omitempty"`
+	AltRight   bool `json:"altRight,omitempty"`
+	MetaRight  bool `json:"metaRight,omitempty"`
+}
+
+// Recording describes a recording kept in the store.
+type Recording struct {
+	ID      string    `json:"id"`
+	Client  string    `json:"client"`
+	Started time.Time `json:"started"`
+	Size    int64     `json:"size"`
+}
+
+// RecordingStore keeps the recordings as files in a directory.
+type RecordingStore struct {
+	// Dir is the path to the directory of the recordings
+	Dir string
+	// active are the IDs of the recordings still being written to
+	active map[string]bool
+	mutex  sync.Mutex
+}
+
+// Recorder appends the key events of a session to a recording.
+type Recorder struct {
+	// ID is the ID of the recording
+	ID        string
+	store     *RecordingStore
+	file      *os.File
+	encoder   *json.Encoder
+	start     time.Time
+	redacting bool
+	mutex     sync.Mutex
+}
+
+var (
+	ErrRecordingNotFound = errors.New("recording not found")
+	ErrInvalidRecording  = errors.New("recording is invalid")
+	ErrRecordingActive   = errors.New("recording is in progress")
+
+	recordingIDPattern = regexp.MustCompile(`^[0-9]+$`)
+)
+
+// Recordable returns whether the message is recorded in a session.
+func (m *StreamMessage) Recordable() bool {
+	switch m.Type {
+	case "", MessageKeyDown, MessageKeyUp, MessageControl:
+		return true
+	default:
+		return false
+	}
+}
+
+// Message returns the message received from the client when the event was
+// recorded.
+func (e *RecordedEvent) Message() StreamMessage {
+	return StreamMessage{
+		Type:     e.Type,
+		Key:      e.Key,
+		Code:     e.Code,
+		Location: e.Location,
+		Ctrl:     e.Ctrl,
+		Shift:    e.Shift,
+		Alt:      e.Alt,
+		Meta:     e.Meta,
+		AltGraph: e.AltGraph,
+
+		CtrlRight:  e.CtrlRight,
+		ShiftRight: e.ShiftRight,
+		AltRight:   e.AltRight,
+		MetaRight:  e.MetaRight,
+	}
+}
+
+// Replayable returns whether the event is sent to the target when replayed.
+func (e *RecordedEvent) Replayable() bool {
+	message := e.Message()
+	return message.Recordable()
+}
+
+// Record appends the message to the recording, unless a redacted segment is in
+// progress or the message is not a key event.
+func (r *Recorder) Record(message StreamMessage) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.redacting || !message.Recordable() {
+		return nil
+	}
+
+	return r.encoder.Encode(RecordedEvent{
+		Offset:   r.offset(),
+		Type:     message.Type,
+		Key:      message.Key,
+		Code:     message.Code,
+		Location: message.Location,
+		Ctrl:     message.Ctrl,
+		Shift:    message.Shift,
+		Alt:      message.Alt,
+		Meta:     message.Meta,
+		AltGraph: message.AltGraph,
+
+		CtrlRight:  message.CtrlRight,
+		ShiftRight: message.ShiftRight,
+		AltRight:   message.AltRight,
+		MetaRight:  message.MetaRight,
+	})
+}
+
+// Redact starts or ends a redacted segment.
+func (r *Recorder) Redact(redacting bool) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.redacting == redacting {
+		return nil
+	}
+	r.redacting = redacting
+
+	event := RecordedEvent{
+		Offset: r.offset(),
+		Type:   RecordRedactEnd,
+	}
+	if redacting {
+		event.Type = RecordRedactStart
+	}
+
+	return r.encoder.Encode(event)
+}
+
+// Close closes the recording.
+func (r *Recorder) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.store.setActive(r.ID, false)
+	return r.file.Close()
+}
+
+func (r *Recorder) offset() int64 {
+	return int64(time.Since(r.start) / time.Millisecond)
+}
+
+// Create starts a new recording of the session of a client.
+func (s *RecordingStore) Create(client string) (*Recorder, error) {
+	if err := os.MkdirAll(s.Dir, 0750); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	id := strconv.FormatInt(now.UnixNano(), 10)
+
+	file, err := os.OpenFile(s.path(id), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		return nil, err
+	}
+
+	s.setActive(id, true)
+	recorder := &Recorder{
+		ID:      id,
+		store:   s,
+		file:    file,
+		encoder: json.NewEncoder(file),
+		start:   now,
+	}
+
+	err = recorder.encoder.Encode(RecordedEvent{
+		Type:   RecordSession,
+		Client: client,
+	})
+	if err != nil {
+		_ = recorder.Close()
+		return nil, err
+	}
+
+	return recorder, nil
+}
+
+// All returns every recording, the most recent first.
+func (s *RecordingStore) All() ([]Recording, error) {
+	files, err := ioutil.ReadDir(s.Dir)
+	if os.IsNotExist(err) {
+		return []Recording{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	recordings := []Recording{}
+	for _, file := range files {
+		id := file.Name()[:len(file.Name())-len(filepath.Ext(file.Name()))]
+		if filepath.Ext(file.Name()) != RecordingExtension || !recordingIDPattern.MatchString(id) {
+			continue
+		}
+
+		nano, _ := strconv.ParseInt(id, 10, 64)
+		recordings = append(recordings, Recording{
+			ID:      id,
+			Client:  s.client(id),
+			Started: time.Unix(0, nano),
+			Size:    file.Size(),
+		})
+	}
+
+	sort.Slice(recordings, func(i, j int) bool {
+		return recordings[i].Started.After(recordings[j].Started)
+	})
+	return recordings, nil
+}
+
+// Path returns the path to the file of the recording.
+func (s *RecordingStore) Path(id string) (string, error) {
+	if !recordingIDPattern.MatchString(id) {
+		return "", ErrRecordingNotFound
+	}
+
+	path := s.path(id)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return "", ErrRecordingNotFound
+	} else if err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+// Load returns the events of the recording.
+func (s *RecordingStore) Load(id string) ([]RecordedEvent, error) {
+	path, err := s.Path(id)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return decodeRecording(file)
+}
+
+// Import stores the recording read from r, e.g. one downloaded from another
+// target, and returns its ID.
+func (s *RecordingStore) Import(r io.Reader) (string, error) {
+	events, err := decodeRecording(r)
+	if err != nil {
+		return "", err
+	}
+
+	if err = os.MkdirAll(s.Dir, 0750); err != nil {
+		return "", err
+	}
+
+	id := strconv.FormatInt(time.Now().UnixNano(), 10)
+	return id, s.save(id, events)
+}
+
+// Redact removes the key events between the offsets from and to, in
+// milliseconds, from the recording. A recording still being written to cannot
+// be redacted, as its recorder would keep appending to the replaced file.
+func (s *RecordingStore) Redact(id string, from int64, to int64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.active[id] {
+		return ErrRecordingActive
+	}
+
+	events, err := s.Load(id)
+	if err != nil {
+		return err
+	}
+
+	redacted := make([]RecordedEvent, 0, len(events))
+	redacting := false
+
+	for _, event := range events {
+		inside := event.Type != RecordSession && event.Offset >= from && event.Offset <= to
+		if inside && !redacting {
+			redacted = append(redacted, RecordedEvent{Offset: from, Type: RecordRedactStart})
+			redacting = true
+		}
+		if !inside && redacting {
+			redacted = append(redacted, RecordedEvent{Offset: to, Type: RecordRedactEnd})
+			redacting = false
+		}
+
+		if inside {
+			continue
+		}
+
+		redacted = append(redacted, event)
+	}
+
+	if redacting {
+		redacted = append(redacted, RecordedEvent{Offset: to, Type: RecordRedactEnd})
+	}
+
+	return s.save(id, redacted)
+}
+
+// Delete removes the recording.
+func (s *RecordingStore) Delete(id string) error {
+	path, err := s.Path(id)
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// Replay sends the replayable events to the target through send, preserving
+// the time between them. The time is divided by speed if positive, and capped
+// to maxDelay if positive. Progress, if not nil, is called after every event.
+func Replay(ctx context.Context, events []RecordedEvent, speed float64, maxDelay time.Duration, send func(StreamMessage) error, progress func(int)) error {
+	var previous int64
+
+	for i, event := range events {
+		if !event.Replayable() {
+			if progress != nil {
+				progress(i + 1)
+			}
+			continue
+		}
+
+		delay := time.Duration(event.Offset-previous) * time.Millisecond
+		previous = event.Offset
+
+		if speed > 0 {
+			delay = time.Duration(float64(delay) / speed)
+		}
+		if maxDelay > 0 && delay > maxDelay {
+			delay = maxDelay
+		}
+
+		if delay > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delay):
+			}
+		} else {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+		}
+
+		if err := send(event.Message()); err != nil {
+			return err
+		}
+
+		if progress != nil {
+			progress(i + 1)
+		}
+	}
+
+	return nil
+}
+
+// setActive records whether the recording is being written to.
+func (s *RecordingStore) setActive(id string, active bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.active == nil {
+		s.active = map[string]bool{}
+	}
+
+	if active {
+		s.active[id] = true
+	} else {
+		delete(s.active, id)
+	}
+}
+
+func (s *RecordingStore) path(id string) string {
+	return filepath.Join(s.Dir, id+RecordingExtension)
+}
+
+// client returns the client identified in the first event of the recording.
+func (s *RecordingStore) client(id string) string {
+	file, err := os.Open(s.path(id))
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	line, err := bufio.NewReader(file).ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return ""
+	}
+
+	event := RecordedEvent{}
+	if err = json.Unmarshal(line, &event); err != nil || event.Type != RecordSession {
+		return ""
+	}
+
+	return event.Client
+}
+
+// save writes the events to a temporary file first, so that the recording is
+// never left partially written.
+func (s *RecordingStore) save(id string, events []RecordedEvent) error {
+	file, err := ioutil.TempFile(s.Dir, ".recording")
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(file)
+	for _, event := range events {
+		if err = encoder.Encode(event); err != nil {
+			_ = file.Close()
+			_ = os.Remove(file.Name())
+			return err
+		}
+	}
+
+	if err = file.Close(); err != nil {
+		_ = os.Remove(file.Name())
+		return err
+	}
+
+	return os.Rename(file.Name(), s.path(id))
+}
+
+func decodeRecording(r io.Reader) ([]RecordedEvent, error) {
+	var events []RecordedEvent
+
+	decoder := json.NewDecoder(r)
+	for {
+		event := RecordedEvent{}
+		err := decoder.Decode(&event)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, ErrInvalidRecording
+		}
+
+		switch event.Type {
+		case RecordSession, RecordRedactStart, RecordRedactEnd:
+		default:
+			if !event.Replayable() {
+				return nil, ErrInvalidRecording
+			}
+		}
+
+		events = append(events, event)
+	}
+
+	if len(events) == 0 {
+		return nil, ErrInvalidRecording
+	}
+
+	return events, nil
+}
@@ -0,0 +1,206 @@
+/*
+ * Adsisto
+ * Copyright (c) 2019 Andrew Ying
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of version 3 of the GNU General Public License as published by the
+ * Free Software Foundation. In addition, this program is also subject to certain
+ * additional terms available at <SUPPLEMENT.md>.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+ * A PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package hid
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// DefaultTypeDelay is the default interval between consecutive reports sent
+// when typing text.
+const DefaultTypeDelay = time.Millisecond * 20
+
+// Keystroke is a key pressed together with a set of modifiers.
+type Keystroke struct {
+	Usage     byte
+	Modifiers byte
+}
+
+// Typer types text on the target by translating every character into a key
+// press and release.
+type Typer struct {
+	Keyboard *Keyboard
+	Writer   ReportWriter
+	// Layout is the keyboard layout configured on the target
+	Layout *Layout
+	// Delay is the interval between consecutive reports
+	Delay time.Duration
+	// Progress, if set, is called after every character typed
+	Progress func(typed int, total int)
+	// LEDs, if set, returns the state of the keyboard LEDs on the target. It
+	// is used to compensate for Caps Lock being turned on.
+	LEDs func() LEDs
+}
+
+// keyboardUpdater is implemented by the writers which change the state of the
+// keyboard themselves, e.g. to hold a lock while changing it.
+type keyboardUpdater interface {
+	updateKeyboard(keyboard *Keyboard, change func(keyboard *Keyboard)) error
+}
+
+// UnsupportedCharacterError is returned when text contains a character which
+// cannot be typed.
+type UnsupportedCharacterError struct {
+	Character rune
+	Offset    int
+}
+
+var (
+	ErrInvalidText = errors.New("text is not valid UTF-8")
+)
+
+func (e *UnsupportedCharacterError) Error() string {
+	return fmt.Sprintf("character %q at offset %d cannot be typed", e.Character, e.Offset)
+}
+
+// NormaliseText returns the text as typed on the target. Line breaks pasted
+// from Windows would otherwise be typed twice.
+func NormaliseText(text string) string {
+	return strings.Replace(text, "\r\n", "\n", -1)
+}
+
+// Validate checks that every character of the text can be typed.
+func (t *Typer) Validate(text string) error {
+	if !utf8.ValidString(text) {
+		return ErrInvalidText
+	}
+
+	layout := t.layout()
+	for offset, r := range text {
+		if _, found := layout.Lookup(r); !found {
+			return &UnsupportedCharacterError{Character: r, Offset: offset}
+		}
+	}
+
+	return nil
+}
+
+// Type types the text on the target. Typing stops when ctx is cancelled, in
+// which case ctx.Err() is returned.
+func (t *Typer) Type(ctx context.Context, text string) error {
+	if err := t.Validate(text); err != nil {
+		return err
+	}
+
+	delay := t.Delay
+	if delay <= 0 {
+		delay = DefaultTypeDelay
+	}
+
+	text = NormaliseText(text)
+
+	layout := t.layout()
+	total := utf8.RuneCountInString(text)
+	typed := 0
+
+	for _, r := range text {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		sequence, _ := layout.Lookup(r)
+		if t.LEDs != nil && t.LEDs().CapsLock {
+			sequence = compensateCapsLock(r, sequence)
+		}
+
+		for _, stroke := range sequence {
+			if err := t.press(stroke); err != nil {
+				_ = t.release(stroke)
+				return err
+			}
+			time.Sleep(delay)
+
+			if err := t.release(stroke); err != nil {
+				return err
+			}
+			time.Sleep(delay)
+		}
+
+		typed++
+		if t.Progress != nil {
+			t.Progress(typed, total)
+		}
+	}
+
+	return nil
+}
+
+// compensateCapsLock inverts Shift for the letter typed by the sequence, as
+// Caps Lock inverts the case of letters typed without AltGr.
+func compensateCapsLock(r rune, sequence []Keystroke) []Keystroke {
+	if !unicode.IsLetter(r) || unicode.ToUpper(r) == unicode.ToLower(r) {
+		return sequence
+	}
+
+	last := sequence[len(sequence)-1]
+	if last.Modifiers&ModRightAlt != 0 {
+		return sequence
+	}
+
+	compensated := make([]Keystroke, len(sequence))
+	copy(compensated, sequence)
+	compensated[len(sequence)-1].Modifiers ^= ModLeftShift
+	return compensated
+}
+
+func (t *Typer) layout() *Layout {
+	if t.Layout == nil {
+		return Layouts[DefaultLayout]
+	}
+
+	return t.Layout
+}
+
+func (t *Typer) press(stroke Keystroke) error {
+	return t.update(func(keyboard *Keyboard) {
+		for _, modifier := range ModifierUsages(stroke.Modifiers) {
+			keyboard.Press(modifier)
+		}
+		keyboard.Press(stroke.Usage)
+	})
+}
+
+func (t *Typer) release(stroke Keystroke) error {
+	return t.update(func(keyboard *Keyboard) {
+		keyboard.Release(stroke.Usage)
+		for _, modifier := range ModifierUsages(stroke.Modifiers) {
+			keyboard.Release(modifier)
+		}
+	})
+}
+
+// update changes the state of the keyboard and sends the report. When the
+// keyboard is shared with the clients, the writer applies the change under the
+// same lock as their input, so that their reports are not interleaved.
+func (t *Typer) update(change func(keyboard *Keyboard)) error {
+	if updater, ok := t.Writer.(keyboardUpdater); ok {
+		return updater.updateKeyboard(t.Keyboard, change)
+	}
+
+	change(t.Keyboard)
+	report := t.Keyboard.Report()
+	return t.Writer.WriteReport(report[:])
+}
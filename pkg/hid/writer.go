@@ -0,0 +1,168 @@
+/*
+ * Adsisto
+ * Copyright (c) 2019 Andrew Ying
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of version 3 of the GNU General Public License as published by the
+ * Free Software Foundation. In addition, this program is also subject to certain
+ * additional terms available at <SUPPLEMENT.md>.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+ * A PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package hid
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// ReportWriter sends raw reports to a HID device.
+type ReportWriter interface {
+	WriteReport(report []byte) error
+	Close() error
+}
+
+// DeviceWriter writes reports to a HID gadget device, e.g. /dev/hidg0. The
+// device is opened on the first write, and re-opened if a write fails, e.g.
+// after the gadget is re-bound to the UDC.
+//
+// As the device is opened for appending only, DeviceWriter pointed at a
+// regular file can also be used to record the reports written.
+type DeviceWriter struct {
+	// Path is the path to the device
+	Path string
+	// Retries is the number of times a failed write is retried
+	Retries int
+	// RetryInterval is the interval between retries
+	RetryInterval time.Duration
+	file          *os.File
+	mutex         sync.Mutex
+}
+
+// MemoryWriter keeps the reports written to it in memory. It is used in place
+// of a HID device when the report pipeline is tested.
+type MemoryWriter struct {
+	reports [][]byte
+	closed  bool
+	mutex   sync.Mutex
+}
+
+var (
+	ErrDeviceUndefined = errors.New("HID device not defined in configuration")
+	ErrWriterClosed    = errors.New("report writer is closed")
+)
+
+// WriteReport writes a report to the device.
+func (d *DeviceWriter) WriteReport(report []byte) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.Path == "" {
+		return ErrDeviceUndefined
+	}
+
+	var err error
+
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			time.Sleep(d.RetryInterval)
+		}
+
+		if d.file == nil {
+			d.file, err = os.OpenFile(d.Path, os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				d.file = nil
+				log.Printf("[ERROR] Unable to open HID device %s: %s\n", d.Path, err)
+
+				if attempt >= d.Retries {
+					return err
+				}
+				continue
+			}
+		}
+
+		var n int
+		n, err = d.file.Write(report)
+		if err == nil && n < len(report) {
+			err = io.ErrShortWrite
+		}
+		if err == nil {
+			return nil
+		}
+
+		log.Printf("[ERROR] Unable to write to HID device %s: %s\n", d.Path, err)
+		_ = d.file.Close()
+		d.file = nil
+
+		if attempt >= d.Retries {
+			return err
+		}
+	}
+}
+
+// Close closes the device.
+func (d *DeviceWriter) Close() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.file == nil {
+		return nil
+	}
+
+	err := d.file.Close()
+	d.file = nil
+	return err
+}
+
+// WriteReport keeps a copy of the report.
+func (m *MemoryWriter) WriteReport(report []byte) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.closed {
+		return ErrWriterClosed
+	}
+
+	buf := make([]byte, len(report))
+	copy(buf, report)
+	m.reports = append(m.reports, buf)
+	return nil
+}
+
+// Reports returns the reports written so far.
+func (m *MemoryWriter) Reports() [][]byte {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	reports := make([][]byte, len(m.reports))
+	copy(reports, m.reports)
+	return reports
+}
+
+// Reset discards the reports written so far.
+func (m *MemoryWriter) Reset() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.reports = nil
+}
+
+// Close marks the writer as closed. Subsequent writes fail with
+// ErrWriterClosed.
+func (m *MemoryWriter) Close() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.closed = true
+	return nil
+}
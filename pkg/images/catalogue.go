@@ -0,0 +1,519 @@
+/*
+ * Adsisto
+ * Copyright (c) 2019 Andrew Ying
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of version 3 of the GNU General Public License as published by the
+ * Free Software Foundation. In addition, this program is also subject to certain
+ * additional terms available at <SUPPLEMENT.md>.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+ * A PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package images
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CatalogueFile is the name of the file holding the metadata of the images,
+// kept in the image directory.
+const CatalogueFile = ".catalogue.json"
+
+// Image is an image in the library.
+type Image struct {
+	// Name is the name of the file in the image directory
+	Name string `json:"name"`
+	// Label is the human-friendly name of the image, e.g. the name of the file
+	// uploaded
+	Label    string    `json:"label"`
+	Size     int64     `json:"size"`
+	SHA256   string    `json:"sha256"`
+	Uploaded time.Time `json:"uploaded"`
+	Uploader string    `json:"uploader"`
+	// Type is the type of the medium, i.e. TypeCDROM or TypeDisk
+	Type string `json:"type"`
+	// Volume is the metadata of the file system of CD-ROM images, or nil if
+	// the image is not an ISO 9660 file system
+	Volume *Volume `json:"volume"`
+}
+
+// Catalogue keeps the metadata of the images in the image directory. Files
+// added to the directory by other means are listed with the metadata
+// available from the file system.
+type Catalogue struct {
+	// Dir is the path to the image directory
+	Dir string
+	// Quota is the maximum total size of the images in bytes, or 0 for no
+	// limit
+	Quota int64
+	// InUse, if not nil, reports whether the image is currently mounted.
+	// Images in use cannot be deleted.
+	InUse func(name string) (bool, error)
+
+	images map[string]Image
+	mutex  sync.Mutex
+}
+
+var (
+	ErrImageNotFound       = errors.New("image not found")
+	ErrImageInUse          = errors.New("image is currently mounted")
+	ErrQuotaExceeded       = errors.New("image storage quota exceeded")
+	ErrUnsupportedFormat   = errors.New("image must be a .iso, .img or .raw file, optionally compressed with gzip, xz or zstd")
+	ErrDecompressorMissing = errors.New("image compression is not supported as xz or zstd is not installed")
+)
+
+// All returns every image, sorted by label.
+func (c *Catalogue) All() ([]Image, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+
+	images := make([]Image, 0, len(c.images))
+	for _, image := range c.images {
+		images = append(images, image)
+	}
+
+	sort.Slice(images, func(i, j int) bool {
+		if images[i].Label == images[j].Label {
+			return images[i].Name < images[j].Name
+		}
+		return images[i].Label < images[j].Label
+	})
+	return images, nil
+}
+
+// Get returns the image with the given name.
+func (c *Catalogue) Get(name string) (Image, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if err := c.load(); err != nil {
+		return Image{}, err
+	}
+
+	image, found := c.images[name]
+	if !found {
+		return Image{}, ErrImageNotFound
+	}
+
+	return image, nil
+}
+
+// Path returns the path to the file of the image with the given name.
+func (c *Catalogue) Path(name string) (string, error) {
+	if !validName(name) {
+		return "", ErrImageNotFound
+	}
+
+	return filepath.Join(c.Dir, name), nil
+}
+
+// Usage returns the total size of the images in bytes.
+func (c *Catalogue) Usage() (int64, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if err := c.load(); err != nil {
+		return 0, err
+	}
+
+	return c.usage(), nil
+}
+
+// Reserve checks that an image of the given size fits within the quota.
+func (c *Catalogue) Reserve(size int64) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if err := c.load(); err != nil {
+		return err
+	}
+
+	if c.Quota > 0 && c.usage()+size > c.Quota {
+		return ErrQuotaExceeded
+	}
+
+	return nil
+}
+
+// Add records the metadata of an image whose file is already in the image
+// directory. The size of the image is taken from its file.
+func (c *Catalogue) Add(image Image) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if err := c.load(); err != nil {
+		return err
+	}
+
+	if !validName(image.Name) {
+		return ErrImageNotFound
+	}
+
+	info, err := os.Stat(filepath.Join(c.Dir, image.Name))
+	if os.IsNotExist(err) {
+		return ErrImageNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	image.Size = info.Size()
+	if image.Label == "" {
+		image.Label = image.Name
+	}
+
+	previous, found := c.images[image.Name]
+	c.images[image.Name] = image
+	if err = c.save(); err != nil {
+		if found {
+			c.images[image.Name] = previous
+		} else {
+			delete(c.images, image.Name)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Commit moves the file at path into the image directory and records the
+// image. The file is named after the SHA-256 digest of its content, which
+// must be set in image, and the extension of its label. Compressed files are
+// decompressed first, in which case the digest is replaced by the digest of
+// the image decompressed. If the library already holds the same image, the
+// file is discarded and the existing image, with its metadata, is returned.
+func (c *Catalogue) Commit(path string, image Image) (Image, error) {
+	extension, err := Extension(image.Label)
+	if err != nil {
+		return Image{}, err
+	}
+
+	if compression := Compression(image.Label); compression != "" {
+		decompressed, digest, err := decompress(path, compression)
+		if err != nil {
+			return Image{}, err
+		}
+		defer os.Remove(decompressed)
+
+		info, err := os.Stat(decompressed)
+		if err != nil {
+			return Image{}, err
+		}
+		if err = c.Reserve(info.Size()); err != nil {
+			return Image{}, err
+		}
+
+		if err = os.Remove(path); err != nil {
+			return Image{}, err
+		}
+		path = decompressed
+		image.SHA256 = digest
+		image.Label = image.Label[:len(image.Label)-len(compression)]
+	}
+
+	image.Name = image.SHA256 + extension
+	image.Type = TypeOf(image.Name)
+	if !validName(image.Name) {
+		return Image{}, ErrImageNotFound
+	}
+
+	if existing, err := c.Get(image.Name); err == nil {
+		return existing, os.Remove(path)
+	} else if err != ErrImageNotFound {
+		return Image{}, err
+	}
+
+	image.Volume = nil
+	if image.Type == TypeCDROM {
+		image.Volume, _ = ReadVolume(path)
+	}
+
+	if err = os.Rename(path, filepath.Join(c.Dir, image.Name)); err != nil {
+		return Image{}, err
+	}
+
+	if err = c.Add(image); err != nil {
+		return Image{}, err
+	}
+
+	return c.Get(image.Name)
+}
+
+// Rehash records the changes made to the file of the image in place, e.g. by
+// the host writing to a medium mounted without an overlay, and returns the
+// image updated. An image named after its digest is renamed after the digest
+// of its new content, unless another image has the same content, in which case
+// the file is removed and the other image returned. The label, uploader and
+// upload time of the image are kept.
+func (c *Catalogue) Rehash(name string) (Image, error) {
+	path, err := c.Path(name)
+	if err != nil {
+		return Image{}, err
+	}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return Image{}, ErrImageNotFound
+	}
+	if err != nil {
+		return Image{}, err
+	}
+
+	digest := sha256.New()
+	_, err = io.Copy(digest, file)
+	_ = file.Close()
+	if err != nil {
+		return Image{}, err
+	}
+	sum := hex.EncodeToString(digest.Sum(nil))
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if err = c.load(); err != nil {
+		return Image{}, err
+	}
+
+	image, found := c.images[name]
+	if !found {
+		return Image{}, ErrImageNotFound
+	}
+	if image.SHA256 == sum {
+		return image, nil
+	}
+
+	extension := filepath.Ext(name)
+	renamed := name
+	if strings.TrimSuffix(name, extension) == image.SHA256 {
+		renamed = sum + extension
+	}
+
+	if existing, found := c.images[renamed]; found && renamed != name {
+		if err = os.Remove(path); err != nil {
+			return Image{}, err
+		}
+		delete(c.images, name)
+		return existing, c.save()
+	}
+
+	if renamed != name {
+		if err = os.Rename(path, filepath.Join(c.Dir, renamed)); err != nil {
+			return Image{}, err
+		}
+		delete(c.images, name)
+	}
+
+	image.Name = renamed
+	image.SHA256 = sum
+	if info, err := os.Stat(filepath.Join(c.Dir, renamed)); err == nil {
+		image.Size = info.Size()
+	}
+	if image.Type == TypeCDROM {
+		image.Volume, _ = ReadVolume(filepath.Join(c.Dir, renamed))
+	}
+	c.images[renamed] = image
+
+	return image, c.save()
+}
+
+// Rename changes the label of the image with the given name.
+func (c *Catalogue) Rename(name string, label string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if err := c.load(); err != nil {
+		return err
+	}
+
+	image, found := c.images[name]
+	if !found {
+		return ErrImageNotFound
+	}
+
+	previous := image.Label
+	image.Label = label
+	c.images[name] = image
+	if err := c.save(); err != nil {
+		image.Label = previous
+		c.images[name] = image
+		return err
+	}
+
+	return nil
+}
+
+// Delete removes the image with the given name and its file, unless it is
+// currently mounted.
+func (c *Catalogue) Delete(name string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if err := c.load(); err != nil {
+		return err
+	}
+
+	image, found := c.images[name]
+	if !found {
+		return ErrImageNotFound
+	}
+
+	if c.InUse != nil {
+		inUse, err := c.InUse(name)
+		if err != nil {
+			return err
+		}
+		if inUse {
+			return ErrImageInUse
+		}
+	}
+
+	if err := os.Remove(filepath.Join(c.Dir, name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	delete(c.images, name)
+	if err := c.save(); err != nil {
+		c.images[name] = image
+		return err
+	}
+
+	return nil
+}
+
+// load reads the catalogue file once, then reconciles the images with the
+// files in the image directory.
+func (c *Catalogue) load() error {
+	if c.images == nil {
+		content, err := ioutil.ReadFile(filepath.Join(c.Dir, CatalogueFile))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		var images []Image
+		if len(content) != 0 {
+			if err = json.Unmarshal(content, &images); err != nil {
+				return err
+			}
+		}
+
+		c.images = map[string]Image{}
+		for _, image := range images {
+			c.images[image.Name] = image
+		}
+	}
+
+	files, err := ioutil.ReadDir(c.Dir)
+	if os.IsNotExist(err) {
+		files = nil
+	} else if err != nil {
+		return err
+	}
+
+	present := map[string]bool{}
+	for _, file := range files {
+		if !file.Mode().IsRegular() || !validName(file.Name()) {
+			continue
+		}
+		present[file.Name()] = true
+
+		image, found := c.images[file.Name()]
+		if !found {
+			image = Image{
+				Name:     file.Name(),
+				Label:    file.Name(),
+				Uploaded: file.ModTime(),
+			}
+		}
+		if image.Type == "" {
+			image.Type = TypeOf(image.Name)
+		}
+		if image.Type == TypeCDROM && image.Volume == nil {
+			image.Volume, _ = ReadVolume(filepath.Join(c.Dir, image.Name))
+		}
+		image.Size = file.Size()
+		c.images[file.Name()] = image
+	}
+
+	for name := range c.images {
+		if !present[name] {
+			delete(c.images, name)
+		}
+	}
+
+	return nil
+}
+
+func (c *Catalogue) usage() int64 {
+	var usage int64
+	for _, image := range c.images {
+		usage += image.Size
+	}
+
+	return usage
+}
+
+// save writes the catalogue to a temporary file first, so that the file is
+// never left partially written.
+func (c *Catalogue) save() error {
+	images := make([]Image, 0, len(c.images))
+	for _, image := range c.images {
+		images = append(images, image)
+	}
+
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].Name < images[j].Name
+	})
+
+	encoded, err := json.MarshalIndent(images, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(c.Dir, 0755); err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(c.Dir, CatalogueFile)
+	if err != nil {
+		return err
+	}
+
+	if _, err = file.Write(encoded); err != nil {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		return err
+	}
+	if err = file.Close(); err != nil {
+		_ = os.Remove(file.Name())
+		return err
+	}
+
+	return os.Rename(file.Name(), filepath.Join(c.Dir, CatalogueFile))
+}
+
+// validName reports whether the name is the name of a file directly in the
+// image directory. Hidden files are reserved for the catalogue.
+func validName(name string) bool {
+	return name != "" && name == filepath.Base(name) && !strings.HasPrefix(name, ".")
+}
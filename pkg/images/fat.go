@@ -0,0 +1,282 @@
+/*
+ * Adsisto
+ * Copyright (c) 2019 Andrew Ying
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of version 3 of the GNU General Public License as published by the
+ * Free Software Foundation. In addition, this program is also subject to certain
+ * additional terms available at <SUPPLEMENT.md>.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+ * A PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package images
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MinFATSize is the minimum size of a FAT image, as FAT32 requires at least
+// 65525 clusters.
+const MinFATSize = 64 << 20
+
+// FATHeadroom is the free space left on a FAT image for the files written by
+// the host, when the size of the image is not given.
+const FATHeadroom = 64 << 20
+
+// DefaultVolumeLabel is the volume label of a FAT image whose label does not
+// contain any character allowed in a volume label.
+const DefaultVolumeLabel = "ADSISTO"
+
+var (
+	ErrFATTooSmall = errors.New("image is too small for the files")
+	ErrNotFAT      = errors.New("image is not a FAT disk image")
+)
+
+var (
+	volumeLabelPattern = regexp.MustCompile(`[^A-Z0-9_-]`)
+)
+
+// Stage returns a new directory in the upload directory, where the files of a
+// FAT image are written before the image is built.
+func (u *Uploads) Stage() (string, error) {
+	if err := os.MkdirAll(u.dir(), 0755); err != nil {
+		return "", err
+	}
+
+	return ioutil.TempDir(u.dir(), "stage")
+}
+
+// BuildFAT builds a FAT32 disk image holding the files in dir and adds it to
+// the library. If size is 0, the image is large enough for the files and
+// FATHeadroom. The image is built with mkfs.fat and mtools, which must be
+// installed.
+func (u *Uploads) BuildFAT(dir string, label string, size int64, uploader string) (Image, error) {
+	return u.buildVolume(dir, label, volumeLabel(label), size, uploader)
+}
+
+// buildVolume builds a FAT32 disk image with the given volume label.
+func (u *Uploads) buildVolume(dir string, label string, volume string, size int64, uploader string) (Image, error) {
+	var total int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			total += info.Size()
+		}
+		return err
+	})
+	if err != nil {
+		return Image{}, err
+	}
+
+	// The file allocation tables and the slack of the last cluster of every
+	// file take up to about a tenth of the image.
+	if size == 0 {
+		size = total + total/10 + FATHeadroom
+	}
+	if size < MinFATSize {
+		size = MinFATSize
+	}
+	size = (size + 1<<20 - 1) &^ (1<<20 - 1)
+	if size < total+total/10 {
+		return Image{}, ErrFATTooSmall
+	}
+
+	if err = u.Catalogue.Reserve(size); err != nil {
+		return Image{}, err
+	}
+
+	if _, err = Extension(label); err != nil || Compression(label) != "" {
+		label = strings.TrimSuffix(label, filepath.Ext(label)) + ".img"
+	}
+
+	file, err := ioutil.TempFile(u.dir(), "fat")
+	if err != nil {
+		return Image{}, err
+	}
+	path := file.Name()
+	if err = file.Close(); err != nil {
+		_ = os.Remove(path)
+		return Image{}, err
+	}
+	// mkfs.fat creates the image itself.
+	if err = os.Remove(path); err != nil {
+		return Image{}, err
+	}
+
+	image, err := u.buildFAT(path, dir, label, volume, size, uploader)
+	if err != nil {
+		_ = os.Remove(path)
+	}
+
+	return image, err
+}
+
+func (u *Uploads) buildFAT(path string, dir string, label string, volume string, size int64, uploader string) (Image, error) {
+	err := run(ioutil.Discard, "mkfs.fat",
+		"-C", "-F", "32", "-n", volume,
+		path, strconv.FormatInt(size>>10, 10),
+	)
+	if err != nil {
+		return Image{}, err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return Image{}, err
+	}
+
+	if len(files) != 0 {
+		args := []string{"-s", "-p", "-Q", "-i", path}
+		for _, file := range files {
+			args = append(args, filepath.Join(dir, file.Name()))
+		}
+		args = append(args, "::/")
+
+		if err = run(ioutil.Discard, "mcopy", args...); err != nil {
+			return Image{}, err
+		}
+	}
+
+	return u.commitBuilt(path, label, uploader)
+}
+
+// commitBuilt adds the image built at path to the library.
+func (u *Uploads) commitBuilt(path string, label string, uploader string) (Image, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Image{}, err
+	}
+	digest := sha256.New()
+	_, err = io.Copy(digest, file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return Image{}, err
+	}
+
+	return u.Catalogue.Commit(path, Image{
+		Label:    label,
+		SHA256:   hex.EncodeToString(digest.Sum(nil)),
+		Uploaded: time.Now(),
+		Uploader: uploader,
+	})
+}
+
+// ExtractFAT writes the files of the FAT disk image with the given name to a
+// ZIP archive, e.g. to retrieve the files written by the host. The image must
+// not be mounted.
+func (u *Uploads) ExtractFAT(name string, writer io.Writer) error {
+	image, err := u.Catalogue.Get(name)
+	if err != nil {
+		return err
+	}
+	if image.Type != TypeDisk {
+		return ErrNotFAT
+	}
+
+	if u.Catalogue.InUse != nil {
+		inUse, err := u.Catalogue.InUse(name)
+		if err != nil {
+			return err
+		}
+		if inUse {
+			return ErrImageInUse
+		}
+	}
+
+	path, err := u.Catalogue.Path(name)
+	if err != nil {
+		return err
+	}
+
+	dir, err := u.Stage()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	if err = run(ioutil.Discard, "mdir", "-i", path, "::/"); err != nil {
+		return ErrNotFAT
+	}
+	if err = run(ioutil.Discard, "mcopy", "-s", "-p", "-n", "-Q", "-i", path, "::/*", dir); err != nil {
+		// mcopy fails when the image is empty.
+		if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+			return err
+		}
+	}
+
+	archive := zip.NewWriter(writer)
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		relative, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(relative)
+		if info.IsDir() {
+			header.Name += "/"
+			_, err = archive.CreateHeader(header)
+			return err
+		}
+		header.Method = zip.Deflate
+
+		entry, err := archive.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		_, err = io.Copy(entry, file)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return archive.Close()
+}
+
+// volumeLabel returns the FAT volume label for the image label, which is at
+// most 11 characters among upper case letters, digits, underscores and
+// hyphens.
+func volumeLabel(label string) string {
+	name := strings.TrimSuffix(filepath.Base(label), filepath.Ext(label))
+	name = volumeLabelPattern.ReplaceAllString(strings.ToUpper(name), "")
+	if len(name) > 11 {
+		name = name[:11]
+	}
+	if name == "" {
+		name = DefaultVolumeLabel
+	}
+
+	return name
+}
@@ -0,0 +1,552 @@
+/*
+ * Adsisto
+ * Copyright (c) 2019 Andrew Ying
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of version 3 of the GNU General Public License as published by the
+ * Free Software Foundation. In addition, this program is also subject to certain
+ * additional terms available at <SUPPLEMENT.md>.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+ * A PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package images
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// States of a fetch.
+const (
+	FetchDownloading = "downloading"
+	FetchVerifying   = "verifying"
+	FetchComplete    = "complete"
+	FetchFailed      = "failed"
+	FetchCancelled   = "cancelled"
+)
+
+// FetchRetries is the number of times a download is resumed in a row without
+// receiving any data before the fetch fails.
+const FetchRetries = 5
+
+// FetchRetryDelay is the time waited before the first attempt to resume a
+// download; the delay doubles with every attempt.
+const FetchRetryDelay = time.Second * 2
+
+// MaxChecksumFileSize is the maximum size of a checksum file downloaded.
+const MaxChecksumFileSize = 1 << 20
+
+// FetchRequest describes an image to be downloaded into the library.
+type FetchRequest struct {
+	URL string `json:"url" validate:"required,url"`
+	// Label is the name of the image, or the last element of the path of the
+	// URL if empty
+	Label string `json:"label"`
+	// SHA256 and SHA512 are the expected digests of the image in hex
+	SHA256 string `json:"sha256" validate:"omitempty,len=64,hexadecimal"`
+	SHA512 string `json:"sha512" validate:"omitempty,len=128,hexadecimal"`
+	// ChecksumURL is the URL of a checksum file listing the expected digest
+	// of the image, e.g. SHA256SUMS
+	ChecksumURL string `json:"checksumUrl" validate:"omitempty,url"`
+}
+
+// Fetch is the progress of an image being downloaded into the library.
+type Fetch struct {
+	ID    string `json:"id"`
+	URL   string `json:"url"`
+	Label string `json:"label"`
+	// Length is the size of the image, or -1 if unknown
+	Length   int64     `json:"length"`
+	Received int64     `json:"received"`
+	State    string    `json:"state"`
+	Error    string    `json:"error,omitempty"`
+	Image    string    `json:"image,omitempty"`
+	Started  time.Time `json:"started"`
+	Uploader string    `json:"uploader"`
+}
+
+// Fetcher downloads images into the library in the background.
+type Fetcher struct {
+	Catalogue *Catalogue
+	// Client is the HTTP client used for downloads, or a client without
+	// timeout for the transfer if nil
+	Client *http.Client
+
+	fetches map[string]*fetchJob
+	mutex   sync.Mutex
+}
+
+type fetchJob struct {
+	Fetch
+	cancel context.CancelFunc
+}
+
+var (
+	ErrFetchNotFound    = errors.New("fetch not found")
+	ErrUnsupportedURL   = errors.New("URL must be a HTTP or HTTPS URL")
+	ErrChecksumNotFound = errors.New("checksum of the image not found in the checksum file")
+	ErrChecksumMismatch = errors.New("checksum of the image downloaded does not match")
+)
+
+var (
+	defaultFetchClient = &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			TLSHandshakeTimeout:   time.Second * 10,
+			ResponseHeaderTimeout: time.Second * 30,
+		},
+	}
+	bsdChecksumPattern = regexp.MustCompile(`^(SHA256|SHA512) \((.+)\) = ([0-9a-fA-F]+)$`)
+)
+
+// Start starts downloading the image in the background.
+func (f *Fetcher) Start(request FetchRequest, uploader string) (Fetch, error) {
+	source, err := url.Parse(request.URL)
+	if err != nil || (source.Scheme != "http" && source.Scheme != "https") {
+		return Fetch{}, ErrUnsupportedURL
+	}
+
+	label := request.Label
+	if label == "" {
+		label = path.Base(source.Path)
+	}
+	if _, err = Extension(label); err != nil {
+		return Fetch{}, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	now := time.Now()
+	job := &fetchJob{
+		Fetch: Fetch{
+			ID:       strconv.FormatInt(now.UnixNano(), 10),
+			URL:      request.URL,
+			Label:    label,
+			Length:   -1,
+			State:    FetchDownloading,
+			Started:  now,
+			Uploader: uploader,
+		},
+		cancel: cancel,
+	}
+
+	f.mutex.Lock()
+	if f.fetches == nil {
+		f.fetches = map[string]*fetchJob{}
+	}
+	f.fetches[job.ID] = job
+	status := job.Fetch
+	f.mutex.Unlock()
+
+	go func() {
+		defer cancel()
+
+		image, err := f.run(ctx, job, request)
+
+		f.mutex.Lock()
+		defer f.mutex.Unlock()
+
+		switch {
+		case ctx.Err() != nil:
+			job.State = FetchCancelled
+		case err != nil:
+			job.State = FetchFailed
+			job.Error = err.Error()
+		default:
+			job.State = FetchComplete
+			job.Image = image.Name
+		}
+	}()
+
+	return status, nil
+}
+
+// All returns every fetch since the server started, most recent first.
+func (f *Fetcher) All() []Fetch {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	fetches := make([]Fetch, 0, len(f.fetches))
+	for _, job := range f.fetches {
+		fetches = append(fetches, job.Fetch)
+	}
+
+	sort.Slice(fetches, func(i, j int) bool {
+		return fetches[i].Started.After(fetches[j].Started)
+	})
+	return fetches
+}
+
+// Cancel stops the fetch with the given ID if it is in progress, or removes
+// it from the list otherwise.
+func (f *Fetcher) Cancel(id string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	job, found := f.fetches[id]
+	if !found {
+		return ErrFetchNotFound
+	}
+
+	switch job.State {
+	case FetchDownloading, FetchVerifying:
+		job.cancel()
+	default:
+		delete(f.fetches, id)
+	}
+
+	return nil
+}
+
+// run downloads the image, verifies it against the expected digest and adds
+// it to the library.
+func (f *Fetcher) run(ctx context.Context, job *fetchJob, request FetchRequest) (Image, error) {
+	expected, digest := request.SHA256, sha256.New
+	if request.SHA512 != "" {
+		expected, digest = request.SHA512, sha512.New
+	}
+
+	if expected == "" && request.ChecksumURL != "" {
+		var err error
+		expected, err = f.checksum(ctx, request.ChecksumURL, job.Label, path.Base(job.URL))
+		if err != nil {
+			return Image{}, err
+		}
+		if len(expected) == sha512.Size*2 {
+			digest = sha512.New
+		}
+	}
+
+	dir := filepath.Join(f.Catalogue.Dir, UploadDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return Image{}, err
+	}
+
+	file, err := ioutil.TempFile(dir, "fetch")
+	if err != nil {
+		return Image{}, err
+	}
+	defer os.Remove(file.Name())
+
+	name := sha256.New()
+	verify := digest()
+	err = f.download(ctx, job, file, name, verify)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return Image{}, err
+	}
+
+	f.mutex.Lock()
+	job.State = FetchVerifying
+	f.mutex.Unlock()
+
+	if expected != "" && !strings.EqualFold(hex.EncodeToString(verify.Sum(nil)), expected) {
+		return Image{}, ErrChecksumMismatch
+	}
+
+	if err = f.Catalogue.Reserve(job.Received); err != nil {
+		return Image{}, err
+	}
+
+	return f.Catalogue.Commit(file.Name(), Image{
+		Label:    job.Label,
+		SHA256:   hex.EncodeToString(name.Sum(nil)),
+		Uploaded: time.Now(),
+		Uploader: job.Uploader,
+	})
+}
+
+// download writes the content at the URL to the file, resuming the download
+// with a range request when the connection is dropped.
+func (f *Fetcher) download(ctx context.Context, job *fetchJob, file *os.File, digests ...hash.Hash) error {
+	writers := make([]io.Writer, 0, len(digests)+1)
+	writers = append(writers, file)
+	for _, digest := range digests {
+		writers = append(writers, digest)
+	}
+	writer := io.MultiWriter(writers...)
+
+	retries := 0
+	for {
+		received, err := f.transfer(ctx, job, file, writer, digests)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if _, permanent := err.(*permanentError); permanent {
+			return err
+		}
+
+		if received > 0 {
+			retries = 0
+		}
+		if retries >= FetchRetries {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(FetchRetryDelay << uint(retries)):
+		}
+		retries++
+	}
+}
+
+// transfer makes one request for the remaining content and copies it to the
+// writer, returning the number of bytes received.
+func (f *Fetcher) transfer(ctx context.Context, job *fetchJob, file *os.File, writer io.Writer, digests []hash.Hash) (int64, error) {
+	f.mutex.Lock()
+	offset := job.Received
+	f.mutex.Unlock()
+
+	request, err := http.NewRequest(http.MethodGet, job.URL, nil)
+	if err != nil {
+		return 0, &permanentError{err}
+	}
+	request = request.WithContext(ctx)
+	if offset > 0 {
+		request.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	response, err := f.client().Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	length := int64(-1)
+	switch {
+	case response.StatusCode == http.StatusPartialContent && offset > 0:
+		// The content is appended to the data received so far only if it
+		// resumes from its end. Otherwise the download restarts from the
+		// beginning on the next attempt.
+		start, valid := rangeStart(response.Header.Get("Content-Range"))
+		if !valid || start != offset {
+			if err = restart(file, digests); err != nil {
+				return 0, &permanentError{err}
+			}
+
+			f.mutex.Lock()
+			job.Received = 0
+			f.mutex.Unlock()
+
+			return 0, fmt.Errorf("server responded with range %q instead of offset %d",
+				response.Header.Get("Content-Range"), offset)
+		}
+
+		if response.ContentLength >= 0 {
+			length = offset + response.ContentLength
+		}
+	case response.StatusCode == http.StatusOK:
+		// The server does not support range requests, so the download
+		// restarts from the beginning.
+		if offset > 0 {
+			if err = restart(file, digests); err != nil {
+				return 0, &permanentError{err}
+			}
+			offset = 0
+		}
+		length = response.ContentLength
+	case response.StatusCode >= 500:
+		return 0, fmt.Errorf("server responded with %s", response.Status)
+	default:
+		return 0, &permanentError{fmt.Errorf("server responded with %s", response.Status)}
+	}
+
+	if length >= 0 {
+		if err = f.Catalogue.Reserve(length); err != nil {
+			return 0, &permanentError{err}
+		}
+	}
+
+	f.mutex.Lock()
+	job.Received = offset
+	job.Length = length
+	f.mutex.Unlock()
+
+	buffer := make([]byte, 32<<10)
+	var received int64
+	for {
+		n, readErr := response.Body.Read(buffer)
+		if n > 0 {
+			if _, err = writer.Write(buffer[:n]); err != nil {
+				return received, &permanentError{err}
+			}
+			received += int64(n)
+
+			f.mutex.Lock()
+			job.Received += int64(n)
+			f.mutex.Unlock()
+		}
+
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return received, readErr
+		}
+	}
+
+	if length >= 0 && offset+received < length {
+		return received, io.ErrUnexpectedEOF
+	}
+
+	return received, nil
+}
+
+// checksum downloads the checksum file and returns the digest listed for the
+// image. Both the GNU and BSD formats of sha256sum and sha512sum are
+// supported; a file listing a single digest without a name is assumed to be
+// the digest of the image.
+func (f *Fetcher) checksum(ctx context.Context, checksumURL string, names ...string) (string, error) {
+	request, err := http.NewRequest(http.MethodGet, checksumURL, nil)
+	if err != nil {
+		return "", err
+	}
+
+	response, err := f.client().Do(request.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unable to download checksum file: server responded with %s", response.Status)
+	}
+
+	var single string
+	lines := 0
+	scanner := bufio.NewScanner(io.LimitReader(response.Body, MaxChecksumFileSize))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines++
+
+		var digest, name string
+		if match := bsdChecksumPattern.FindStringSubmatch(line); match != nil {
+			name, digest = match[2], match[3]
+		} else {
+			fields := strings.Fields(line)
+			digest = fields[0]
+			if len(fields) > 1 {
+				name = strings.TrimPrefix(strings.Join(fields[1:], " "), "*")
+			}
+		}
+
+		if !validDigest(digest) {
+			continue
+		}
+		if name == "" {
+			single = digest
+			continue
+		}
+
+		for _, wanted := range names {
+			if path.Base(name) == wanted {
+				return digest, nil
+			}
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return "", err
+	}
+
+	if single != "" && lines == 1 {
+		return single, nil
+	}
+
+	return "", ErrChecksumNotFound
+}
+
+func (f *Fetcher) client() *http.Client {
+	if f.Client != nil {
+		return f.Client
+	}
+
+	return defaultFetchClient
+}
+
+// permanentError is an error after which the download is not resumed.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+// rangeStart returns the offset of the first byte of the content of a partial
+// response given its Content-Range header, e.g. "bytes 1024-2047/4096".
+func rangeStart(header string) (int64, bool) {
+	if !strings.HasPrefix(header, "bytes ") {
+		return 0, false
+	}
+
+	dash := strings.Index(header, "-")
+	if dash < 0 {
+		return 0, false
+	}
+
+	start, err := strconv.ParseInt(strings.TrimSpace(header[len("bytes "):dash]), 10, 64)
+	if err != nil || start < 0 {
+		return 0, false
+	}
+
+	return start, true
+}
+
+// restart truncates the file and resets the digests.
+func restart(file *os.File, digests []hash.Hash) error {
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	for _, digest := range digests {
+		digest.Reset()
+	}
+
+	return nil
+}
+
+func validDigest(digest string) bool {
+	if len(digest) != sha256.Size*2 && len(digest) != sha512.Size*2 {
+		return false
+	}
+
+	_, err := hex.DecodeString(digest)
+	return err == nil
+}
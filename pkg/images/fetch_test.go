@@ -0,0 +1,143 @@
+/*
+ * Adsisto
+ * Copyright (c) 2019 Andrew Ying
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of version 3 of the GNU General Public License as published by the
+ * Free Software Foundation. In addition, this program is also subject to certain
+ * additional terms available at <SUPPLEMENT.md>.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+ * A PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package images
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestChecksum(t *testing.T) {
+	digest256 := strings.Repeat("ab", 32)
+	digest512 := strings.Repeat("cd", 64)
+	other := strings.Repeat("01", 32)
+
+	tests := []struct {
+		name     string
+		content  string
+		expected string
+		err      error
+	}{
+		{
+			"GNU text mode",
+			other + "  other.iso\n" + digest256 + "  ubuntu.iso\n",
+			digest256, nil,
+		},
+		{
+			"GNU binary mode",
+			other + " *other.iso\n" + digest256 + " *ubuntu.iso\n",
+			digest256, nil,
+		},
+		{
+			"GNU with directory",
+			digest512 + "  ./images/ubuntu.iso\n",
+			digest512, nil,
+		},
+		{
+			"BSD",
+			"# Checksums\nSHA256 (other.iso) = " + other + "\nSHA256 (ubuntu.iso) = " + digest256 + "\n",
+			digest256, nil,
+		},
+		{
+			"BSD SHA-512",
+			"SHA512 (ubuntu.iso) = " + digest512 + "\n",
+			digest512, nil,
+		},
+		{
+			"name of the URL",
+			digest256 + "  download.iso\n",
+			digest256, nil,
+		},
+		{
+			"single digest without name",
+			"\n" + digest256 + "\n",
+			digest256, nil,
+		},
+		{
+			"single digest among others",
+			digest256 + "\n" + other + "  other.iso\n",
+			"", ErrChecksumNotFound,
+		},
+		{
+			"invalid digest",
+			"abcd  ubuntu.iso\n",
+			"", ErrChecksumNotFound,
+		},
+		{
+			"image not listed",
+			other + "  other.iso\n",
+			"", ErrChecksumNotFound,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte(test.content))
+			}))
+			defer server.Close()
+
+			f := &Fetcher{Client: server.Client()}
+			digest, err := f.checksum(context.Background(), server.URL+"/SHA256SUMS", "ubuntu.iso", "download.iso")
+			if err != test.err {
+				t.Fatalf("checksum() = %v, expected %v", err, test.err)
+			}
+			if digest != test.expected {
+				t.Errorf("checksum() = %q, expected %q", digest, test.expected)
+			}
+		})
+	}
+}
+
+func TestChecksumNotFound(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	f := &Fetcher{Client: server.Client()}
+	if _, err := f.checksum(context.Background(), server.URL+"/SHA256SUMS", "ubuntu.iso"); err == nil {
+		t.Error("checksum() succeeded for a missing checksum file")
+	}
+}
+
+func TestRangeStart(t *testing.T) {
+	tests := []struct {
+		header   string
+		expected int64
+		valid    bool
+	}{
+		{"bytes 1024-2047/4096", 1024, true},
+		{"bytes 0-2047/*", 0, true},
+		{"", 0, false},
+		{"bytes */4096", 0, false},
+		{"items 1024-2047/4096", 0, false},
+		{"bytes -1024-2047/4096", 0, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.header, func(t *testing.T) {
+			start, valid := rangeStart(test.header)
+			if start != test.expected || valid != test.valid {
+				t.Errorf("rangeStart(%q) = %d, %v, expected %d, %v",
+					test.header, start, valid, test.expected, test.valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+/*
+ * Adsisto
+ * Copyright (c) 2019 Andrew Ying
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of version 3 of the GNU General Public License as published by the
+ * Free Software Foundation. In addition, this program is also subject to certain
+ * additional terms available at <SUPPLEMENT.md>.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+ * A PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package images
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Types of media, which determine the mode of the logical unit an image is
+// mounted on.
+const (
+	// TypeCDROM is an optical disc image, e.g. an ISO9660 file system
+	TypeCDROM = "cdrom"
+	// TypeDisk is a raw disk image, e.g. a USB stick image
+	TypeDisk = "disk"
+)
+
+var (
+	// imageTypes maps the extensions of the images supported to their type
+	imageTypes = map[string]string{
+		".iso": TypeCDROM,
+		".img": TypeDisk,
+		".raw": TypeDisk,
+	}
+	// compressions are the extensions of the compressed images supported,
+	// which are decompressed when added to the library
+	compressions = []string{".gz", ".xz", ".zst"}
+	// decompressors are the commands decompressing the compressions not
+	// decompressed natively
+	decompressors = map[string]string{
+		".xz":  "xz",
+		".zst": "zstd",
+	}
+)
+
+// Extension returns the extension of the image file with the given name,
+// ignoring the extension of its compression, or ErrUnsupportedFormat if the
+// image is not in a supported format. ErrDecompressorMissing is returned if
+// the image is compressed but the command decompressing it is not installed,
+// so that the image is refused before it is received.
+func Extension(filename string) (string, error) {
+	name := strings.ToLower(filename)
+	compression := Compression(name)
+	name = strings.TrimSuffix(name, compression)
+
+	extension := filepath.Ext(name)
+	if _, found := imageTypes[extension]; !found {
+		return "", ErrUnsupportedFormat
+	}
+
+	if command, found := decompressors[compression]; found {
+		if _, err := exec.LookPath(command); err != nil {
+			return "", ErrDecompressorMissing
+		}
+	}
+
+	return extension, nil
+}
+
+// Compression returns the extension of the compression of the file with the
+// given name, or an empty string if the file is not compressed.
+func Compression(filename string) string {
+	extension := strings.ToLower(filepath.Ext(filename))
+	for _, compression := range compressions {
+		if extension == compression {
+			return compression
+		}
+	}
+
+	return ""
+}
+
+// TypeOf returns the type of the image with the given name, or TypeDisk if
+// the type cannot be told from its extension.
+func TypeOf(filename string) string {
+	if imageType, found := imageTypes[strings.ToLower(filepath.Ext(filename))]; found {
+		return imageType
+	}
+
+	return TypeDisk
+}
+
+// decompress decompresses the file at path into a temporary file in the same
+// directory, and returns the path to the file and the SHA-256 digest of its
+// content. Gzip is decompressed natively; xz and zstd require the xz and
+// zstd commands respectively.
+func decompress(path string, compression string) (string, string, error) {
+	file, err := ioutil.TempFile(filepath.Dir(path), "decompress")
+	if err != nil {
+		return "", "", err
+	}
+
+	digest := sha256.New()
+	writer := io.MultiWriter(file, digest)
+
+	switch compression {
+	case ".gz":
+		err = gunzip(path, writer)
+	case ".xz":
+		err = run(writer, "xz", "--decompress", "--stdout", path)
+	case ".zst":
+		err = run(writer, "zstd", "--decompress", "--stdout", "--quiet", path)
+	default:
+		err = ErrUnsupportedFormat
+	}
+	if err != nil && err != ErrUnsupportedFormat {
+		err = fmt.Errorf("unable to decompress image: %s", err)
+	}
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+		return "", "", err
+	}
+
+	return file.Name(), hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+func gunzip(path string, writer io.Writer) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	_, err = io.Copy(writer, reader)
+	return err
+}
+
+// run runs the command, writing its output to the writer.
+func run(writer io.Writer, name string, args ...string) error {
+	if _, err := exec.LookPath(name); err != nil {
+		return fmt.Errorf("%s is not installed", name)
+	}
+
+	stderr := &bytes.Buffer{}
+	command := exec.Command(name, args...)
+	command.Stdout = writer
+	command.Stderr = stderr
+	// mtools otherwise refuses images whose size is not a multiple of the
+	// size of a track.
+	command.Env = append(os.Environ(), "MTOOLS_SKIP_CHECK=1")
+
+	if err := command.Run(); err != nil {
+		return fmt.Errorf("%s: %s: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
@@ -0,0 +1,430 @@
+/*
+ * Adsisto
+ * Copyright (c) 2019 Andrew Ying
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of version 3 of the GNU General Public License as published by the
+ * Free Software Foundation. In addition, this program is also subject to certain
+ * additional terms available at <SUPPLEMENT.md>.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+ * A PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package images
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/adsisto/adsisto/pkg/auth"
+	"github.com/adsisto/adsisto/pkg/response"
+	"gopkg.in/go-playground/validator.v9"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// TusVersion is the version of the tus resumable upload protocol implemented
+// by the upload handlers, see https://tus.io/protocols/resumable-upload.html.
+const TusVersion = "1.0.0"
+
+// UploadContentType is the content type of the data sent to resume an upload.
+const UploadContentType = "application/offset+octet-stream"
+
+type imageRequest struct {
+	Name string `json:"name" validate:"required"`
+}
+
+type fetchCancelRequest struct {
+	ID string `json:"id" validate:"required"`
+}
+
+type renameRequest struct {
+	Name  string `json:"name" validate:"required"`
+	Label string `json:"label" validate:"required,max=255"`
+}
+
+var (
+	validate = validator.New()
+)
+
+// IndexHandler lists the images in the library with the storage used.
+func (c *Catalogue) IndexHandler(w http.ResponseWriter, r *http.Request) {
+	images, err := c.All()
+	if err != nil {
+		internalError(w, "unable to retrieve images", err)
+		return
+	}
+
+	var usage int64
+	for _, image := range images {
+		usage += image.Size
+	}
+
+	response.JSON(w, http.StatusOK, map[string]interface{}{
+		"code":   http.StatusOK,
+		"images": images,
+		"usage":  usage,
+		"quota":  c.Quota,
+	})
+}
+
+// ShowHandler returns the image whose name is given in the query string.
+func (c *Catalogue) ShowHandler(w http.ResponseWriter, r *http.Request) {
+	image, err := c.Get(r.URL.Query().Get("name"))
+	if err == ErrImageNotFound {
+		imageNotFound(w)
+		return
+	}
+	if err != nil {
+		internalError(w, "unable to retrieve image", err)
+		return
+	}
+
+	response.JSON(w, http.StatusOK, map[string]interface{}{
+		"code":  http.StatusOK,
+		"image": image,
+	})
+}
+
+// RenameHandler changes the label of the image in the request.
+func (c *Catalogue) RenameHandler(w http.ResponseWriter, r *http.Request) {
+	request := &renameRequest{}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(request); err != nil {
+		invalidUserInput(w)
+		return
+	}
+
+	if err := validate.Struct(request); err != nil {
+		invalidUserInput(w)
+		return
+	}
+
+	if err := c.Rename(request.Name, request.Label); err != nil {
+		if err == ErrImageNotFound {
+			imageNotFound(w)
+			return
+		}
+
+		internalError(w, "unable to rename image", err)
+		return
+	}
+
+	response.JSON(w, http.StatusOK, map[string]interface{}{
+		"code": http.StatusOK,
+	})
+}
+
+// DeleteHandler removes the image in the request from the library.
+func (c *Catalogue) DeleteHandler(w http.ResponseWriter, r *http.Request) {
+	request := &imageRequest{}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(request); err != nil {
+		invalidUserInput(w)
+		return
+	}
+
+	if err := validate.Struct(request); err != nil {
+		invalidUserInput(w)
+		return
+	}
+
+	if err := c.Delete(request.Name); err != nil {
+		switch err {
+		case ErrImageNotFound:
+			imageNotFound(w)
+		case ErrImageInUse:
+			response.JSON(w, http.StatusConflict, map[string]interface{}{
+				"code":    http.StatusConflict,
+				"message": err.Error(),
+			})
+		default:
+			internalError(w, "unable to delete image", err)
+		}
+		return
+	}
+
+	log.Printf("[INFO] Deleted image %s\n", request.Name)
+	response.JSON(w, http.StatusOK, map[string]interface{}{
+		"code": http.StatusOK,
+	})
+}
+
+// FetchIndexHandler reports the progress of the images being downloaded.
+func (f *Fetcher) FetchIndexHandler(w http.ResponseWriter, r *http.Request) {
+	response.JSON(w, http.StatusOK, map[string]interface{}{
+		"code":    http.StatusOK,
+		"fetches": f.All(),
+	})
+}
+
+// FetchHandler starts downloading the image at the URL in the request. The
+// image is downloaded in the background; its progress is reported by
+// FetchIndexHandler.
+func (f *Fetcher) FetchHandler(w http.ResponseWriter, r *http.Request) {
+	request := &FetchRequest{}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(request); err != nil {
+		invalidUserInput(w)
+		return
+	}
+
+	if err := validate.Struct(request); err != nil {
+		invalidUserInput(w)
+		return
+	}
+
+	fetch, err := f.Start(*request, Uploader(r))
+	if err != nil {
+		UploadError(w, err)
+		return
+	}
+
+	log.Printf("[INFO] Fetching image from %s\n", fetch.URL)
+	response.JSON(w, http.StatusAccepted, map[string]interface{}{
+		"code":  http.StatusAccepted,
+		"fetch": fetch,
+	})
+}
+
+// FetchCancelHandler cancels the download in the request, or removes it from
+// the list if it has finished.
+func (f *Fetcher) FetchCancelHandler(w http.ResponseWriter, r *http.Request) {
+	request := &fetchCancelRequest{}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(request); err != nil {
+		invalidUserInput(w)
+		return
+	}
+
+	if err := validate.Struct(request); err != nil {
+		invalidUserInput(w)
+		return
+	}
+
+	if err := f.Cancel(request.ID); err != nil {
+		response.JSON(w, http.StatusNotFound, map[string]interface{}{
+			"code":    http.StatusNotFound,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Uploader returns the name of the user uploading an image, i.e. the identity
+// authenticated or the address of the client.
+func Uploader(r *http.Request) string {
+	if identity := auth.Identity(r.Context()); identity != "" {
+		return identity
+	}
+
+	return r.RemoteAddr
+}
+
+// UploadOptionsHandler reports the features of the upload protocol supported.
+func (u *Uploads) UploadOptionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", TusVersion)
+	w.Header().Set("Tus-Version", TusVersion)
+	w.Header().Set("Tus-Extension", "creation,termination")
+	if u.Catalogue.Quota > 0 {
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(u.Catalogue.Quota, 10))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UploadCreateHandler starts an upload of the length given in the
+// Upload-Length header. The name of the file must be given in the filename
+// key of the Upload-Metadata header.
+func (u *Uploads) UploadCreateHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", TusVersion)
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		invalidUserInput(w)
+		return
+	}
+
+	filename := uploadMetadata(r.Header.Get("Upload-Metadata"))["filename"]
+	if filename == "" {
+		invalidUserInput(w)
+		return
+	}
+
+	upload, err := u.Create(filename, length, Uploader(r))
+	if err != nil {
+		UploadError(w, err)
+		return
+	}
+
+	log.Printf("[INFO] Started upload %s of file %s\n", upload.ID, upload.Label)
+	w.Header().Set("Location", fmt.Sprintf("%s?id=%s", r.URL.Path, upload.ID))
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	response.JSON(w, http.StatusCreated, map[string]interface{}{
+		"code":   http.StatusCreated,
+		"upload": upload,
+	})
+}
+
+// UploadOffsetHandler reports the number of bytes received for the upload
+// whose ID is given in the query string.
+func (u *Uploads) UploadOffsetHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", TusVersion)
+	w.Header().Set("Cache-Control", "no-store")
+
+	upload, err := u.Get(r.URL.Query().Get("id"))
+	if err != nil {
+		UploadError(w, err)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+// UploadShowHandler returns the upload whose ID is given in the query string,
+// including the name of the image once the upload is complete.
+func (u *Uploads) UploadShowHandler(w http.ResponseWriter, r *http.Request) {
+	upload, err := u.Get(r.URL.Query().Get("id"))
+	if err != nil {
+		UploadError(w, err)
+		return
+	}
+
+	response.JSON(w, http.StatusOK, map[string]interface{}{
+		"code":   http.StatusOK,
+		"upload": upload,
+	})
+}
+
+// UploadPatchHandler appends the request body to the upload whose ID is given
+// in the query string, at the offset given in the Upload-Offset header.
+func (u *Uploads) UploadPatchHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", TusVersion)
+
+	if r.Header.Get("Content-Type") != UploadContentType {
+		response.JSON(w, http.StatusUnsupportedMediaType, map[string]interface{}{
+			"code":    http.StatusUnsupportedMediaType,
+			"message": "content type must be " + UploadContentType,
+		})
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		invalidUserInput(w)
+		return
+	}
+
+	upload, err := u.Write(r.URL.Query().Get("id"), offset, r.Body)
+	if err != nil {
+		if upload.ID != "" {
+			w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		}
+		UploadError(w, err)
+		return
+	}
+
+	if upload.Image != "" {
+		log.Printf("[INFO] Completed upload %s as image %s\n", upload.ID, upload.Image)
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UploadDeleteHandler discards the upload whose ID is given in the query
+// string.
+func (u *Uploads) UploadDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", TusVersion)
+
+	if err := u.Delete(r.URL.Query().Get("id")); err != nil {
+		UploadError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// uploadMetadata decodes the Upload-Metadata header, a comma separated list
+// of keys and base64 encoded values.
+func uploadMetadata(header string) map[string]string {
+	metadata := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(pair)
+		if len(fields) == 0 {
+			continue
+		}
+
+		value := ""
+		if len(fields) > 1 {
+			decoded, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				continue
+			}
+			value = string(decoded)
+		}
+		metadata[fields[0]] = value
+	}
+
+	return metadata
+}
+
+// UploadError responds with the status matching an error adding an image to
+// the library, whether uploaded, fetched or built.
+func UploadError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch err {
+	case ErrUploadNotFound, ErrImageNotFound:
+		status = http.StatusNotFound
+	case ErrOffsetMismatch, ErrUploadComplete, ErrImageInUse, ErrNotFAT:
+		status = http.StatusConflict
+	case ErrUploadBusy:
+		status = http.StatusLocked
+	case ErrUnsupportedFormat, ErrDecompressorMissing:
+		status = http.StatusUnsupportedMediaType
+	case ErrUnsupportedURL, ErrEmptySeed, ErrSeedConflict, ErrUnknownSeedFormat:
+		status = http.StatusUnprocessableEntity
+	case ErrQuotaExceeded, ErrFATTooSmall:
+		status = http.StatusRequestEntityTooLarge
+	default:
+		internalError(w, "unable to save uploaded image", err)
+		return
+	}
+
+	response.JSON(w, status, map[string]interface{}{
+		"code":    status,
+		"message": err.Error(),
+	})
+}
+
+func imageNotFound(w http.ResponseWriter) {
+	response.JSON(w, http.StatusNotFound, map[string]interface{}{
+		"code":    http.StatusNotFound,
+		"message": ErrImageNotFound.Error(),
+	})
+}
+
+func invalidUserInput(w http.ResponseWriter) {
+	response.JSON(w, http.StatusBadRequest, map[string]interface{}{
+		"code":    http.StatusBadRequest,
+		"message": "invalid user inputs",
+	})
+}
+
+func internalError(w http.ResponseWriter, message string, err error) {
+	log.Printf("[ERROR] Unable to access image library: %s\n", err)
+	response.JSON(w, http.StatusInternalServerError, map[string]interface{}{
+		"code":    http.StatusInternalServerError,
+		"message": message,
+	})
+}
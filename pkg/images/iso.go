@@ -0,0 +1,199 @@
+/*
+ * Adsisto
+ * Copyright (c) 2019 Andrew Ying
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of version 3 of the GNU General Public License as published by the
+ * Free Software Foundation. In addition, this program is also subject to certain
+ * additional terms available at <SUPPLEMENT.md>.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+ * A PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package images
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Layout of ISO 9660 file systems and of El Torito boot catalogues.
+const (
+	isoSectorSize = 2048
+	// isoDescriptorsStart is the sector of the first volume descriptor
+	isoDescriptorsStart = 16
+	// isoMaxDescriptors bounds the number of volume descriptors read
+	isoMaxDescriptors = 64
+
+	descriptorBoot       = 0
+	descriptorPrimary    = 1
+	descriptorTerminator = 255
+
+	elToritoID = "EL TORITO SPECIFICATION"
+
+	catalogueEntrySize = 32
+	headerValidation   = 0x01
+	headerSection      = 0x90
+	headerFinalSection = 0x91
+	entryBootable      = 0x88
+	entryExtension     = 0x44
+
+	platformBIOS = 0x00
+	platformUEFI = 0xef
+)
+
+// Volume is the metadata of the ISO 9660 file system of a CD-ROM image.
+type Volume struct {
+	// Label is the volume identifier
+	Label     string `json:"label"`
+	Publisher string `json:"publisher"`
+	// Created is the creation date of the volume, or nil if not recorded
+	Created *time.Time `json:"created"`
+	// BIOS and UEFI report whether the image has an El Torito boot entry
+	// for BIOS and UEFI firmware respectively
+	BIOS bool `json:"bios"`
+	UEFI bool `json:"uefi"`
+}
+
+var (
+	ErrNotISO = errors.New("image is not an ISO 9660 file system")
+)
+
+// ReadVolume reads the primary volume descriptor and the El Torito boot
+// catalogue of the ISO 9660 image at path.
+func ReadVolume(path string) (*Volume, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var volume *Volume
+	var catalogue uint32
+
+	sector := make([]byte, isoSectorSize)
+	for i := 0; i < isoMaxDescriptors; i++ {
+		if _, err = file.ReadAt(sector, int64(isoDescriptorsStart+i)*isoSectorSize); err != nil {
+			return nil, ErrNotISO
+		}
+		if string(sector[1:6]) != "CD001" {
+			return nil, ErrNotISO
+		}
+
+		switch sector[0] {
+		case descriptorBoot:
+			if isoString(sector[7:39]) == elToritoID {
+				catalogue = binary.LittleEndian.Uint32(sector[71:75])
+			}
+		case descriptorPrimary:
+			if volume == nil {
+				volume = &Volume{
+					Label:     isoString(sector[40:72]),
+					Publisher: isoString(sector[318:446]),
+					Created:   isoTime(sector[813:830]),
+				}
+			}
+		}
+
+		if sector[0] == descriptorTerminator {
+			break
+		}
+	}
+
+	if volume == nil {
+		return nil, ErrNotISO
+	}
+
+	if catalogue != 0 {
+		if _, err = file.ReadAt(sector, int64(catalogue)*isoSectorSize); err == nil {
+			volume.BIOS, volume.UEFI = bootPlatforms(sector)
+		}
+	}
+
+	return volume, nil
+}
+
+// bootPlatforms reports whether the El Torito boot catalogue has bootable
+// entries for BIOS and UEFI firmware. Only the first sector of the catalogue
+// is read, which holds 64 entries.
+func bootPlatforms(catalogue []byte) (bios bool, uefi bool) {
+	validation := catalogue[:catalogueEntrySize]
+	if validation[0] != headerValidation || validation[30] != 0x55 || validation[31] != 0xaa {
+		return false, false
+	}
+
+	mark := func(platform byte, entry []byte) {
+		if entry[0] != entryBootable {
+			return
+		}
+
+		switch platform {
+		case platformBIOS:
+			bios = true
+		case platformUEFI:
+			uefi = true
+		}
+	}
+
+	// The initial entry follows the validation entry and boots on the
+	// platform of the latter.
+	mark(validation[1], catalogue[catalogueEntrySize:2*catalogueEntrySize])
+
+	platform := validation[1]
+	for offset := 2 * catalogueEntrySize; offset+catalogueEntrySize <= len(catalogue); offset += catalogueEntrySize {
+		entry := catalogue[offset : offset+catalogueEntrySize]
+		switch entry[0] {
+		case headerSection, headerFinalSection:
+			platform = entry[1]
+		case entryExtension:
+		case entryBootable, 0x00:
+			mark(platform, entry)
+		default:
+			return bios, uefi
+		}
+	}
+
+	return bios, uefi
+}
+
+// isoString returns the content of a space-padded string field.
+func isoString(field []byte) string {
+	return strings.TrimSpace(string(bytes.TrimRight(field, "\x00")))
+}
+
+// isoTime parses a date and time field of a volume descriptor, i.e. digits in
+// the format YYYYMMDDHHMMSSCC followed by the offset from UTC in intervals of
+// 15 minutes. Returns nil if the date is not set.
+func isoTime(field []byte) *time.Time {
+	digits := string(field[:16])
+	if strings.Trim(digits, "0 \x00") == "" {
+		return nil
+	}
+
+	// Year, month, day, hour, minute, second and hundredths of a second
+	bounds := []int{0, 4, 6, 8, 10, 12, 14, 16}
+	values := make([]int, len(bounds)-1)
+	for i := range values {
+		value, err := strconv.Atoi(digits[bounds[i]:bounds[i+1]])
+		if err != nil {
+			return nil
+		}
+		values[i] = value
+	}
+
+	location := time.FixedZone("", int(int8(field[16]))*15*60)
+	created := time.Date(values[0], time.Month(values[1]), values[2],
+		values[3], values[4], values[5], values[6]*int(10*time.Millisecond), location)
+
+	return &created
+}
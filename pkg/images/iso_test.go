@@ -0,0 +1,271 @@
+/*
+ * Adsisto
+ * Copyright (c) 2019 Andrew Ying
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of version 3 of the GNU General Public License as published by the
+ * Free Software Foundation. In addition, this program is also subject to certain
+ * additional terms available at <SUPPLEMENT.md>.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+ * A PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package images
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// catalogueEntry returns a boot catalogue entry of the given type, i.e. its
+// first byte, and second byte, e.g. the platform of a section header.
+func catalogueEntry(kind byte, second byte) []byte {
+	entry := make([]byte, catalogueEntrySize)
+	entry[0], entry[1] = kind, second
+	return entry
+}
+
+// bootCatalogue returns the first sector of an El Torito boot catalogue whose
+// validation entry is for the given platform, followed by the entries.
+func bootCatalogue(platform byte, entries ...[]byte) []byte {
+	sector := make([]byte, isoSectorSize)
+	validation := catalogueEntry(headerValidation, platform)
+	validation[30], validation[31] = 0x55, 0xaa
+	copy(sector, validation)
+
+	for i, entry := range entries {
+		copy(sector[(i+1)*catalogueEntrySize:], entry)
+	}
+
+	return sector
+}
+
+// isoImage writes an ISO 9660 image with the given label and publisher, and
+// with the boot catalogue if not nil, and returns its path.
+func isoImage(t *testing.T, label string, publisher string, created string, catalogue []byte) string {
+	const catalogueSector = 20
+	image := make([]byte, (catalogueSector+1)*isoSectorSize)
+	descriptor := func(sector int, kind byte) []byte {
+		content := image[sector*isoSectorSize : (sector+1)*isoSectorSize]
+		content[0] = kind
+		copy(content[1:6], "CD001")
+		return content
+	}
+
+	primary := descriptor(isoDescriptorsStart, descriptorPrimary)
+	copy(primary[40:72], label+"                                ")
+	copy(primary[318:446], publisher)
+	copy(primary[813:829], created)
+	primary[829] = 4
+
+	next := isoDescriptorsStart + 1
+	if catalogue != nil {
+		boot := descriptor(next, descriptorBoot)
+		copy(boot[7:39], elToritoID)
+		binary.LittleEndian.PutUint32(boot[71:75], catalogueSector)
+		copy(image[catalogueSector*isoSectorSize:], catalogue)
+		next++
+	}
+	descriptor(next, descriptorTerminator)
+
+	return tempImage(t, image)
+}
+
+// tempImage writes the content to a temporary file, which the caller removes,
+// and returns its path.
+func tempImage(t *testing.T, content []byte) string {
+	file, err := ioutil.TempFile("", "image*.iso")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(content); err != nil {
+		os.Remove(file.Name())
+		t.Fatal(err)
+	}
+
+	return file.Name()
+}
+
+func TestReadVolume(t *testing.T) {
+	created := time.Date(2022, time.August, 9, 12, 34, 56, 780000000, time.FixedZone("", 3600))
+	catalogue := bootCatalogue(platformBIOS,
+		catalogueEntry(entryBootable, 0),
+		catalogueEntry(headerFinalSection, platformUEFI),
+		catalogueEntry(entryBootable, 0),
+	)
+
+	tests := []struct {
+		name      string
+		catalogue []byte
+		bios      bool
+		uefi      bool
+	}{
+		{"BIOS and UEFI", catalogue, true, true},
+		{"no boot catalogue", nil, false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := isoImage(t, "UBUNTU 22.04", "CANONICAL", "2022080912345678", test.catalogue)
+			defer os.Remove(path)
+
+			volume, err := ReadVolume(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if volume.Label != "UBUNTU 22.04" {
+				t.Errorf("Label = %q, expected %q", volume.Label, "UBUNTU 22.04")
+			}
+			if volume.Publisher != "CANONICAL" {
+				t.Errorf("Publisher = %q, expected %q", volume.Publisher, "CANONICAL")
+			}
+			if volume.Created == nil || !volume.Created.Equal(created) {
+				t.Errorf("Created = %v, expected %v", volume.Created, created)
+			}
+			if volume.BIOS != test.bios || volume.UEFI != test.uefi {
+				t.Errorf("BIOS, UEFI = %v, %v, expected %v, %v",
+					volume.BIOS, volume.UEFI, test.bios, test.uefi)
+			}
+		})
+	}
+}
+
+func TestReadVolumeNotISO(t *testing.T) {
+	tests := []struct {
+		name    string
+		content []byte
+	}{
+		{"empty", nil},
+		{"too short", make([]byte, isoSectorSize*isoDescriptorsStart)},
+		{"no descriptor", make([]byte, isoSectorSize*(isoDescriptorsStart+2))},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := tempImage(t, test.content)
+			defer os.Remove(path)
+
+			if _, err := ReadVolume(path); err != ErrNotISO {
+				t.Errorf("ReadVolume() = %v, expected %v", err, ErrNotISO)
+			}
+		})
+	}
+}
+
+func TestBootPlatforms(t *testing.T) {
+	invalid := bootCatalogue(platformBIOS, catalogueEntry(entryBootable, 0))
+	invalid[31] = 0
+
+	tests := []struct {
+		name      string
+		catalogue []byte
+		bios      bool
+		uefi      bool
+	}{
+		{
+			"BIOS initial entry",
+			bootCatalogue(platformBIOS, catalogueEntry(entryBootable, 0)),
+			true, false,
+		},
+		{
+			"UEFI initial entry",
+			bootCatalogue(platformUEFI, catalogueEntry(entryBootable, 0)),
+			false, true,
+		},
+		{
+			"not bootable initial entry",
+			bootCatalogue(platformBIOS, catalogueEntry(0x00, 0)),
+			false, false,
+		},
+		{
+			"UEFI section",
+			bootCatalogue(platformBIOS,
+				catalogueEntry(entryBootable, 0),
+				catalogueEntry(headerFinalSection, platformUEFI),
+				catalogueEntry(entryBootable, 0),
+			),
+			true, true,
+		},
+		{
+			"UEFI section after an extension",
+			bootCatalogue(platformBIOS,
+				catalogueEntry(0x00, 0),
+				catalogueEntry(headerSection, platformUEFI),
+				catalogueEntry(entryExtension, 0),
+				catalogueEntry(entryBootable, 0),
+			),
+			false, true,
+		},
+		{
+			"entries after the end of the catalogue",
+			bootCatalogue(platformBIOS,
+				catalogueEntry(0x00, 0),
+				catalogueEntry(0xff, 0),
+				catalogueEntry(headerFinalSection, platformUEFI),
+				catalogueEntry(entryBootable, 0),
+			),
+			false, false,
+		},
+		{"invalid validation entry", invalid, false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bios, uefi := bootPlatforms(test.catalogue)
+			if bios != test.bios || uefi != test.uefi {
+				t.Errorf("bootPlatforms() = %v, %v, expected %v, %v",
+					bios, uefi, test.bios, test.uefi)
+			}
+		})
+	}
+}
+
+func TestISOTime(t *testing.T) {
+	tests := []struct {
+		name     string
+		digits   string
+		offset   int8
+		expected *time.Time
+	}{
+		{
+			"UTC",
+			"2019010203040506", 0,
+			timePointer(time.Date(2019, time.January, 2, 3, 4, 5, 60000000, time.UTC)),
+		},
+		{
+			"negative offset",
+			"2019123123595900", -20,
+			timePointer(time.Date(2019, time.December, 31, 23, 59, 59, 0, time.FixedZone("", -5*3600))),
+		},
+		{"zeros", "0000000000000000", 0, nil},
+		{"spaces", "                ", 0, nil},
+		{"not digits", "2019-01-02 03:04", 0, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			field := append([]byte(test.digits), byte(test.offset))
+
+			created := isoTime(field)
+			if (created == nil) != (test.expected == nil) ||
+				(created != nil && !created.Equal(*test.expected)) {
+				t.Errorf("isoTime(%q) = %v, expected %v", test.digits, created, test.expected)
+			}
+		})
+	}
+}
+
+func timePointer(t time.Time) *time.Time {
+	return &t
+}
@@ -0,0 +1,215 @@
+/*
+ * Adsisto
+ * Copyright (c) 2019 Andrew Ying
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of version 3 of the GNU General Public License as published by the
+ * Free Software Foundation. In addition, this program is also subject to certain
+ * additional terms available at <SUPPLEMENT.md>.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+ * A PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package images
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Formats of seed images.
+const (
+	SeedISO = "iso"
+	SeedFAT = "fat"
+)
+
+// Volume labels looked up by cloud-init and by the Anaconda installer.
+const (
+	NoCloudVolumeLabel   = "cidata"
+	KickstartVolumeLabel = "OEMDRV"
+)
+
+// SeedFATSize is the size of FAT seed images.
+const SeedFATSize = MinFATSize
+
+// Seed is the configuration of an unattended installation, written to a seed
+// image read by the host when it boots. Cloud-init reads the user-data,
+// meta-data and network-config files of a NoCloud seed, which is also how the
+// Ubuntu installer reads an autoinstall configuration. Anaconda reads the
+// ks.cfg file of a seed labelled OEMDRV.
+type Seed struct {
+	UserData      string `json:"userData"`
+	MetaData      string `json:"metaData"`
+	NetworkConfig string `json:"networkConfig"`
+	// Autoinstall is an Ubuntu autoinstall configuration, written to the
+	// user-data file under the autoinstall key unless it already has one
+	Autoinstall string `json:"autoinstall"`
+	// Kickstart is a Kickstart file, which cannot be combined with the
+	// cloud-init files
+	Kickstart string `json:"kickstart"`
+}
+
+var (
+	ErrEmptySeed         = errors.New("seed must have user-data, an autoinstall configuration or a Kickstart file")
+	ErrSeedConflict      = errors.New("seed must have only one of user-data, an autoinstall configuration or a Kickstart file")
+	ErrUnknownSeedFormat = errors.New("seed format must be iso or fat")
+)
+
+// BuildSeed builds a seed image in the given format and adds it to the
+// library. ISO images are built with genisoimage or xorriso, and FAT images
+// with mkfs.fat and mtools, which must be installed.
+func (u *Uploads) BuildSeed(seed Seed, format string, label string, uploader string) (Image, error) {
+	if format != "" && format != SeedISO && format != SeedFAT {
+		return Image{}, ErrUnknownSeedFormat
+	}
+
+	files, volume, err := seed.files()
+	if err != nil {
+		return Image{}, err
+	}
+
+	if label == "" {
+		label = volume
+	}
+	label = strings.TrimSuffix(label, filepath.Ext(label))
+
+	dir, err := u.Stage()
+	if err != nil {
+		return Image{}, err
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range files {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			return Image{}, err
+		}
+	}
+
+	if format == SeedFAT {
+		return u.buildVolume(dir, label+".img", strings.ToUpper(volume), SeedFATSize, uploader)
+	}
+
+	return u.buildISO(dir, label+".iso", volume, uploader)
+}
+
+// files returns the content of the files of the seed by name, and the volume
+// label of the seed image.
+func (s Seed) files() (map[string]string, string, error) {
+	if s.Kickstart != "" {
+		if s.UserData != "" || s.Autoinstall != "" || s.MetaData != "" || s.NetworkConfig != "" {
+			return nil, "", ErrSeedConflict
+		}
+
+		return map[string]string{"ks.cfg": s.Kickstart}, KickstartVolumeLabel, nil
+	}
+
+	userData := s.UserData
+	if s.Autoinstall != "" {
+		if userData != "" {
+			return nil, "", ErrSeedConflict
+		}
+		userData = autoinstallUserData(s.Autoinstall)
+	}
+	if userData == "" {
+		return nil, "", ErrEmptySeed
+	}
+
+	// Cloud-init only runs again on an instance whose ID has changed.
+	metaData := s.MetaData
+	if metaData == "" {
+		metaData = fmt.Sprintf("instance-id: adsisto-%d\n", time.Now().UnixNano())
+	}
+
+	files := map[string]string{
+		"user-data": userData,
+		"meta-data": metaData,
+	}
+	if s.NetworkConfig != "" {
+		files["network-config"] = s.NetworkConfig
+	}
+
+	return files, NoCloudVolumeLabel, nil
+}
+
+// buildISO builds an ISO 9660 image with Joliet and Rock Ridge extensions
+// holding the files in dir and adds it to the library.
+func (u *Uploads) buildISO(dir string, label string, volume string, uploader string) (Image, error) {
+	name, args := "genisoimage", []string{}
+	if _, err := exec.LookPath(name); err != nil {
+		name, args = "xorriso", []string{"-as", "mkisofs"}
+	}
+
+	file, err := ioutil.TempFile(u.dir(), "iso")
+	if err != nil {
+		return Image{}, err
+	}
+	path := file.Name()
+	if err = file.Close(); err != nil {
+		_ = os.Remove(path)
+		return Image{}, err
+	}
+
+	args = append(args, "-quiet", "-output", path, "-volid", volume, "-joliet", "-rock", dir)
+	image, err := u.buildISOFile(path, name, args, label, uploader)
+	if err != nil {
+		_ = os.Remove(path)
+	}
+
+	return image, err
+}
+
+func (u *Uploads) buildISOFile(path string, name string, args []string, label string, uploader string) (Image, error) {
+	if err := run(ioutil.Discard, name, args...); err != nil {
+		return Image{}, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return Image{}, err
+	}
+	if err = u.Catalogue.Reserve(info.Size()); err != nil {
+		return Image{}, err
+	}
+
+	return u.commitBuilt(path, label, uploader)
+}
+
+// autoinstallUserData returns the cloud-config user-data holding the
+// autoinstall configuration.
+func autoinstallUserData(autoinstall string) string {
+	lines := strings.Split(strings.TrimRight(autoinstall, "\n"), "\n")
+	for _, line := range lines {
+		if strings.HasPrefix(line, "autoinstall:") {
+			if strings.HasPrefix(autoinstall, "#cloud-config") {
+				return autoinstall
+			}
+			return "#cloud-config\n" + autoinstall
+		}
+	}
+
+	var userData strings.Builder
+	userData.WriteString("#cloud-config\nautoinstall:\n")
+	for _, line := range lines {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if line != "" {
+			userData.WriteString("  ")
+		}
+		userData.WriteString(line)
+		userData.WriteString("\n")
+	}
+
+	return userData.String()
+}
@@ -0,0 +1,60 @@
+/*
+ * Adsisto
+ * Copyright (c) 2019 Andrew Ying
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of version 3 of the GNU General Public License as published by the
+ * Free Software Foundation. In addition, this program is also subject to certain
+ * additional terms available at <SUPPLEMENT.md>.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+ * A PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package images
+
+import (
+	"testing"
+)
+
+func TestAutoinstallUserData(t *testing.T) {
+	tests := []struct {
+		name        string
+		autoinstall string
+		expected    string
+	}{
+		{
+			"without autoinstall key",
+			"version: 1\nidentity:\n  hostname: ubuntu\n",
+			"#cloud-config\nautoinstall:\n  version: 1\n  identity:\n    hostname: ubuntu\n",
+		},
+		{
+			"without autoinstall key and with comments and blank lines",
+			"#cloud-config\nversion: 1\n\nlocale: en_GB.UTF-8",
+			"#cloud-config\nautoinstall:\n  version: 1\n\n  locale: en_GB.UTF-8\n",
+		},
+		{
+			"with autoinstall key",
+			"autoinstall:\n  version: 1\n",
+			"#cloud-config\nautoinstall:\n  version: 1\n",
+		},
+		{
+			"with autoinstall key and cloud-config header",
+			"#cloud-config\nautoinstall:\n  version: 1\n",
+			"#cloud-config\nautoinstall:\n  version: 1\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if userData := autoinstallUserData(test.autoinstall); userData != test.expected {
+				t.Errorf("autoinstallUserData(%q) = %q, expected %q",
+					test.autoinstall, userData, test.expected)
+			}
+		})
+	}
+}
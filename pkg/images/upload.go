@@ -0,0 +1,510 @@
+/*
+ * Adsisto
+ * Copyright (c) 2019 Andrew Ying
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of version 3 of the GNU General Public License as published by the
+ * Free Software Foundation. In addition, this program is also subject to certain
+ * additional terms available at <SUPPLEMENT.md>.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+ * A PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package images
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UploadDir is the name of the directory holding the uploads in progress,
+// kept in the image directory so that completed uploads are moved into the
+// library atomically.
+const UploadDir = ".uploads"
+
+// DefaultUploadExpiry is the time after which an upload which has not
+// received any data is discarded.
+const DefaultUploadExpiry = time.Hour * 24
+
+// importChunk is the space reserved at a time for the data of an import, so
+// that the quota is not checked on every read.
+const importChunk = 64 << 20
+
+// Upload is a resumable upload of an image.
+type Upload struct {
+	ID string `json:"id"`
+	// Label is the name of the file uploaded
+	Label    string    `json:"label"`
+	Length   int64     `json:"length"`
+	Offset   int64     `json:"offset"`
+	Uploader string    `json:"uploader"`
+	Created  time.Time `json:"created"`
+	// Image is the name of the image in the library once the upload is
+	// complete
+	Image string `json:"image,omitempty"`
+	// Hash is the state of the SHA-256 digest of the data received
+	Hash []byte `json:"hash"`
+}
+
+// Uploads keeps the state of the resumable uploads, so that an upload can be
+// resumed from the last byte received after the connection is dropped or the
+// server is restarted.
+type Uploads struct {
+	Catalogue *Catalogue
+	// Expiry is the time after which an upload which has not received any
+	// data is discarded, or DefaultUploadExpiry if 0
+	Expiry time.Duration
+
+	active map[string]bool
+	// imports is the space reserved for each import in progress
+	imports map[string]int64
+	mutex   sync.Mutex
+}
+
+var (
+	ErrUploadNotFound = errors.New("upload not found")
+	ErrUploadBusy     = errors.New("upload is already receiving data")
+	ErrOffsetMismatch = errors.New("offset does not match the data received")
+	ErrUploadComplete = errors.New("upload is already complete")
+)
+
+var (
+	uploadIDPattern = regexp.MustCompile(`^[0-9]+$`)
+)
+
+// Create starts an upload of a file of the given length. The length of the
+// uploads in progress is reserved in the library, so that they cannot
+// together exceed the quota.
+func (u *Uploads) Create(label string, length int64, uploader string) (Upload, error) {
+	if _, err := Extension(label); err != nil {
+		return Upload{}, err
+	}
+
+	u.mutex.Lock()
+	upload, digest, err := u.create(label, length, uploader)
+	u.mutex.Unlock()
+	if err != nil || upload.Length != 0 {
+		return upload, err
+	}
+
+	return u.complete(upload, digest)
+}
+
+// create records a new upload. The caller must hold the lock.
+func (u *Uploads) create(label string, length int64, uploader string) (Upload, hash.Hash, error) {
+	u.expire()
+
+	if err := u.Catalogue.Reserve(length + u.reserved()); err != nil {
+		return Upload{}, nil, err
+	}
+
+	if err := os.MkdirAll(u.dir(), 0755); err != nil {
+		return Upload{}, nil, err
+	}
+
+	now := time.Now()
+	upload := Upload{
+		ID:       strconv.FormatInt(now.UnixNano(), 10),
+		Label:    filepath.Base(label),
+		Length:   length,
+		Uploader: uploader,
+		Created:  now,
+	}
+
+	digest := sha256.New()
+	state, err := digest.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return Upload{}, nil, err
+	}
+	upload.Hash = state
+
+	file, err := os.OpenFile(u.path(upload.ID, ".part"), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return Upload{}, nil, err
+	}
+	if err = file.Close(); err != nil {
+		return Upload{}, nil, err
+	}
+
+	if err = u.save(upload); err != nil {
+		_ = os.Remove(u.path(upload.ID, ".part"))
+		return Upload{}, nil, err
+	}
+
+	return upload, digest, nil
+}
+
+// Get returns the upload with the given ID.
+func (u *Uploads) Get(id string) (Upload, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	return u.load(id)
+}
+
+// Write appends the data read from src to the upload, starting at offset,
+// which must be the number of bytes received so far. The data received is
+// kept even if reading src fails, so that the upload can be resumed.
+func (u *Uploads) Write(id string, offset int64, src io.Reader) (Upload, error) {
+	u.mutex.Lock()
+	upload, err := u.load(id)
+	if err == nil && u.active[id] {
+		err = ErrUploadBusy
+	}
+	if err != nil {
+		u.mutex.Unlock()
+		return upload, err
+	}
+
+	if u.active == nil {
+		u.active = map[string]bool{}
+	}
+	u.active[id] = true
+	u.mutex.Unlock()
+
+	defer func() {
+		u.mutex.Lock()
+		delete(u.active, id)
+		u.mutex.Unlock()
+	}()
+
+	if upload.Image != "" {
+		return upload, ErrUploadComplete
+	}
+	if offset != upload.Offset {
+		return upload, ErrOffsetMismatch
+	}
+
+	digest := sha256.New()
+	if err = digest.(encoding.BinaryUnmarshaler).UnmarshalBinary(upload.Hash); err != nil {
+		return upload, err
+	}
+
+	file, err := os.OpenFile(u.path(id, ".part"), os.O_WRONLY, 0644)
+	if err != nil {
+		return upload, err
+	}
+
+	// Data written after the state was last saved, e.g. before a crash, is
+	// discarded as it is not part of the digest.
+	if err = file.Truncate(upload.Offset); err != nil {
+		_ = file.Close()
+		return upload, err
+	}
+	if _, err = file.Seek(upload.Offset, io.SeekStart); err != nil {
+		_ = file.Close()
+		return upload, err
+	}
+
+	written, copyErr := io.Copy(
+		io.MultiWriter(file, digest),
+		io.LimitReader(src, upload.Length-upload.Offset),
+	)
+	// The data must be on disk before the state refers to it.
+	if err = file.Sync(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	if err = file.Close(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+
+	upload.Offset += written
+	if upload.Hash, err = digest.(encoding.BinaryMarshaler).MarshalBinary(); err != nil {
+		return upload, err
+	}
+
+	// The upload stays active until it is committed, which takes a while for
+	// a compressed file, so that it is neither expired nor deleted meanwhile.
+	if err = u.save(upload); err != nil {
+		return upload, err
+	}
+	if copyErr != nil {
+		return upload, copyErr
+	}
+
+	if upload.Offset == upload.Length {
+		return u.complete(upload, digest)
+	}
+
+	return upload, nil
+}
+
+// Delete discards the upload with the given ID.
+func (u *Uploads) Delete(id string) error {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if _, err := u.load(id); err != nil {
+		return err
+	}
+	if u.active[id] {
+		return ErrUploadBusy
+	}
+
+	return u.remove(id)
+}
+
+// Import adds the file read from src to the library in one go, e.g. for a
+// file uploaded in a form. The file is written to the upload directory first,
+// so that the library never holds a partial image. The space for the data is
+// reserved as it is read, so that the import fails as soon as it exceeds the
+// quota, and is held until the image is in the library.
+func (u *Uploads) Import(src io.Reader, label string, uploader string) (Image, error) {
+	if _, err := Extension(label); err != nil {
+		return Image{}, err
+	}
+
+	if err := os.MkdirAll(u.dir(), 0755); err != nil {
+		return Image{}, err
+	}
+
+	file, err := ioutil.TempFile(u.dir(), "import")
+	if err != nil {
+		return Image{}, err
+	}
+
+	id := filepath.Base(file.Name())
+	defer u.release(id)
+
+	digest := sha256.New()
+	_, err = io.Copy(io.MultiWriter(file, digest), &importReader{uploads: u, id: id, src: src})
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+		return Image{}, err
+	}
+
+	image, err := u.Catalogue.Commit(file.Name(), Image{
+		Label:    filepath.Base(label),
+		SHA256:   hex.EncodeToString(digest.Sum(nil)),
+		Uploaded: time.Now(),
+		Uploader: uploader,
+	})
+	if err != nil {
+		_ = os.Remove(file.Name())
+	}
+
+	return image, err
+}
+
+// reserve checks that the import with the given ID fits within the quota
+// with size bytes, together with the uploads and imports in progress, and
+// reserves the space for it.
+func (u *Uploads) reserve(id string, size int64) error {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if size <= u.imports[id] {
+		return nil
+	}
+
+	others := u.reserved() - u.imports[id]
+	reservation := (size/importChunk + 1) * importChunk
+	err := u.Catalogue.Reserve(reservation + others)
+	if err == ErrQuotaExceeded {
+		// Close to the quota, only the data read so far is reserved.
+		reservation = size
+		err = u.Catalogue.Reserve(reservation + others)
+	}
+	if err != nil {
+		return err
+	}
+
+	if u.imports == nil {
+		u.imports = map[string]int64{}
+	}
+	u.imports[id] = reservation
+
+	return nil
+}
+
+// release frees the space reserved for the import with the given ID.
+func (u *Uploads) release(id string) {
+	u.mutex.Lock()
+	delete(u.imports, id)
+	u.mutex.Unlock()
+}
+
+// complete moves the file uploaded into the library. The state of the upload
+// is kept until it expires, so that the client can find the image created.
+// The caller must not hold the lock, as the file may be decompressed first.
+func (u *Uploads) complete(upload Upload, digest hash.Hash) (Upload, error) {
+	image, err := u.Catalogue.Commit(u.path(upload.ID, ".part"), Image{
+		Label:    upload.Label,
+		SHA256:   hex.EncodeToString(digest.Sum(nil)),
+		Uploaded: time.Now(),
+		Uploader: upload.Uploader,
+	})
+	if err != nil {
+		return upload, err
+	}
+
+	upload.Image = image.Name
+	return upload, u.save(upload)
+}
+
+// expire discards the uploads which have not received data for longer than
+// the expiry time.
+func (u *Uploads) expire() {
+	expiry := u.Expiry
+	if expiry == 0 {
+		expiry = DefaultUploadExpiry
+	}
+
+	files, err := ioutil.ReadDir(u.dir())
+	if err != nil {
+		return
+	}
+
+	for _, file := range files {
+		if time.Since(file.ModTime()) < expiry {
+			continue
+		}
+
+		id := strings.TrimSuffix(file.Name(), filepath.Ext(file.Name()))
+		if uploadIDPattern.MatchString(id) && !u.active[id] {
+			_ = u.remove(id)
+		} else if strings.HasPrefix(file.Name(), "import") && u.imports[file.Name()] == 0 {
+			_ = os.Remove(filepath.Join(u.dir(), file.Name()))
+		}
+	}
+}
+
+// reserved returns the total length of the uploads and imports in progress.
+// The caller must hold the lock.
+func (u *Uploads) reserved() int64 {
+	var length int64
+	for _, reservation := range u.imports {
+		length += reservation
+	}
+
+	files, err := ioutil.ReadDir(u.dir())
+	if err != nil {
+		return length
+	}
+
+	for _, file := range files {
+		id := strings.TrimSuffix(file.Name(), ".json")
+		if filepath.Ext(file.Name()) != ".json" || !uploadIDPattern.MatchString(id) {
+			continue
+		}
+
+		if upload, err := u.load(id); err == nil && upload.Image == "" {
+			length += upload.Length
+		}
+	}
+
+	return length
+}
+
+func (u *Uploads) load(id string) (Upload, error) {
+	if !uploadIDPattern.MatchString(id) {
+		return Upload{}, ErrUploadNotFound
+	}
+
+	content, err := ioutil.ReadFile(u.path(id, ".json"))
+	if os.IsNotExist(err) {
+		return Upload{}, ErrUploadNotFound
+	}
+	if err != nil {
+		return Upload{}, err
+	}
+
+	upload := Upload{}
+	if err = json.Unmarshal(content, &upload); err != nil {
+		return Upload{}, err
+	}
+
+	return upload, nil
+}
+
+// save writes the state of the upload to a temporary file first, so that the
+// state is never left partially written.
+func (u *Uploads) save(upload Upload) error {
+	encoded, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(u.dir(), "."+upload.ID)
+	if err != nil {
+		return err
+	}
+
+	if _, err = file.Write(encoded); err != nil {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		return err
+	}
+	if err = file.Close(); err != nil {
+		_ = os.Remove(file.Name())
+		return err
+	}
+
+	return os.Rename(file.Name(), u.path(upload.ID, ".json"))
+}
+
+func (u *Uploads) remove(id string) error {
+	if err := os.Remove(u.path(id, ".part")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.Remove(u.path(id, ".json")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// importReader reserves the space for the data read from src as it is read.
+type importReader struct {
+	uploads *Uploads
+	id      string
+	src     io.Reader
+	read    int64
+}
+
+func (r *importReader) Read(p []byte) (int, error) {
+	n, err := r.src.Read(p)
+	if n > 0 {
+		r.read += int64(n)
+		if reserveErr := r.uploads.reserve(r.id, r.read); reserveErr != nil {
+			return n, reserveErr
+		}
+	}
+
+	return n, err
+}
+
+func (u *Uploads) dir() string {
+	return filepath.Join(u.Catalogue.Dir, UploadDir)
+}
+
+func (u *Uploads) path(id string, extension string) string {
+	return filepath.Join(u.dir(), id+extension)
+}
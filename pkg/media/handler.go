@@ -0,0 +1,177 @@
+/*
+ * Adsisto
+ * Copyright (c) 2019 Andrew Ying
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of version 3 of the GNU General Public License as published by the
+ * Free Software Foundation. In addition, this program is also subject to certain
+ * additional terms available at <SUPPLEMENT.md>.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+ * A PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package media
+
+import (
+	"encoding/json"
+	"github.com/adsisto/adsisto/pkg/images"
+	"github.com/adsisto/adsisto/pkg/response"
+	"gopkg.in/go-playground/validator.v9"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+type mountRequest struct {
+	LUN   int    `json:"lun" validate:"gte=0"`
+	Image string `json:"image" validate:"required"`
+	Options
+}
+
+type ejectRequest struct {
+	LUN int `json:"lun" validate:"gte=0"`
+	EjectOptions
+}
+
+var (
+	validate = validator.New()
+)
+
+// StatusHandler reports the media mounted on the logical units, or on the
+// logical unit given in the lun query parameter.
+func (m *Manager) StatusHandler(w http.ResponseWriter, r *http.Request) {
+	media, err := m.Status()
+	if err != nil {
+		mediaError(w, "unable to retrieve media status", err)
+		return
+	}
+
+	if query := r.URL.Query().Get("lun"); query != "" {
+		lun, err := strconv.Atoi(query)
+		if err != nil {
+			invalidUserInput(w)
+			return
+		}
+
+		for _, medium := range media {
+			if medium.LUN == lun {
+				response.JSON(w, http.StatusOK, map[string]interface{}{
+					"code":   http.StatusOK,
+					"medium": medium,
+				})
+				return
+			}
+		}
+
+		mediaError(w, "unable to retrieve media status", ErrUnknownLUN)
+		return
+	}
+
+	response.JSON(w, http.StatusOK, map[string]interface{}{
+		"code":  http.StatusOK,
+		"media": media,
+	})
+}
+
+// MountHandler mounts the image in the request on the logical unit.
+func (m *Manager) MountHandler(w http.ResponseWriter, r *http.Request) {
+	request := &mountRequest{}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(request); err != nil {
+		invalidUserInput(w)
+		return
+	}
+
+	if err := validate.Struct(request); err != nil {
+		invalidUserInput(w)
+		return
+	}
+
+	if err := m.Mount(request.LUN, request.Image, request.Options); err != nil {
+		mediaError(w, "unable to mount image", err)
+		return
+	}
+
+	log.Printf("[INFO] Mounted image %s on LUN %d\n", request.Image, request.LUN)
+	m.StatusHandler(w, r)
+}
+
+// EjectHandler ejects the medium from the logical unit in the request.
+func (m *Manager) EjectHandler(w http.ResponseWriter, r *http.Request) {
+	request := &ejectRequest{}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(request); err != nil {
+		invalidUserInput(w)
+		return
+	}
+
+	if err := validate.Struct(request); err != nil {
+		invalidUserInput(w)
+		return
+	}
+
+	options := request.EjectOptions
+	options.Uploader = images.Uploader(r)
+
+	image, err := m.Eject(request.LUN, options)
+	if err != nil {
+		mediaError(w, "unable to eject medium", err)
+		return
+	}
+
+	log.Printf("[INFO] Ejected medium from LUN %d\n", request.LUN)
+	if image.Name != "" {
+		log.Printf("[INFO] Added image %s with the changes made by the host\n", image.Name)
+	}
+
+	media, err := m.Status()
+	if err != nil {
+		mediaError(w, "unable to retrieve media status", err)
+		return
+	}
+
+	response.JSON(w, http.StatusOK, map[string]interface{}{
+		"code":  http.StatusOK,
+		"media": media,
+		"image": image,
+	})
+}
+
+// mediaError responds with the status matching the error.
+func mediaError(w http.ResponseWriter, message string, err error) {
+	switch err {
+	case ErrImageNotFound, ErrUnknownLUN:
+		response.JSON(w, http.StatusNotFound, map[string]interface{}{
+			"code":    http.StatusNotFound,
+			"message": err.Error(),
+		})
+	case ErrUnknownAction:
+		response.JSON(w, http.StatusUnprocessableEntity, map[string]interface{}{
+			"code":    http.StatusUnprocessableEntity,
+			"message": err.Error(),
+		})
+	case ErrNoMassStorage, ErrMediumLocked, ErrOverlayPending:
+		response.JSON(w, http.StatusConflict, map[string]interface{}{
+			"code":    http.StatusConflict,
+			"message": err.Error(),
+		})
+	default:
+		log.Printf("[ERROR] Unable to access mass storage: %s\n", err)
+		response.JSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"code":    http.StatusInternalServerError,
+			"message": message,
+		})
+	}
+}
+
+func invalidUserInput(w http.ResponseWriter) {
+	response.JSON(w, http.StatusBadRequest, map[string]interface{}{
+		"code":    http.StatusBadRequest,
+		"message": "invalid user inputs",
+	})
+}
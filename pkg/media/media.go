@@ -0,0 +1,549 @@
+/*
+ * Adsisto
+ * Copyright (c) 2019 Andrew Ying
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of version 3 of the GNU General Public License as published by the
+ * Free Software Foundation. In addition, this program is also subject to certain
+ * additional terms available at <SUPPLEMENT.md>.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+ * A PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package media
+
+import (
+	"errors"
+	"fmt"
+	"github.com/adsisto/adsisto/pkg/images"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Manager attaches images from the library to the logical units of the mass
+// storage function of the USB gadget.
+type Manager struct {
+	// Dir is the path to the directory of the mass storage function in
+	// configfs, e.g. /sys/kernel/config/usb_gadget/adsisto/functions/mass_storage.usb0
+	Dir string
+	// Catalogue is the image library
+	Catalogue *images.Catalogue
+	// Uploads adds the images with the changes made by the host to the
+	// library
+	Uploads *images.Uploads
+	// OverlayDir is the path to the directory of the overlays of writable
+	// media, or empty if the host writes to the images directly
+	OverlayDir string
+
+	// mutex must not be held while calling the catalogue, which checks
+	// whether images are mounted while holding its own lock
+	mutex sync.Mutex
+	// ejecting are the logical units whose changes are being copied
+	ejecting map[int]bool
+}
+
+// Options are the modes in which a medium is mounted.
+type Options struct {
+	// CDROM presents the medium as an optical disc instead of a removable
+	// disk if true, or as a disk if false. The mode matches the type of the
+	// image in the library if nil. Optical discs are always read-only.
+	CDROM    *bool `json:"cdrom"`
+	ReadOnly bool  `json:"readOnly"`
+	// Removable reports the medium as removable to the host if true, or as
+	// fixed if false. The unit keeps its current setting if nil.
+	Removable *bool `json:"removable"`
+	// Direct lets the host write to the image in the library instead of an
+	// overlay. The image is renamed after the digest of its new content once
+	// ejected or replaced.
+	Direct bool `json:"direct"`
+}
+
+// EjectOptions are the options of ejecting a medium.
+type EjectOptions struct {
+	// Force ejects the medium even if the host has locked it
+	Force bool `json:"force"`
+	// Action is what happens to the changes made by the host to a writable
+	// medium, i.e. EjectDiscard, EjectKeep or EjectMerge
+	Action string `json:"action" validate:"omitempty,oneof=discard keep merge"`
+	// Uploader is the name of the user ejecting the medium, recorded as the
+	// uploader of the image kept
+	Uploader string `json:"-"`
+}
+
+// Medium is the state of a logical unit.
+type Medium struct {
+	LUN int `json:"lun"`
+	// Image is the name of the image in the library, or empty if the file
+	// mounted is not part of the library
+	Image string `json:"image"`
+	// File is the path to the file mounted, or empty if no medium is present
+	File      string `json:"file"`
+	CDROM     bool   `json:"cdrom"`
+	ReadOnly  bool   `json:"readOnly"`
+	Removable bool   `json:"removable"`
+	// Overlay reports whether the changes made by the host are written to an
+	// overlay
+	Overlay bool `json:"overlay"`
+}
+
+var (
+	ErrNoMassStorage = errors.New("gadget has no mass storage function")
+	ErrUnknownLUN    = errors.New("logical unit not found")
+	ErrImageNotFound = errors.New("image not found")
+	ErrMediumLocked  = errors.New("medium is locked by the host")
+)
+
+// Mount attaches the image to the logical unit, ejecting the medium currently
+// present if any.
+func (m *Manager) Mount(lun int, image string, options Options) error {
+	written, rehashed, err := m.ejectWritten(lun)
+	if err != nil {
+		return err
+	}
+	if written != "" && written == image {
+		image = rehashed.Name
+	}
+
+	path, err := m.imagePath(image)
+	if err != nil {
+		return err
+	}
+
+	cdrom := false
+	if options.CDROM != nil {
+		cdrom = *options.CDROM
+	} else if metadata, err := m.Catalogue.Get(image); err == nil {
+		cdrom = metadata.Type == images.TypeCDROM
+	} else {
+		cdrom = images.TypeOf(image) == images.TypeCDROM
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	dir, err := m.lunDir(lun)
+	if err != nil {
+		return err
+	}
+
+	if overlay, err := m.loadOverlay(lun); err != nil {
+		return err
+	} else if overlay != nil || m.ejecting[lun] {
+		return ErrOverlayPending
+	}
+
+	// Another image written directly may have been mounted in the meantime.
+	if written, err = m.writtenImage(dir); err != nil {
+		return err
+	} else if written != "" {
+		return ErrOverlayPending
+	}
+
+	if err = writeAttribute(dir, "file", ""); err != nil {
+		return err
+	}
+
+	attributes := map[string]bool{
+		"cdrom": cdrom,
+		"ro":    options.ReadOnly || cdrom,
+	}
+	if options.Removable != nil {
+		attributes["removable"] = *options.Removable
+	}
+	for name, flag := range attributes {
+		value := "0"
+		if flag {
+			value = "1"
+		}
+
+		if err = writeAttribute(dir, name, value); err != nil {
+			return err
+		}
+	}
+
+	if options.ReadOnly || cdrom || options.Direct || m.OverlayDir == "" {
+		return writeAttribute(dir, "file", path)
+	}
+
+	overlay, err := m.createOverlay(lun, image, path)
+	if err != nil {
+		return err
+	}
+
+	if err = writeAttribute(dir, "file", overlay.Device()); err != nil {
+		_ = m.removeOverlay(overlay)
+		return err
+	}
+
+	return nil
+}
+
+// Eject detaches the medium from the logical unit. Unless forced, ejecting
+// fails with ErrMediumLocked if the host has prevented the removal of the
+// medium. The changes made by the host to a medium with an overlay are then
+// discarded or added to the library, in which case the image created is
+// returned. An image the host wrote to directly is renamed after the digest of
+// its new content, and returned.
+func (m *Manager) Eject(lun int, options EjectOptions) (images.Image, error) {
+	switch options.Action {
+	case "", EjectDiscard, EjectKeep, EjectMerge:
+	default:
+		return images.Image{}, ErrUnknownAction
+	}
+
+	m.mutex.Lock()
+	if m.ejecting[lun] {
+		m.mutex.Unlock()
+		return images.Image{}, ErrOverlayPending
+	}
+	overlay, written, err := m.eject(lun, options.Force)
+	if err != nil || (overlay == nil && written == "") {
+		m.mutex.Unlock()
+		return images.Image{}, err
+	}
+	if m.ejecting == nil {
+		m.ejecting = map[int]bool{}
+	}
+	m.ejecting[lun] = true
+	m.mutex.Unlock()
+
+	// The changes are copied without holding the lock, as it takes a while
+	// and the catalogue checks whether images are mounted. The overlay
+	// prevents other media from being mounted on the unit in the meantime.
+	var image images.Image
+	if written != "" {
+		image, err = m.Catalogue.Rehash(written)
+	} else if options.Action == EjectKeep || options.Action == EjectMerge {
+		image, err = m.keepOverlay(overlay, options)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.ejecting, lun)
+
+	// The overlay is kept if its changes could not be copied, so that
+	// ejecting can be retried.
+	if err != nil || overlay == nil {
+		return image, err
+	}
+
+	return image, m.removeOverlay(overlay)
+}
+
+// eject detaches the medium from the logical unit and returns its overlay, if
+// any, or the name of the image the host wrote to directly, if any.
+func (m *Manager) eject(lun int, force bool) (*Overlay, string, error) {
+	dir, err := m.lunDir(lun)
+	if err != nil {
+		return nil, "", err
+	}
+
+	written, err := m.writtenImage(dir)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if force {
+		if _, err = os.Stat(filepath.Join(dir, "forced_eject")); err == nil {
+			err = writeAttribute(dir, "forced_eject", "1")
+		} else {
+			err = writeAttribute(dir, "file", "")
+		}
+	} else {
+		err = writeAttribute(dir, "file", "")
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	overlay, err := m.loadOverlay(lun)
+	return overlay, written, err
+}
+
+// ejectWritten ejects the image the host wrote to directly from the logical
+// unit, if any, and renames it after the digest of its new content. Returns the
+// name of the image ejected, and the image renamed. The image is hashed without
+// holding the lock, as it takes a while and the catalogue checks whether images
+// are mounted.
+func (m *Manager) ejectWritten(lun int) (string, images.Image, error) {
+	m.mutex.Lock()
+	if m.ejecting[lun] {
+		m.mutex.Unlock()
+		return "", images.Image{}, ErrOverlayPending
+	}
+
+	dir, err := m.lunDir(lun)
+	if err != nil {
+		m.mutex.Unlock()
+		return "", images.Image{}, err
+	}
+
+	written, err := m.writtenImage(dir)
+	if err == nil && written != "" {
+		err = writeAttribute(dir, "file", "")
+	}
+	if err != nil || written == "" {
+		m.mutex.Unlock()
+		return "", images.Image{}, err
+	}
+
+	if m.ejecting == nil {
+		m.ejecting = map[int]bool{}
+	}
+	m.ejecting[lun] = true
+	m.mutex.Unlock()
+
+	image, err := m.Catalogue.Rehash(written)
+
+	m.mutex.Lock()
+	delete(m.ejecting, lun)
+	m.mutex.Unlock()
+
+	return written, image, err
+}
+
+// writtenImage returns the name of the image in the library mounted writable
+// without an overlay on the logical unit, or empty if none.
+func (m *Manager) writtenImage(dir string) (string, error) {
+	file, err := readAttribute(dir, "file")
+	if err != nil || file == "" {
+		return "", err
+	}
+
+	readOnly, err := readAttribute(dir, "ro")
+	if err != nil || readOnly == "1" {
+		return "", err
+	}
+
+	imageDir, err := filepath.Abs(m.Catalogue.Dir)
+	if err != nil {
+		return "", err
+	}
+	if filepath.Dir(file) != imageDir {
+		return "", nil
+	}
+
+	return filepath.Base(file), nil
+}
+
+// keepOverlay adds the image with the changes made by the host to the
+// library. When merging, the new image replaces the original image, unless it
+// is mounted on another logical unit.
+func (m *Manager) keepOverlay(overlay *Overlay, options EjectOptions) (images.Image, error) {
+	original, err := m.Catalogue.Get(overlay.Image)
+	if err != nil {
+		return images.Image{}, err
+	}
+
+	label := original.Label
+	if options.Action == EjectKeep {
+		extension := filepath.Ext(label)
+		label = fmt.Sprintf("%s (%s)%s",
+			strings.TrimSuffix(label, extension),
+			time.Now().Format("2006-01-02 15:04"),
+			extension,
+		)
+	}
+
+	device, err := os.Open(overlay.Device())
+	if err != nil {
+		return images.Image{}, err
+	}
+	defer device.Close()
+
+	image, err := m.Uploads.Import(device, label, options.Uploader)
+	if err != nil {
+		return images.Image{}, err
+	}
+
+	if options.Action == EjectMerge && image.Name != original.Name {
+		err = m.Catalogue.Delete(original.Name)
+		if err == images.ErrImageInUse {
+			log.Printf("[INFO] Kept image %s mounted on another LUN\n", original.Name)
+		} else if err != nil {
+			return image, err
+		}
+	}
+
+	return image, nil
+}
+
+// Status returns the state of the logical units, ordered by number.
+func (m *Manager) Status() ([]Medium, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	luns, err := m.luns()
+	if err != nil {
+		return nil, err
+	}
+
+	imageDir, err := filepath.Abs(m.Catalogue.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	media := make([]Medium, 0, len(luns))
+	for _, lun := range luns {
+		dir := filepath.Join(m.Dir, fmt.Sprintf("lun.%d", lun))
+		medium := Medium{
+			LUN: lun,
+		}
+
+		if medium.File, err = readAttribute(dir, "file"); err != nil {
+			return nil, err
+		}
+		if medium.File != "" && filepath.Dir(medium.File) == imageDir {
+			medium.Image = filepath.Base(medium.File)
+		}
+
+		overlay, err := m.loadOverlay(lun)
+		if err != nil {
+			return nil, err
+		}
+		if overlay != nil && medium.File == overlay.Device() {
+			medium.Image = overlay.Image
+			medium.Overlay = true
+		}
+
+		flags := []struct {
+			name  string
+			value *bool
+		}{
+			{"cdrom", &medium.CDROM},
+			{"ro", &medium.ReadOnly},
+			{"removable", &medium.Removable},
+		}
+		for _, flag := range flags {
+			value, err := readAttribute(dir, flag.name)
+			if err != nil {
+				return nil, err
+			}
+			*flag.value = value == "1"
+		}
+
+		media = append(media, medium)
+	}
+
+	return media, nil
+}
+
+// InUse reports whether the image is mounted on any logical unit.
+func (m *Manager) InUse(image string) (bool, error) {
+	media, err := m.Status()
+	if err == ErrNoMassStorage {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	for _, medium := range media {
+		if medium.Image == image {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// imagePath returns the absolute path to the image in the library.
+func (m *Manager) imagePath(image string) (string, error) {
+	path, err := m.Catalogue.Path(image)
+	if err != nil {
+		return "", ErrImageNotFound
+	}
+
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) || (err == nil && !info.Mode().IsRegular()) {
+		return "", ErrImageNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Abs(path)
+}
+
+// luns returns the numbers of the logical units of the function.
+func (m *Manager) luns() ([]int, error) {
+	if m.Dir == "" {
+		return nil, ErrNoMassStorage
+	}
+
+	files, err := ioutil.ReadDir(m.Dir)
+	if os.IsNotExist(err) {
+		return nil, ErrNoMassStorage
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var luns []int
+	for _, file := range files {
+		if !file.IsDir() || !strings.HasPrefix(file.Name(), "lun.") {
+			continue
+		}
+
+		lun, err := strconv.Atoi(strings.TrimPrefix(file.Name(), "lun."))
+		if err == nil {
+			luns = append(luns, lun)
+		}
+	}
+	sort.Ints(luns)
+
+	return luns, nil
+}
+
+// lunDir returns the path to the directory of the logical unit.
+func (m *Manager) lunDir(lun int) (string, error) {
+	if m.Dir == "" {
+		return "", ErrNoMassStorage
+	}
+	if _, err := os.Stat(m.Dir); os.IsNotExist(err) {
+		return "", ErrNoMassStorage
+	}
+
+	dir := filepath.Join(m.Dir, fmt.Sprintf("lun.%d", lun))
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return "", ErrUnknownLUN
+	} else if err != nil {
+		return "", err
+	}
+
+	return dir, nil
+}
+
+func readAttribute(dir string, name string) (string, error) {
+	content, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(content)), nil
+}
+
+// writeAttribute writes the value to the attribute of the logical unit. The
+// kernel refuses to change the medium or its mode with EBUSY while the host
+// prevents its removal.
+func writeAttribute(dir string, name string, value string) error {
+	err := ioutil.WriteFile(filepath.Join(dir, name), []byte(value+"\n"), 0644)
+	if pathErr, ok := err.(*os.PathError); ok && pathErr.Err == syscall.EBUSY {
+		return ErrMediumLocked
+	}
+
+	return err
+}
@@ -0,0 +1,241 @@
+/*
+ * Adsisto
+ * Copyright (c) 2019 Andrew Ying
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of version 3 of the GNU General Public License as published by the
+ * Free Software Foundation. In addition, this program is also subject to certain
+ * additional terms available at <SUPPLEMENT.md>.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+ * A PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package media
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Actions on the overlay of a writable medium when it is ejected.
+const (
+	// EjectDiscard discards the changes made by the host
+	EjectDiscard = "discard"
+	// EjectKeep adds the image with the changes made by the host to the
+	// library as a new image
+	EjectKeep = "keep"
+	// EjectMerge replaces the image in the library with the image with the
+	// changes made by the host
+	EjectMerge = "merge"
+)
+
+// SnapshotChunkSize is the size of the chunks of the snapshot in sectors.
+const SnapshotChunkSize = 8
+
+// Overlay is a copy-on-write snapshot of an image, which holds the changes
+// made by the host so that the image in the library is left untouched. The
+// snapshot is a device-mapper target backed by loop devices of the image and
+// of the overlay file.
+type Overlay struct {
+	LUN   int    `json:"lun"`
+	Image string `json:"image"`
+	// File is the path to the overlay file holding the changes
+	File string `json:"file"`
+	// Name is the name of the device-mapper device
+	Name string `json:"name"`
+	// Origin and Store are the loop devices of the image and of the overlay
+	// file respectively
+	Origin string `json:"origin"`
+	Store  string `json:"store"`
+}
+
+var (
+	ErrOverlayPending = errors.New("medium with pending changes must be ejected first")
+	ErrUnknownAction  = errors.New("action on eject must be discard, keep or merge")
+)
+
+// Device returns the path to the device-mapper device of the overlay.
+func (o *Overlay) Device() string {
+	return "/dev/mapper/" + o.Name
+}
+
+// createOverlay creates a copy-on-write snapshot of the image at path for the
+// logical unit. Requires losetup and dmsetup.
+func (m *Manager) createOverlay(lun int, image string, path string) (*Overlay, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = os.MkdirAll(m.OverlayDir, 0755); err != nil {
+		return nil, err
+	}
+
+	overlay := &Overlay{
+		LUN:   lun,
+		Image: image,
+		File:  filepath.Join(m.OverlayDir, fmt.Sprintf("lun.%d.cow", lun)),
+		Name:  fmt.Sprintf("adsisto-lun%d", lun),
+	}
+
+	// The overlay file is sparse, so it only takes up the space of the
+	// chunks changed, but must be large enough for every chunk of the image
+	// and the metadata of the snapshot.
+	file, err := os.OpenFile(overlay.File, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = file.Truncate(info.Size() + info.Size()/8 + 8<<20)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(overlay.File)
+		return nil, err
+	}
+
+	if err = m.saveOverlay(overlay); err != nil {
+		_ = os.Remove(overlay.File)
+		return nil, err
+	}
+
+	if overlay.Origin, err = command("losetup", "--find", "--show", "--read-only", path); err != nil {
+		_ = m.removeOverlay(overlay)
+		return nil, err
+	}
+	if err = m.saveOverlay(overlay); err != nil {
+		_ = m.removeOverlay(overlay)
+		return nil, err
+	}
+
+	if overlay.Store, err = command("losetup", "--find", "--show", overlay.File); err != nil {
+		_ = m.removeOverlay(overlay)
+		return nil, err
+	}
+	if err = m.saveOverlay(overlay); err != nil {
+		_ = m.removeOverlay(overlay)
+		return nil, err
+	}
+
+	table := fmt.Sprintf("0 %d snapshot %s %s P %d",
+		info.Size()/512, overlay.Origin, overlay.Store, SnapshotChunkSize,
+	)
+	if _, err = command("dmsetup", "create", overlay.Name, "--table", table); err != nil {
+		_ = m.removeOverlay(overlay)
+		return nil, err
+	}
+
+	return overlay, nil
+}
+
+// removeOverlay tears down the snapshot and discards the overlay file.
+func (m *Manager) removeOverlay(overlay *Overlay) error {
+	if _, err := os.Stat(overlay.Device()); err == nil {
+		if _, err = command("dmsetup", "remove", overlay.Name); err != nil {
+			return err
+		}
+	}
+
+	for _, device := range []string{overlay.Store, overlay.Origin} {
+		if device == "" {
+			continue
+		}
+
+		// The loop devices are gone if the system was restarted.
+		if _, err := command("losetup", "--detach", device); err != nil {
+			log.Printf("[WARN] Unable to detach loop device: %s\n", err)
+		}
+	}
+
+	if err := os.Remove(overlay.File); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	err := os.Remove(m.overlayState(overlay.LUN))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// loadOverlay returns the overlay of the logical unit, or nil if the unit has
+// no overlay.
+func (m *Manager) loadOverlay(lun int) (*Overlay, error) {
+	if m.OverlayDir == "" {
+		return nil, nil
+	}
+
+	content, err := ioutil.ReadFile(m.overlayState(lun))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	overlay := &Overlay{}
+	if err = json.Unmarshal(content, overlay); err != nil {
+		return nil, err
+	}
+
+	return overlay, nil
+}
+
+// saveOverlay writes the state of the overlay, so that its devices can be
+// torn down after a restart.
+func (m *Manager) saveOverlay(overlay *Overlay) error {
+	encoded, err := json.Marshal(overlay)
+	if err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(m.OverlayDir, ".overlay")
+	if err != nil {
+		return err
+	}
+
+	if _, err = file.Write(encoded); err != nil {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		return err
+	}
+	if err = file.Close(); err != nil {
+		_ = os.Remove(file.Name())
+		return err
+	}
+
+	return os.Rename(file.Name(), m.overlayState(overlay.LUN))
+}
+
+func (m *Manager) overlayState(lun int) string {
+	return filepath.Join(m.OverlayDir, fmt.Sprintf("lun.%d.json", lun))
+}
+
+// command runs the command and returns its output.
+func command(name string, args ...string) (string, error) {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%s: %s: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return strings.TrimSpace(stdout.String()), nil
+}